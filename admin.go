@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventSize 默认保留的最近事件数量
+const EventSize = 100
+
+// Event 服务端事件
+type Event struct {
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"` // auth / port / conn / error / server
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+}
+
+// EventLog 最近事件的环形缓冲
+type EventLog struct {
+	mu   sync.Mutex
+	buf  []Event
+	next int
+	full bool
+}
+
+// NewEventLog 创建保留最近n条事件的缓冲
+func NewEventLog(n int) *EventLog {
+	if n <= 0 {
+		n = EventSize
+	}
+	return &EventLog{buf: make([]Event, n)}
+}
+
+// Add 记录事件，缓冲满后覆盖最早的事件
+func (l *EventLog) Add(level Level, kind, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf[l.next] = Event{Time: time.Now(), Kind: kind, Level: level.String(), Msg: msg}
+	l.next++
+	if l.next == len(l.buf) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// Println 输出日志并记录事件，error类事件为error级别，其余为info级别
+func (l *EventLog) Println(kind string, v ...interface{}) {
+	level := LevelInfo
+	if kind == "error" {
+		level = LevelError
+	}
+	l.log(level, kind, v...)
+}
+
+// Debugln 以debug级别输出日志并记录事件，用于逐个连接的事件
+func (l *EventLog) Debugln(kind string, v ...interface{}) {
+	l.log(LevelDebug, kind, v...)
+}
+
+// Warnln 以warn级别输出日志并记录事件，用于被拒绝的认证与连接等
+func (l *EventLog) Warnln(kind string, v ...interface{}) {
+	l.log(LevelWarn, kind, v...)
+}
+
+func (l *EventLog) log(level Level, kind string, v ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	switch level {
+	case LevelError:
+		logger.Error(msg)
+	case LevelWarn:
+		logger.Warn(msg)
+	case LevelDebug:
+		logger.Debug(msg)
+	default:
+		logger.Info(msg)
+	}
+	l.Add(level, kind, msg)
+}
+
+// List 按时间顺序返回缓冲中的事件
+func (l *EventLog) List() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Event(nil), l.buf[:l.next]...)
+	}
+	return append(append([]Event(nil), l.buf[l.next:]...), l.buf[:l.next]...)
+}
+
+// ServeHTTP 以JSON输出最近事件
+func (l *EventLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.List())
+}
+
+// localOnly 只允许本机访问，否则返回403
+func localOnly(w http.ResponseWriter, r *http.Request) bool {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		http.Error(w, "only allowed from localhost", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// startAdmin 启动管理接口
+func startAdmin(addr string, mux *http.ServeMux) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("Admin listening on", addr)
+	go http.Serve(lis, mux)
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// allowRule 允许转发的内网地址：网段或主机名，可限定端口；或Unix域套接字地址
+type allowRule struct {
+	ipnet *net.IPNet
+	host  string
+	port  string
+	unix  string
+}
+
+// allowList 允许转发的内网地址，为nil时不限制
+type allowList []allowRule
+
+// parseAllowList 解析allow_inner，每项为IP、网段或主机名，可加端口如192.168.1.0/24:80、[fd00::/8]:443，或Unix域套接字如unix:/run/app.sock；entries为nil时不限制
+func parseAllowList(entries []string) (allowList, error) {
+	if entries == nil {
+		return nil, nil
+	}
+	var list = make(allowList, 0, len(entries))
+	for _, e := range entries {
+		var rule allowRule
+		if strings.HasPrefix(e, UnixScheme) {
+			// Unix域套接字按完整地址匹配
+			rule.unix = e
+			list = append(list, rule)
+			continue
+		}
+		host := e
+		if h, p, err := net.SplitHostPort(e); err == nil {
+			if _, err := net.LookupPort("tcp", p); err != nil {
+				return nil, fmt.Errorf("bad port in allow_inner %q", e)
+			}
+			host, rule.port = h, p
+		}
+		if ipnet, ok := parseNet(host); ok {
+			rule.ipnet = ipnet
+		} else if host != "" {
+			rule.host = strings.ToLower(host)
+		} else {
+			return nil, fmt.Errorf("bad allow_inner %q", e)
+		}
+		list = append(list, rule)
+	}
+	return list, nil
+}
+
+// Allowed addr(host:port)是否允许转发；主机名匹配网段时解析后的所有地址都须在网段内
+func (l allowList) Allowed(addr string) bool {
+	_, ok := l.Resolve(addr)
+	return ok
+}
+
+// Resolve 校验addr是否允许转发，并返回应连接的地址：主机名按网段校验时为校验过的IP，
+// 连接时不再重新解析，避免校验之后DNS记录被改为列表外的地址；其余情况原样返回addr
+func (l allowList) Resolve(addr string) (string, bool) {
+	if l == nil {
+		return addr, true
+	}
+	if strings.HasPrefix(addr, UnixScheme) {
+		for _, rule := range l {
+			if rule.unix == addr {
+				return addr, true
+			}
+		}
+		return "", false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{normalizeIP(ip)}
+	}
+	var resolved bool
+	for _, rule := range l {
+		if rule.unix != "" || rule.port != "" && rule.port != port {
+			continue
+		}
+		if rule.ipnet == nil {
+			if strings.EqualFold(rule.host, host) {
+				// 按名称允许，信任该名称解析的结果
+				return addr, true
+			}
+			continue
+		}
+		if ips == nil && !resolved {
+			resolved = true
+			ips, _ = net.LookupIP(host)
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		all := true
+		for _, ip := range ips {
+			all = all && rule.ipnet.Contains(normalizeIP(ip))
+		}
+		if all {
+			return net.JoinHostPort(ips[0].String(), port), true
+		}
+	}
+	return "", false
+}
+
+// checkAllow 校验映射配置中固定的内网地址，并记录映射使用的允许列表；
+// 映射配置了allow_inner时代替客户端的全局设置；代理端口必须有允许列表，否则任何访问者都能经由客户端连接整个内网
+func (m *ClientMapConfig) checkAllow(global allowList) error {
+	m.allow = global
+	if m.AllowInner != nil {
+		var err error
+		if m.allow, err = parseAllowList(m.AllowInner); err != nil {
+			return fmt.Errorf("%v, port %v", err, m.Outer)
+		}
+	}
+	if m.ForwardProxy != "" && m.allow == nil {
+		return fmt.Errorf("forward_proxy requires allow_inner, port %v", m.Outer)
+	}
+	if m.Dir != nil || m.Inner == StdioInner {
+		return nil
+	}
+	var addrs []string
+	if m.lb != nil {
+		for _, be := range m.lb.backends {
+			addrs = append(addrs, be.addr)
+		}
+	} else if m.Inner != "" && !m.Transparent && m.ForwardProxy == "" {
+		addrs = append(addrs, m.Inner)
+	}
+	for _, rule := range m.Detect {
+		if rule.Inner != "" {
+			addrs = append(addrs, rule.Inner)
+		}
+	}
+	for _, addr := range addrs {
+		if !m.allow.Allowed(addr) {
+			return fmt.Errorf("inner %v for port %v is not in allow_inner", addr, m.Outer)
+		}
+	}
+	return nil
+}
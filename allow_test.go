@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckAllowForwardProxy(t *testing.T) {
+	global, _ := parseAllowList([]string{"10.0.0.0/8"})
+	tests := []struct {
+		name    string
+		m       ClientMapConfig
+		global  allowList
+		wantErr bool
+	}{
+		{"no allow list", ClientMapConfig{Outer: 1, ForwardProxy: ForwardSOCKS5}, nil, true},
+		{"global list", ClientMapConfig{Outer: 1, ForwardProxy: ForwardSOCKS5}, global, false},
+		{"mapping list", ClientMapConfig{Outer: 1, ForwardProxy: ForwardHTTP, AllowInner: []string{"192.168.1.0/24"}}, nil, false},
+		{"empty mapping list denies all", ClientMapConfig{Outer: 1, ForwardProxy: ForwardHTTP, AllowInner: []string{}}, nil, false},
+		{"plain mapping", ClientMapConfig{Outer: 1, Inner: "127.0.0.1:80"}, nil, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.m.normalize(); err != nil {
+				t.Fatal(err)
+			}
+			err := tt.m.checkAllow(tt.global)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkAllow = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllowResolve(t *testing.T) {
+	list, err := parseAllowList([]string{"127.0.0.0/8", "::1", "intranet.example:443", "unix:/run/app.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want string // 为空时不允许，"ip"表示应返回解析得到的IP
+	}{
+		{"127.0.0.1:80", "127.0.0.1:80"},
+		{"[::1]:80", "[::1]:80"},
+		{"10.0.0.1:80", ""},
+		{"localhost:8080", "ip"},
+		{"intranet.example:443", "intranet.example:443"},
+		{"intranet.example:80", ""},
+		{"unix:/run/app.sock", "unix:/run/app.sock"},
+		{"unix:/run/other.sock", ""},
+		{"no-port", ""},
+	}
+	for _, tt := range tests {
+		got, ok := list.Resolve(tt.addr)
+		switch {
+		case tt.want == "":
+			if ok {
+				t.Errorf("Resolve(%q) = %q, want refused", tt.addr, got)
+			}
+		case tt.want == "ip":
+			// 连接校验过的IP，而不是再次解析主机名
+			host, port, err := net.SplitHostPort(got)
+			if !ok || err != nil || net.ParseIP(host) == nil || port != "8080" {
+				t.Errorf("Resolve(%q) = %q, %v; want a validated IP", tt.addr, got, ok)
+			}
+		case !ok || got != tt.want:
+			t.Errorf("Resolve(%q) = %q, %v; want %q", tt.addr, got, ok, tt.want)
+		}
+	}
+	if got, ok := allowList(nil).Resolve("anything:1"); !ok || got != "anything:1" {
+		t.Errorf("nil list: Resolve = %q, %v", got, ok)
+	}
+}
+
+// TestAllowMapped IPv4映射的IPv6地址与IPv4形式的规则互相匹配
+func TestAllowMapped(t *testing.T) {
+	tests := []struct {
+		rule, addr string
+		want       bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3:80", true},
+		{"10.0.0.0/8", "[::ffff:10.1.2.3]:80", true},
+		{"10.0.0.0/8", "[::ffff:11.1.2.3]:80", false},
+		{"::ffff:10.0.0.0/104", "10.1.2.3:80", true},
+		{"::ffff:10.0.0.0/104", "11.1.2.3:80", false},
+		{"[::ffff:10.1.2.3]:80", "10.1.2.3:80", true},
+		{"[::ffff:10.1.2.3]:80", "10.1.2.3:81", false},
+		{"fd00::/8", "[fd00::1]:80", true},
+		{"fd00::/8", "10.1.2.3:80", false},
+	}
+	for _, tt := range tests {
+		list, err := parseAllowList([]string{tt.rule})
+		if err != nil {
+			t.Fatalf("%q: %v", tt.rule, err)
+		}
+		if got := list.Allowed(tt.addr); got != tt.want {
+			t.Errorf("rule %q: Allowed(%q) = %v, want %v", tt.rule, tt.addr, got, tt.want)
+		}
+	}
+	list, _ := parseAllowList([]string{"10.0.0.0/8"})
+	if got, _ := list.Resolve("[::ffff:10.1.2.3]:80"); got != "10.1.2.3:80" {
+		t.Errorf("Resolve of a mapped address = %q, want 10.1.2.3:80", got)
+	}
+}
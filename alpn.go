@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"pmap/encrypto"
+	"time"
+)
+
+// ALPNControl 控制端口TLS握手时表示pmap协议的ALPN，开启tls的客户端都会携带
+const ALPNControl = "pmap/1"
+
+// controlTLSConfig 控制端口终止TLS使用的配置，在映射端口的证书配置上协商ALPNControl
+func controlTLSConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	cfg.NextProtos = []string{ALPNControl}
+	return cfg
+}
+
+// splitALPN 控制端口与其他TLS服务共用时按ClientHello的ALPN分流：携带ALPNControl的连接终止TLS后返回，
+// 之后与普通的控制连接相同；其余连接不解密，原样转发到fallback并返回nil
+func splitALPN(conn net.Conn, config *tls.Config, fallback string, timeout time.Duration) (net.Conn, error) {
+	hello, pconn, err := peekClientHello(conn)
+	if hello == nil {
+		conn.Close()
+		if err == nil {
+			err = fmt.Errorf("not a tls client hello")
+		}
+		return nil, err
+	}
+	if intersectString([]string{ALPNControl}, hello.SupportedProtos) {
+		return tls.Server(pconn, config), nil
+	}
+	backend, err := net.DialTimeout("tcp", fallback, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dial control_fallback %v: %v", fallback, err)
+	}
+	go encrypto.NetCopy(backend, pconn, "")
+	go encrypto.NetCopy(pconn, backend, "")
+	return nil, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成127.0.0.1的自签名证书，返回证书与私钥文件
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pmap test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	return
+}
+
+// TestControlALPN 同一个TLS控制端口上，携带pmap/1的连接作为隧道，其余TLS连接原样转发到control_fallback
+func TestControlALPN(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fallback"))
+	}))
+	defer backend.Close()
+	certFile, keyFile := writeTestCert(t)
+	server := &ServerConfig{
+		TLSCert:         certFile,
+		TLSKey:          keyFile,
+		ControlTLS:      true,
+		ControlFallback: backend.Listener.Addr().String(),
+	}
+	startServer(t, server)
+	control := localAddr(server.Port)
+
+	t.Run("pmap", func(t *testing.T) {
+		c, err := tls.Dial("tcp", control, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNControl}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := c.ConnectionState().NegotiatedProtocol; p != ALPNControl {
+			t.Errorf("negotiated %q, want %q", p, ALPNControl)
+		}
+		c.Close()
+
+		outer := freePort(t)
+		startClient(t, &ClientConfig{
+			Server:      control,
+			TLS:         true,
+			TLSInsecure: true,
+			Map:         []ClientMapConfig{{Inner: echoServer(t), Outer: outer}},
+		})
+		data := bytes.Repeat([]byte("alpn"), 1000)
+		if got := roundTrip(t, localAddr(outer), data); !bytes.Equal(got, data) {
+			t.Fatal("echo mismatch")
+		}
+	})
+	t.Run("fallback", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + control + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "fallback" {
+			t.Fatalf("got %q from the shared port, want the fallback backend", body)
+		}
+		// 转发的是原始TLS，证书来自后端而不是服务端
+		if resp.TLS == nil || !resp.TLS.PeerCertificates[0].Equal(backend.Certificate()) {
+			t.Error("TLS was terminated by the server instead of the backend")
+		}
+	})
+}
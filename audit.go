@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 审计事件类型
+const (
+	AuditOpen  = "open"  // 外网连接已分配等待对接的序号，通知客户端建立连接
+	AuditClose = "close" // 外网连接关闭，带有双向字节数
+)
+
+// AuditEvent 外网连接的审计记录，同一连接的open与close事件Seq相同
+type AuditEvent struct {
+	Type   string    `json:"type"`
+	Seq    uint64    `json:"seq"`    // 进程内唯一的连接序号
+	Port   uint16    `json:"port"`   // 外网端口
+	Remote string    `json:"remote"` // 访问者地址
+	ID     uint8     `json:"id"`     // 等待对接的序号，连接关闭后会被复用
+	Time   time.Time `json:"time"`   // 事件发生的时间
+	Open   time.Time `json:"open"`   // 连接开始的时间，close事件据此计算持续时间
+	In     int64     `json:"in"`     // 访问者发来的字节数，close事件才有
+	Out    int64     `json:"out"`    // 发回访问者的字节数，close事件才有
+}
+
+// AuditHook 审计回调，在接受连接与转发的协程中同步调用，须尽快返回
+type AuditHook func(e AuditEvent)
+
+// AuditLog 内置的审计回调，以JSON写入服务端的audit类事件日志
+const AuditLog = "log"
+
+var (
+	auditMu    sync.RWMutex
+	auditHooks = map[string]AuditHook{}
+	auditSeq   uint64
+)
+
+// RegisterAuditHook 注册审计回调，服务端通过audit按名称引用，不能使用内置的名称
+func RegisterAuditHook(name string, h AuditHook) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditHooks[name] = h
+}
+
+// lookupAuditHooks 按名称查找审计回调，内置的log写入events
+func lookupAuditHooks(names []string, events *EventLog) ([]AuditHook, error) {
+	auditMu.RLock()
+	defer auditMu.RUnlock()
+	list := make([]AuditHook, 0, len(names))
+	for _, name := range names {
+		if name == AuditLog {
+			list = append(list, func(e AuditEvent) {
+				b, _ := json.Marshal(e)
+				events.Println("audit", "Audit", string(b))
+			})
+			continue
+		}
+		h, ok := auditHooks[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown audit hook %q", name)
+		}
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+// auditConn 接受时记录访问者地址，Open后关闭时发出close事件；
+// 包在外网连接的最内层，随等待对接的Worker到NEWCONN，统计的是访问者连接上的原始字节
+type auditConn struct {
+	net.Conn
+	hooks   []AuditHook
+	event   AuditEvent
+	in, out int64
+	opened  int32
+	once    sync.Once
+}
+
+func newAuditConn(conn net.Conn, hooks []AuditHook, port uint16) *auditConn {
+	return &auditConn{
+		Conn:  conn,
+		hooks: hooks,
+		event: AuditEvent{
+			Seq:    atomic.AddUint64(&auditSeq, 1),
+			Port:   port,
+			Remote: conn.RemoteAddr().String(),
+		},
+	}
+}
+
+func (c *auditConn) fire(e AuditEvent) {
+	for _, h := range c.hooks {
+		h(e)
+	}
+}
+
+// Open 连接得到等待对接的序号时调用；c为nil时不记录
+func (c *auditConn) Open(id uint8) {
+	if c == nil {
+		return
+	}
+	c.event.ID = id
+	c.event.Open = time.Now()
+	e := c.event
+	e.Type, e.Time = AuditOpen, c.event.Open
+	c.fire(e)
+	atomic.StoreInt32(&c.opened, 1)
+}
+
+func (c *auditConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *auditConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.in, int64(n))
+	return n, err
+}
+
+func (c *auditConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.out, int64(n))
+	return n, err
+}
+
+func (c *auditConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if atomic.LoadInt32(&c.opened) == 0 {
+			// 没有分配到序号就被拒绝，不记录
+			return
+		}
+		e := c.event
+		e.Type, e.Time = AuditClose, time.Now()
+		e.In, e.Out = atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+		c.fire(e)
+	})
+	return err
+}
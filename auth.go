@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// AuthNonceSize 认证挑战随机数的长度
+const AuthNonceSize = 32
+
+// newAuthNonce 生成认证挑战
+func newAuthNonce() ([]byte, error) {
+	nonce := make([]byte, AuthNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// authProof 客户端对挑战的应答，key不在网络上传输
+func authProof(key string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// checkProof 以常数时间比较应答
+func checkProof(key string, nonce, proof []byte) bool {
+	return hmac.Equal(authProof(key, nonce), proof)
+}
+
+// SpareProofSize SPARE中应答的长度
+const SpareProofSize = sha256.Size
+
+// spareWindow 备用连接序号的重放窗口，客户端并发建立时序号可能乱序到达
+const spareWindow = 1024
+
+// spareProof 备用连接的应答HMAC-SHA256(key, "SPARE" nonce port seq)，nonce为会话的认证挑战
+func spareProof(key string, nonce []byte, port uint16, seq uint64) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("SPARE"))
+	mac.Write(nonce)
+	var b [10]byte
+	binary.BigEndian.PutUint16(b[:2], port)
+	binary.BigEndian.PutUint64(b[2:], seq)
+	mac.Write(b[:])
+	return mac.Sum(nil)
+}
+
+// spareAuth 校验会话的备用连接，只有认证成功的客户端能为自己的端口建立备用连接；
+// 每个序号只能使用一次，截获的SPARE不能重放
+type spareAuth struct {
+	key   string
+	nonce []byte
+	mu    sync.Mutex
+	max   uint64          // 已使用的最大序号
+	used  map[uint64]bool // 窗口内已使用的序号
+}
+
+func newSpareAuth(key string, nonce []byte) *spareAuth {
+	return &spareAuth{key: key, nonce: nonce, used: make(map[uint64]bool)}
+}
+
+// Check 校验应答，a为nil(会话未经挑战认证)时拒绝
+func (a *spareAuth) Check(port uint16, seq uint64, proof []byte) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if seq+spareWindow <= a.max || a.used[seq] {
+		return false
+	}
+	if !hmac.Equal(spareProof(a.key, a.nonce, port, seq), proof) {
+		return false
+	}
+	a.used[seq] = true
+	if seq > a.max {
+		a.max = seq
+	}
+	if len(a.used) > 2*spareWindow {
+		for s := range a.used {
+			if s+spareWindow <= a.max {
+				delete(a.used, s)
+			}
+		}
+	}
+	return true
+}
+
+// KeyConfig 单个密钥的配置
+type KeyConfig struct {
+	Label       string   `json:"label,omitempty"`        // 租户名称，用于日志
+	PortRange   []uint16 `json:"port_range,omitempty"`   // 允许的端口范围[min, max]，为空则使用服务端的limit_port
+	MaxMappings int      `json:"max_mappings,omitempty"` // 最多映射数量，0使用服务端的max_mappings
+	MaxConns    int      `json:"max_conns,omitempty"`    // 全部映射端口同时存在的连接数量，0使用服务端的client_max_conns
+	QuotaBytes  int64    `json:"quota_bytes,omitempty"`  // 流量配额，0不限制
+	MemoryBytes int64    `json:"memory_bytes,omitempty"` // 每个客户端转发缓冲可用内存，0不限制
+	TOTPSecret  string   `json:"totp_secret,omitempty"`  // 第二因子TOTP的base32密钥，为空不校验
+}
+
+// KeyStore 从独立文件加载的多密钥配置，文件格式为 密钥->KeyConfig
+type KeyStore struct {
+	path string
+	mu   sync.RWMutex
+	keys map[string]*KeyConfig
+	used map[string]*int64 // 各密钥已用流量，重新加载时保留
+}
+
+// LoadKeyStore 加载密钥配置文件
+func LoadKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{
+		path: path,
+		used: make(map[string]*int64),
+	}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload 重新加载密钥配置文件，校验失败时保留原配置
+func (ks *KeyStore) Reload() error {
+	data, err := ioutil.ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+	var keys map[string]*KeyConfig
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("invalid auth file %s: %v", ks.path, err)
+	}
+	if err = validateKeys(keys); err != nil {
+		return fmt.Errorf("invalid auth file %s: %v", ks.path, err)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	for k := range keys {
+		if ks.used[k] == nil {
+			ks.used[k] = new(int64)
+		}
+	}
+	return nil
+}
+
+// validateKeys 校验端口范围，不同密钥的端口范围不能重叠
+func validateKeys(keys map[string]*KeyConfig) error {
+	var labels []string
+	for k, kc := range keys {
+		if kc == nil {
+			return errors.New("key config must not be null")
+		}
+		if kc.TOTPSecret != "" {
+			if _, err := decodeTOTPSecret(kc.TOTPSecret); err != nil {
+				return fmt.Errorf("%v for %q", err, kc.name())
+			}
+		}
+		if len(kc.PortRange) == 0 {
+			continue
+		}
+		if len(kc.PortRange) != 2 || kc.PortRange[0] > kc.PortRange[1] {
+			return fmt.Errorf("bad port range for %q: %v", kc.name(), kc.PortRange)
+		}
+		labels = append(labels, k)
+	}
+	// 按起始端口排序后只需比较相邻的范围
+	sort.Slice(labels, func(i, j int) bool {
+		return keys[labels[i]].PortRange[0] < keys[labels[j]].PortRange[0]
+	})
+	for i := 1; i < len(labels); i++ {
+		prev, cur := keys[labels[i-1]], keys[labels[i]]
+		if cur.PortRange[0] <= prev.PortRange[1] {
+			return fmt.Errorf("port range of %q %v overlaps %q %v",
+				cur.name(), cur.PortRange, prev.name(), prev.PortRange)
+		}
+	}
+	return nil
+}
+
+// Add 注册或更新密钥并写回文件，校验失败时不做修改
+func (ks *KeyStore) Add(key string, kc *KeyConfig) error {
+	if key == "" {
+		return errors.New("key must not be empty")
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	keys := make(map[string]*KeyConfig, len(ks.keys)+1)
+	for k, v := range ks.keys {
+		keys[k] = v
+	}
+	keys[key] = kc
+	if err := validateKeys(keys); err != nil {
+		return err
+	}
+	if err := ks.save(keys); err != nil {
+		return err
+	}
+	ks.keys = keys
+	if ks.used[key] == nil {
+		ks.used[key] = new(int64)
+	}
+	return nil
+}
+
+// Revoke 吊销密钥并写回文件，密钥不存在时返回false
+func (ks *KeyStore) Revoke(key string) (bool, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.keys[key] == nil {
+		return false, nil
+	}
+	keys := make(map[string]*KeyConfig, len(ks.keys))
+	for k, v := range ks.keys {
+		if k != key {
+			keys[k] = v
+		}
+	}
+	if err := ks.save(keys); err != nil {
+		return false, err
+	}
+	ks.keys = keys
+	return true, nil
+}
+
+// save 先写临时文件再替换，避免进程中断时留下不完整的配置
+func (ks *KeyStore) save(keys map[string]*KeyConfig) error {
+	data, err := json.MarshalIndent(keys, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := ks.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
+
+// name 日志中显示的名称，不输出密钥本身
+func (kc *KeyConfig) name() string {
+	if kc != nil && kc.Label != "" {
+		return kc.Label
+	}
+	return "(unlabeled)"
+}
+
+// Get 查询密钥配置，返回配置与该密钥已用流量计数，不存在时返回nil
+func (ks *KeyStore) Get(key string) (*KeyConfig, *int64) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	kc := ks.keys[key]
+	if kc == nil {
+		return nil, nil
+	}
+	return kc, ks.used[key]
+}
+
+// Match 按挑战应答查找密钥，没有匹配时返回空字符串
+func (ks *KeyStore) Match(nonce, proof []byte) string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for k := range ks.keys {
+		if checkProof(k, nonce, proof) {
+			return k
+		}
+	}
+	return ""
+}
+
+// ErrQuota 流量超出配额
+var ErrQuota = errors.New("quota exceeded")
+
+// quotaConn 统计连接双向流量，超出配额后返回ErrQuota
+type quotaConn struct {
+	net.Conn
+	used  *int64
+	limit int64
+}
+
+func (c *quotaConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *quotaConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if atomic.AddInt64(c.used, int64(n)) > c.limit && err == nil {
+		err = ErrQuota
+	}
+	return n, err
+}
+
+func (c *quotaConn) Write(p []byte) (n int, err error) {
+	if atomic.LoadInt64(c.used) > c.limit {
+		return 0, ErrQuota
+	}
+	n, err = c.Conn.Write(p)
+	atomic.AddInt64(c.used, int64(n))
+	return n, err
+}
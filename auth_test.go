@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSpareAuth(t *testing.T) {
+	nonce := bytes.Repeat([]byte{1}, AuthNonceSize)
+	other := bytes.Repeat([]byte{2}, AuthNonceSize)
+	a := newSpareAuth("secret", nonce)
+	// 按顺序执行，重放与窗口依赖之前的结果
+	tests := []struct {
+		name  string
+		port  uint16
+		seq   uint64
+		proof []byte
+		ok    bool
+	}{
+		{"valid", 9100, 1, spareProof("secret", nonce, 9100, 1), true},
+		{"replay", 9100, 1, spareProof("secret", nonce, 9100, 1), false},
+		{"wrong key", 9100, 2, spareProof("guess", nonce, 9100, 2), false},
+		{"other session", 9100, 2, spareProof("secret", other, 9100, 2), false},
+		{"proof for another port", 9101, 2, spareProof("secret", nonce, 9100, 2), false},
+		{"empty proof", 9100, 2, nil, false},
+		{"next", 9101, 3, spareProof("secret", nonce, 9101, 3), true},
+		{"out of order", 9100, 2, spareProof("secret", nonce, 9100, 2), true},
+		{"jump ahead", 9100, 5000, spareProof("secret", nonce, 9100, 5000), true},
+		{"within window", 9100, 5000 - spareWindow + 1, spareProof("secret", nonce, 9100, 5000-spareWindow+1), true},
+		{"older than window", 9100, 5000 - spareWindow, spareProof("secret", nonce, 9100, 5000-spareWindow), false},
+	}
+	for _, tt := range tests {
+		if got := a.Check(tt.port, tt.seq, tt.proof); got != tt.ok {
+			t.Errorf("%v: Check(%v, %v) = %v, want %v", tt.name, tt.port, tt.seq, got, tt.ok)
+		}
+	}
+	var unauth *spareAuth
+	if unauth.Check(9100, 1, spareProof("", nil, 9100, 1)) {
+		t.Error("session without challenge auth accepted a spare")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryFactor 每次重连失败后重连间隔的默认增长倍数
+const RetryFactor = 2
+
+// Backoff 客户端重连间隔，失败后按倍数增长到上限，认证成功后恢复初始值；
+// 实际等待时间在[间隔/2, 间隔]内随机，避免服务端恢复时所有客户端同时重连
+type Backoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Factor float64
+	cur    time.Duration
+	rnd    *rand.Rand
+}
+
+// NewBackoff 创建从base开始的重连间隔
+func NewBackoff(base, max time.Duration, factor float64) *Backoff {
+	return &Backoff{
+		Base:   base,
+		Max:    max,
+		Factor: factor,
+		cur:    base,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next 返回本次等待的时间并增长间隔
+func (b *Backoff) Next() time.Duration {
+	d := b.cur/2 + time.Duration(b.rnd.Int63n(int64(b.cur/2)+1))
+	if next := float64(b.cur) * b.Factor; next < float64(b.Max) {
+		b.cur = time.Duration(next)
+	} else {
+		b.cur = b.Max
+	}
+	return d
+}
+
+// Reset 恢复初始间隔
+func (b *Backoff) Reset() {
+	b.cur = b.Base
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 多个内网服务的选择方式
+const (
+	BalanceRoundRobin = "round-robin" // 轮询
+	BalanceLeastConn  = "least-conn"  // 转发中连接最少的
+)
+
+// backend 负载均衡的单个内网服务
+type backend struct {
+	addr     string
+	active   int64     // 转发中的连接数
+	down     time.Time // 连接失败后在该时间之前不再选择
+	draining bool      // 维护中，不再分配新连接，已建立的连接继续转发
+}
+
+// BackendStatus 内网服务的状态，drained为维护中且已没有转发中的连接，可以安全停止
+type BackendStatus struct {
+	Addr     string `json:"addr"`
+	Active   int64  `json:"active"`
+	Down     bool   `json:"down"`
+	Draining bool   `json:"draining"`
+	Drained  bool   `json:"drained"`
+}
+
+// balancer 在映射的多个内网服务之间选择，连接失败时依次尝试下一个
+type balancer struct {
+	port     uint16
+	mode     string
+	cooldown time.Duration
+	mu       sync.Mutex
+	next     int
+	backends []*backend
+}
+
+func newBalancer(port uint16, addrs []string, mode string, cooldown time.Duration) *balancer {
+	b := &balancer{port: port, mode: mode, cooldown: cooldown}
+	for _, addr := range addrs {
+		b.backends = append(b.backends, &backend{addr: addr})
+	}
+	return b
+}
+
+// order 本次连接尝试的顺序：可用的按选择方式排在前面，冷却中的排在最后，全部不可用时仍会尝试；维护中的不参与
+func (b *balancer) order() []*backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var up, down []*backend
+	for _, be := range b.backends {
+		if be.draining {
+			continue
+		}
+		if now.Before(be.down) {
+			down = append(down, be)
+		} else {
+			up = append(up, be)
+		}
+	}
+	if len(up) > 0 {
+		// 只在可用的之间轮询，冷却中的不会让下一个多分到连接
+		start := b.next % len(up)
+		up = append(append([]*backend(nil), up[start:]...), up[:start]...)
+	}
+	b.next++
+	if b.mode == BalanceLeastConn {
+		// 从轮询位置开始找连接最少的，连接数相同时轮流选择
+		for i := 1; i < len(up); i++ {
+			if atomic.LoadInt64(&up[i].active) < atomic.LoadInt64(&up[0].active) {
+				up[0], up[i] = up[i], up[0]
+			}
+		}
+	}
+	return append(up, down...)
+}
+
+// Dial 按顺序连接内网服务直到成功，dial连接单个地址
+func (b *balancer) Dial(dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	backends := b.order()
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("all backends for :%v are draining", b.port)
+	}
+	var err error
+	for _, be := range backends {
+		var conn net.Conn
+		if conn, err = dial(be.addr); err == nil {
+			b.mu.Lock()
+			be.down = time.Time{}
+			b.mu.Unlock()
+			atomic.AddInt64(&be.active, 1)
+			return &backendConn{Conn: conn, be: be}, nil
+		}
+		err = fmt.Errorf("%v: %w", be.addr, err)
+		if b.cooldown > 0 {
+			b.mu.Lock()
+			be.down = time.Now().Add(b.cooldown)
+			b.mu.Unlock()
+			logger.Warnf("Backend %v for :%v failed, skipped for %v: %v", be.addr, b.port, b.cooldown, err)
+		}
+	}
+	return nil, err
+}
+
+// Drain 将内网服务标记为维护中或恢复，addr不在映射中时返回false
+func (b *balancer) Drain(addr string, draining bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, be := range b.backends {
+		if be.addr != addr {
+			continue
+		}
+		if be.draining != draining {
+			be.draining = draining
+			if draining {
+				logger.Infof("Draining backend %v for :%v, %v active connections", addr, b.port, atomic.LoadInt64(&be.active))
+			} else {
+				logger.Infof("Backend %v for :%v is back in rotation", addr, b.port)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Status 各内网服务的当前状态
+func (b *balancer) Status() []BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	list := make([]BackendStatus, 0, len(b.backends))
+	for _, be := range b.backends {
+		active := atomic.LoadInt64(&be.active)
+		list = append(list, BackendStatus{
+			Addr:     be.addr,
+			Active:   active,
+			Down:     now.Before(be.down),
+			Draining: be.draining,
+			Drained:  be.draining && active == 0,
+		})
+	}
+	return list
+}
+
+// backendConn 关闭时减少内网服务的连接数
+type backendConn struct {
+	net.Conn
+	be   *backend
+	once sync.Once
+}
+
+func (c *backendConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.be.active, -1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestBalancerDrain 维护中的内网服务不再分配新连接，已建立的连接结束后报告为drained
+func TestBalancerDrain(t *testing.T) {
+	b := newBalancer(1, []string{"a:1", "b:1"}, BalanceRoundRobin, 0)
+	var dialed []string
+	dial := func(addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	conn, err := b.Dial(dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Drain(dialed[0], true) {
+		t.Fatal("backend not found")
+	}
+	if b.Drain("c:1", true) {
+		t.Error("drained an unknown backend")
+	}
+	for i := 0; i < 3; i++ {
+		c, err := b.Dial(dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if dialed[len(dialed)-1] == dialed[0] {
+			t.Fatalf("new connection %v went to the draining backend", i)
+		}
+	}
+	st := b.Status()
+	if !st[0].Draining || st[0].Drained || st[0].Active != 1 {
+		t.Errorf("before close: %+v", st[0])
+	}
+	conn.Close()
+	if st = b.Status(); !st[0].Drained || st[1].Draining {
+		t.Errorf("after close: %+v", st)
+	}
+
+	b.Drain("b:1", true)
+	if _, err := b.Dial(func(string) (net.Conn, error) { return nil, errors.New("dialed") }); err == nil || err.Error() != "all backends for :1 are draining" {
+		t.Errorf("all draining: %v", err)
+	}
+	b.Drain("a:1", false)
+	if c, err := b.Dial(dial); err != nil || dialed[len(dialed)-1] != "a:1" {
+		t.Errorf("after resume: dialed %v, %v", dialed[len(dialed)-1], err)
+	} else {
+		c.Close()
+	}
+}
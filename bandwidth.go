@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// bandwidth 映射的带宽限制，端口上的全部连接共享，in为访问者发往内网服务的方向，out为内网服务发往访问者的方向
+type bandwidth struct {
+	in, out *tokenBucket // 为nil不限制该方向
+}
+
+// newBandwidth 单位为字节/秒，both为两个方向共同的设置，in、out不为0时覆盖；都为0时返回nil
+func newBandwidth(both, in, out int64) (*bandwidth, error) {
+	if both < 0 || in < 0 || out < 0 {
+		return nil, fmt.Errorf("bad bandwidth %v/%v/%v, must not be negative", both, in, out)
+	}
+	if in == 0 {
+		in = both
+	}
+	if out == 0 {
+		out = both
+	}
+	if in == 0 && out == 0 {
+		return nil, nil
+	}
+	var b bandwidth
+	if in > 0 {
+		b.in = newTokenBucket(float64(in))
+	}
+	if out > 0 {
+		b.out = newTokenBucket(float64(out))
+	}
+	return &b, nil
+}
+
+// Wrap 返回按限制读写的外网连接
+func (b *bandwidth) Wrap(conn net.Conn) net.Conn {
+	if b == nil {
+		return conn
+	}
+	return &bandwidthConn{Conn: conn, bw: b, done: make(chan struct{})}
+}
+
+// bandwidthConn 读取后按in等待，写入前按out等待，连接关闭时不再等待
+type bandwidthConn struct {
+	net.Conn
+	bw   *bandwidth
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *bandwidthConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *bandwidthConn) Read(p []byte) (int, error) {
+	if c.bw.in != nil && len(p) > int(c.bw.in.burst) {
+		// 每次最多读取一秒的量，避免单次等待过久
+		p = p[:int(c.bw.in.burst)]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.bw.in != nil {
+		c.wait(c.bw.in, n)
+	}
+	return n, err
+}
+
+func (c *bandwidthConn) Write(p []byte) (n int, err error) {
+	if c.bw.out == nil {
+		return c.Conn.Write(p)
+	}
+	for len(p) > 0 {
+		k := len(p)
+		if k > int(c.bw.out.burst) {
+			k = int(c.bw.out.burst)
+		}
+		if !c.wait(c.bw.out, k) {
+			return n, io.ErrClosedPipe
+		}
+		m, err := c.Conn.Write(p[:k])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// wait 取出n个令牌，连接已关闭时返回false
+func (c *bandwidthConn) wait(b *tokenBucket, n int) bool {
+	d := b.Take(n)
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *bandwidthConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// BatchMax BATCH中压缩前后的最大字节数
+const BatchMax = 0xffff
+
+// errBatchSize 解压后的命令超过BatchMax
+var errBatchSize = errors.New("control batch too large")
+
+// controlBatch 客户端的控制命令批量写出：普通命令先缓存，每隔interval合并为一次写出，减少控制连接上的小包；
+// compress时合并的命令以DEFLATE压缩为一个BATCH帧；KILL等紧急命令由WriteNow连同已缓存的命令立即写出
+type controlBatch struct {
+	conn     net.Conn
+	compress bool
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	zbuf     bytes.Buffer
+	zw       *flate.Writer
+	writes   int64 // 实际写出的次数
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newControlBatch 创建并开始定时写出，Close后停止
+func newControlBatch(conn net.Conn, interval time.Duration, compress bool) *controlBatch {
+	b := &controlBatch{conn: conn, compress: compress, done: make(chan struct{})}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-t.C:
+			}
+			b.mu.Lock()
+			err := b.flush(nil)
+			b.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return b
+}
+
+// Write 缓存一个或多个完整的命令，缓存将超过BatchMax时先写出已缓存的
+func (b *controlBatch) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf.Len()+len(p) > BatchMax {
+		if err := b.flush(nil); err != nil {
+			return 0, err
+		}
+	}
+	return b.buf.Write(p)
+}
+
+// WriteNow 已缓存的命令与p在一次写出中立即发送，p不压缩
+func (b *controlBatch) WriteNow(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.flush(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writes 实际写出的次数
+func (b *controlBatch) Writes() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writes
+}
+
+// flush 写出缓存的命令及urgent，调用时须持有mu
+func (b *controlBatch) flush(urgent []byte) error {
+	if b.buf.Len() == 0 && len(urgent) == 0 {
+		return nil
+	}
+	out := b.buf.Bytes()
+	if b.compress && b.buf.Len() > 0 {
+		// BATCH len(2) 压缩的命令，每个帧单独压缩
+		b.zbuf.Reset()
+		b.zbuf.Write([]byte{BATCH, 0, 0})
+		if b.zw == nil {
+			b.zw, _ = flate.NewWriter(&b.zbuf, flate.BestSpeed)
+		} else {
+			b.zw.Reset(&b.zbuf)
+		}
+		b.zw.Write(out)
+		b.zw.Close()
+		out = b.zbuf.Bytes()
+		n := len(out) - 3
+		if len(out) >= b.buf.Len() || n > BatchMax {
+			// 压缩后没有变小(如只有一个PING)或超出长度字段的范围，按原样写出，服务端同样能逐个解析
+			out = b.buf.Bytes()
+		} else {
+			out[1], out[2] = uint8(n>>8), uint8(n)
+		}
+	}
+	out = append(out, urgent...)
+	b.buf.Reset()
+	b.writes++
+	_, err := b.conn.Write(out)
+	return err
+}
+
+// Close 停止定时写出，未写出的命令丢弃
+func (b *controlBatch) Close() {
+	b.once.Do(func() { close(b.done) })
+}
+
+// readBatch 读取BATCH之后的 len(2) 压缩的命令，返回解压后的命令
+func readBatch(r io.Reader) ([]byte, error) {
+	blen := make([]byte, 2)
+	if _, err := io.ReadFull(r, blen); err != nil {
+		return nil, err
+	}
+	z := make([]byte, int(blen[0])<<8|int(blen[1]))
+	if _, err := io.ReadFull(r, z); err != nil {
+		return nil, err
+	}
+	zr := flate.NewReader(bytes.NewReader(z))
+	defer zr.Close()
+	cmds, err := ioutil.ReadAll(io.LimitReader(zr, BatchMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(cmds) > BatchMax {
+		return nil, errBatchSize
+	}
+	return cmds, nil
+}
+
+// controlReader 服务端读取控制命令，BATCH解压后的命令先于连接上的后续数据读出
+type controlReader struct {
+	conn    net.Conn
+	pending []byte
+}
+
+func (r *controlReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	return r.conn.Read(p)
+}
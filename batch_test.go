@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writesConn 记录每次写出的数据
+type writesConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *writesConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// TestControlBatch 缓存的命令与KILL在一次写出中发送，服务端解开后与逐个发送的命令相同
+func TestControlBatch(t *testing.T) {
+	var cmds, want bytes.Buffer
+	for i := 0; i < 20; i++ {
+		cmds.WriteByte(PING)
+	}
+	for i := 0; i < 10; i++ {
+		info := []byte(fmt.Sprintf(`{"inner":"127.0.0.1:%v","outer":%v}`, 8080+i, 9100+i))
+		cmds.Write([]byte{ADD_PORT, 0, uint8(len(info))})
+		cmds.Write(info)
+	}
+	kill := []byte{KILL, 3, 'b', 'y', 'e'}
+	want.Write(cmds.Bytes())
+	want.Write(kill)
+	for _, compress := range []bool{false, true} {
+		rc := &writesConn{}
+		b := newControlBatch(rc, time.Hour, compress)
+		for i := 0; i < 20; i++ {
+			b.Write([]byte{PING})
+		}
+		b.Write(cmds.Bytes()[20:])
+		b.WriteNow(kill)
+		b.Close()
+		if len(rc.writes) != 1 || b.Writes() != 1 {
+			t.Fatalf("compress %v: %v writes for 31 commands, want 1", compress, len(rc.writes))
+		}
+		out := rc.writes[0]
+		if compress {
+			if out[0] != BATCH {
+				t.Fatalf("compressed batch starts with %#02x", out[0])
+			}
+			r := bytes.NewReader(out[1:])
+			got, err := readBatch(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest, _ := ioutil.ReadAll(r)
+			t.Logf("%v bytes of commands sent as %v bytes in one write", want.Len(), len(out))
+			if len(out) >= want.Len() {
+				t.Errorf("%v bytes of commands sent as %v bytes", want.Len(), len(out))
+			}
+			out = append(got, rest...)
+		}
+		if !bytes.Equal(out, want.Bytes()) {
+			t.Errorf("compress %v: got % x, want % x", compress, out, want.Bytes())
+		}
+	}
+}
+
+// TestControlBatchTunnel 合并压缩控制命令时心跳与运行中添加、关闭映射照常工作
+func TestControlBatchTunnel(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "dev.lock")
+	server := &ServerConfig{}
+	startServer(t, server)
+	outer := freePort(t)
+	client := &ClientConfig{
+		Key:             "test-key",
+		Server:          localAddr(server.Port),
+		PingInterval:    1,
+		ControlBatch:    100,
+		ControlCompress: true,
+		Map:             []ClientMapConfig{{Inner: echoServer(t), Outer: outer, When: &WhenConfig{File: lock, Interval: 1}}},
+	}
+	run(t, func(ctx context.Context) error { return DoClient(ctx, client) })
+	if err := ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitDial(t, localAddr(outer))
+	// 经过几次心跳，连接仍然可用
+	time.Sleep(2500 * time.Millisecond)
+	if got := roundTrip(t, localAddr(outer), []byte("ping")); string(got) != "ping" {
+		t.Fatalf("echo %q", got)
+	}
+	os.Remove(lock)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", localAddr(outer))
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("port still open after KILL_PORT in a batch")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// mapFlags 可重复的-map参数
+type mapFlags []ClientMapConfig
+
+func (f *mapFlags) String() string {
+	var maps []string
+	for _, m := range *f {
+		maps = append(maps, fmt.Sprintf("%v:%v", m.Inner, m.Outer))
+	}
+	return strings.Join(maps, ",")
+}
+
+func (f *mapFlags) Set(value string) error {
+	m, err := parseMap(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, m)
+	return nil
+}
+
+// parseMap 解析inner:outer，inner只有端口时为本机端口，如8080:80、192.168.1.2:22:2222、[::1]:8080:80
+func parseMap(value string) (ClientMapConfig, error) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return ClientMapConfig{}, fmt.Errorf("bad map %q, must be inner:outer", value)
+	}
+	outer, err := strconv.ParseUint(value[i+1:], 10, 16)
+	if err != nil || outer == 0 {
+		return ClientMapConfig{}, fmt.Errorf("bad outer port in map %q", value)
+	}
+	inner := value[:i]
+	if _, err := strconv.ParseUint(inner, 10, 16); err == nil {
+		inner = net.JoinHostPort("127.0.0.1", inner)
+	}
+	if inner, err = normalizeAddr(inner); err != nil {
+		return ClientMapConfig{}, fmt.Errorf("bad inner address in map %q: %v", value, err)
+	}
+	return ClientMapConfig{Inner: inner, Outer: uint16(outer)}, nil
+}
+
+// inlineConfig 由命令行参数生成配置，不读取配置文件；server为监听地址如:7000，client为服务端地址
+func inlineConfig(server, client, key string, maps mapFlags) (*Config, error) {
+	switch {
+	case server == "" && client == "":
+		return nil, errors.New("-key and -map require -server or -client")
+	case key == "":
+		return nil, errors.New("-key is required with -server or -client")
+	}
+	var config Config
+	if server != "" {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, fmt.Errorf("bad -server address %q: %v", server, err)
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad -server port %q", port)
+		}
+		config.Server = &ServerConfig{Key: key, Port: uint16(p), Bind: host}
+	}
+	if client != "" {
+		if len(maps) == 0 {
+			return nil, errors.New("-client requires at least one -map")
+		}
+		config.Client = &ClientConfig{Key: key, Server: client, Map: maps}
+	} else if len(maps) > 0 {
+		return nil, errors.New("-map requires -client")
+	}
+	return &config, nil
+}
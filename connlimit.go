@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SaturatedLogInterval 汇总记录端口拒绝连接数量的间隔
+const SaturatedLogInterval = time.Second
+
+// tokenBucket 令牌桶，每秒补充rate个令牌，最多积累burst个
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	// 允许一秒内的突发
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Allow 取出一个令牌，没有令牌时返回false
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Take 取出n个令牌，可以透支，返回需要等待的时间；透支时之后的调用等待更久
+func (b *tokenBucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// connLimiter 映射端口的并发连接数与接受速率限制，从Accept到外网连接关闭占用一个并发数
+type connLimiter struct {
+	slots         chan struct{} // 为nil不限制并发
+	bucket        *tokenBucket  // 为nil不限制速率
+	rateRejected  int64         // 上次汇总后因速率拒绝的连接数
+	connsRejected int64         // 上次汇总后因并发数拒绝的连接数
+}
+
+// newConnLimiter 两项都为0时返回nil
+func newConnLimiter(maxConns int, rate float64) *connLimiter {
+	if maxConns <= 0 && rate <= 0 {
+		return nil
+	}
+	l := &connLimiter{}
+	if maxConns > 0 {
+		l.slots = make(chan struct{}, maxConns)
+	}
+	if rate > 0 {
+		l.bucket = newTokenBucket(rate)
+	}
+	return l
+}
+
+// Accept 判断是否接受新连接，接受时返回关闭后归还并发数的连接；
+// 并发数已满时先调用reap回收过期的等待连接再试一次
+func (l *connLimiter) Accept(conn net.Conn, reap func()) (net.Conn, bool) {
+	if l.bucket != nil && !l.bucket.Allow() {
+		atomic.AddInt64(&l.rateRejected, 1)
+		return nil, false
+	}
+	if l.slots == nil {
+		return conn, true
+	}
+	if !l.acquire() {
+		reap()
+		if !l.acquire() {
+			atomic.AddInt64(&l.connsRejected, 1)
+			return nil, false
+		}
+	}
+	return &slotConn{Conn: conn, slots: l.slots}, true
+}
+
+func (l *connLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Rejected 返回上次汇总后因速率与并发数拒绝的连接数量并清零
+func (l *connLimiter) Rejected() (rate, conns int64) {
+	return atomic.SwapInt64(&l.rateRejected, 0), atomic.SwapInt64(&l.connsRejected, 0)
+}
+
+// memoryBudget 客户端转发缓冲的内存预算，换算为同时转发的连接数，同一客户端的全部端口共享
+type memoryBudget chan struct{}
+
+// newMemoryBudget 每个连接两个方向各占一个bufferSize的缓冲，预算不足一个连接时按一个计算；bytes不大于0时返回nil
+func newMemoryBudget(bytes int64, bufferSize int) memoryBudget {
+	if bytes <= 0 {
+		return nil
+	}
+	n := bytes / int64(2*bufferSize)
+	if n < 1 {
+		n = 1
+	}
+	return make(memoryBudget, n)
+}
+
+// Acquire 占用一个连接的预算，已用完时返回false；为nil时不限制
+func (b memoryBudget) Acquire() bool {
+	if b == nil {
+		return true
+	}
+	select {
+	case b <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release 归还Acquire占用的预算
+func (b memoryBudget) Release() {
+	if b != nil {
+		<-b
+	}
+}
+
+// slotConn 关闭时归还connLimiter的并发数
+type slotConn struct {
+	net.Conn
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *slotConn) Close() error {
+	c.once.Do(func() {
+		<-c.slots
+	})
+	return c.Conn.Close()
+}
+
+func (c *slotConn) Unwrap() net.Conn { return c.Conn }
+
+// connWrapper 包装了另一个连接的连接，如slotConn、peekConn与auditConn；半关闭也逐层找到原始连接
+type connWrapper interface {
+	Unwrap() net.Conn
+}
+
+// baseConn 逐层去掉包装，用于需要原始连接类型的操作
+func baseConn(conn net.Conn) net.Conn {
+	for {
+		w, ok := conn.(connWrapper)
+		if !ok {
+			return conn
+		}
+		conn = w.Unwrap()
+	}
+}
+
+// mappingLimit 映射与全局设置中较小的非0值，都为0时不限制；映射不能放宽服务端的限制
+func mappingLimit(mapping, global float64) (float64, error) {
+	if mapping < 0 {
+		return 0, fmt.Errorf("bad limit %v, must not be negative", mapping)
+	}
+	if mapping == 0 || (global > 0 && global < mapping) {
+		return global, nil
+	}
+	return mapping, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// tcpConn 接受一个本机TCP连接
+func tcpConn(t *testing.T) net.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBaseConn(t *testing.T) {
+	limit := func(c net.Conn) net.Conn {
+		conn, ok := newConnLimiter(1, 0).Accept(c, func() {})
+		if !ok {
+			t.Fatal("limiter rejected the first conn")
+		}
+		return conn
+	}
+	peek := func(c net.Conn) net.Conn { return newPeekConn(c, nil) }
+	audit := func(c net.Conn) net.Conn { return newAuditConn(c, nil, 1) }
+	tests := []struct {
+		name  string
+		wraps []func(net.Conn) net.Conn
+	}{
+		{"plain", nil},
+		{"port limit", []func(net.Conn) net.Conn{limit}},
+		{"port and client limit", []func(net.Conn) net.Conn{limit, limit}},
+		{"limits and tls check", []func(net.Conn) net.Conn{limit, limit, peek}},
+		{"limits, tls check and audit", []func(net.Conn) net.Conn{limit, limit, peek, audit}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			raw := tcpConn(t)
+			defer raw.Close()
+			conn := raw
+			for _, wrap := range tt.wraps {
+				conn = wrap(conn)
+			}
+			if got := baseConn(conn); got != raw {
+				t.Fatalf("baseConn = %T, want the accepted *net.TCPConn", got)
+			}
+		})
+	}
+}
+
+// TestSlotConnRelease 端口与客户端两层限制，关闭后两层的并发数都归还
+func TestSlotConnRelease(t *testing.T) {
+	port, client := newConnLimiter(1, 0), newConnLimiter(1, 0)
+	for i := 0; i < 3; i++ {
+		c1, ok := port.Accept(tcpConn(t), func() {})
+		if !ok {
+			t.Fatalf("round %v: port limit not released", i)
+		}
+		c2, ok := client.Accept(c1, func() {})
+		if !ok {
+			t.Fatalf("round %v: client limit not released", i)
+		}
+		if _, ok := port.Accept(tcpConn(t), func() {}); ok {
+			t.Fatalf("round %v: port limit not enforced", i)
+		}
+		c2.Close()
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const flood = 500
+	tests := []struct {
+		name  string
+		bytes int64
+		want  int // 同时转发的连接数，-1不限制
+	}{
+		{"unlimited", 0, -1},
+		{"negative", -1, -1},
+		{"below one connection", 1, 1},
+		{"one connection", 2 * 10240, 1},
+		{"two connections", 4*10240 + 1, 2},
+		{"1MB", 1 << 20, 51},
+	}
+	for _, tt := range tests {
+		b := newMemoryBudget(tt.bytes, 10240)
+		var ok int32
+		var wg sync.WaitGroup
+		for i := 0; i < flood; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if b.Acquire() {
+					atomic.AddInt32(&ok, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		want := tt.want
+		if want < 0 {
+			want = flood
+		}
+		if int(ok) != want {
+			t.Errorf("%v: %v of %v connections accepted, want %v", tt.name, ok, flood, want)
+			continue
+		}
+		if tt.want < 0 {
+			continue
+		}
+		// 连接结束归还后可以再接受一个
+		b.Release()
+		if !b.Acquire() {
+			t.Errorf("%v: rejected after release", tt.name)
+		}
+		if b.Acquire() {
+			t.Errorf("%v: accepted beyond the budget after release", tt.name)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// countConn 统计连接双向的字节数
+type countConn struct {
+	net.Conn
+	in, out *int64
+}
+
+func (c *countConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.in, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.out, int64(n))
+	return n, err
+}
+
+// LogSampler 连接关闭日志的采样，错误与认证日志不采样
+type LogSampler struct {
+	every    int64         // 每every个连接记录一个，0不按比例记录
+	bytes    int64         // 双向字节数达到该值时总是记录，0不启用
+	duration time.Duration // 持续时间达到该值时总是记录，0不启用
+	count    int64
+}
+
+// NewLogSampler 创建采样器，三项都为0时不记录连接关闭日志
+func NewLogSampler(every int, bytes int64, duration time.Duration) *LogSampler {
+	return &LogSampler{every: int64(every), bytes: bytes, duration: duration}
+}
+
+// Keep 判断是否记录该连接
+func (s *LogSampler) Keep(bytes int64, d time.Duration) bool {
+	if s.bytes > 0 && bytes >= s.bytes {
+		return true
+	}
+	if s.duration > 0 && d >= s.duration {
+		return true
+	}
+	return s.every > 0 && atomic.AddInt64(&s.count, 1)%s.every == 0
+}
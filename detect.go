@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DetectTimeOut 等待首部数据识别协议的时间，超时按未识别处理
+	DetectTimeOut = 2 * time.Second
+	// DetectDefault 未识别的协议，转发到映射的inner
+	DetectDefault = 0xff
+	// detectMinLen 识别内置协议需要的首部长度
+	detectMinLen = 8
+)
+
+// DetectRule 协议识别规则，按配置顺序匹配
+type DetectRule struct {
+	Proto  string `json:"proto"`  // 内置协议ssh/http/tls，或自定义名称
+	Prefix string `json:"prefix"` // 自定义协议的首部前缀，内置协议不填
+	Inner  string `json:"inner"`  // 该协议转发到的内网地址
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+// Validate 校验规则
+func (d *DetectRule) Validate() error {
+	switch d.Proto {
+	case "ssh", "http", "tls":
+		if d.Prefix != "" {
+			return fmt.Errorf("builtin protocol %q does not take a prefix", d.Proto)
+		}
+	default:
+		if d.Prefix == "" {
+			return fmt.Errorf("protocol %q needs a prefix", d.Proto)
+		}
+	}
+	return nil
+}
+
+// Match 判断首部数据是否符合该协议
+func (d *DetectRule) Match(head []byte) bool {
+	switch d.Proto {
+	case "ssh":
+		return bytes.HasPrefix(head, []byte("SSH-"))
+	case "http":
+		for _, m := range httpMethods {
+			if bytes.HasPrefix(head, m) {
+				return true
+			}
+		}
+		return false
+	case "tls":
+		// handshake记录 0x16 0x03 0x0?
+		return len(head) >= 2 && head[0] == 0x16 && head[1] == 0x03
+	default:
+		return bytes.HasPrefix(head, []byte(d.Prefix))
+	}
+}
+
+// detectProto 预读首部数据识别协议，返回匹配的规则序号(未识别为DetectDefault)与重放首部的连接
+func detectProto(conn net.Conn, rules []DetectRule) (uint8, net.Conn) {
+	var need = detectMinLen
+	for _, r := range rules {
+		if len(r.Prefix) > need {
+			need = len(r.Prefix)
+		}
+	}
+	var head = make([]byte, 0, need)
+	conn.SetReadDeadline(time.Now().Add(DetectTimeOut))
+	for len(head) < need {
+		n, err := conn.Read(head[len(head):need])
+		head = head[:len(head)+n]
+		if err != nil {
+			break
+		}
+		// 已经能确定时不再等待
+		if len(head) >= 4 && matchRule(head, rules) != DetectDefault {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return matchRule(head, rules), newPeekConn(conn, head)
+}
+
+func matchRule(head []byte, rules []DetectRule) uint8 {
+	for i := range rules {
+		if rules[i].Match(head) {
+			return uint8(i)
+		}
+	}
+	return DetectDefault
+}
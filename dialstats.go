@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// RefusedAlert 连续被拒绝该次数后告警，通常说明内网服务进程已退出而主机仍在线
+const RefusedAlert = 5
+
+// 连接内网服务失败的原因
+const (
+	DialRefused = "refused" // 主机可达但端口拒绝连接
+	DialTimeout = "timeout" // 连接超时
+	DialDNS     = "dns"     // 域名解析失败
+	DialOther   = "other"
+)
+
+// classifyDialError 区分连接内网服务失败的原因
+func classifyDialError(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialRefused
+	case errors.As(err, &dnsErr):
+		return DialDNS
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return DialTimeout
+	}
+	return DialOther
+}
+
+// DialStats 单个映射连接内网服务的统计
+type DialStats struct {
+	Success     int64 `json:"success"`
+	Refused     int64 `json:"refused"`
+	Timeout     int64 `json:"timeout"`
+	DNS         int64 `json:"dns"`
+	Other       int64 `json:"other"`
+	Consecutive int64 `json:"consecutive_refused"` // 最近连续被拒绝的次数
+}
+
+// DialStatsMap 各映射的连接统计，键为外网端口
+type DialStatsMap struct {
+	mu    sync.Mutex
+	stats map[uint16]*DialStats
+}
+
+func (m *DialStatsMap) get(port uint16) *DialStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stats == nil {
+		m.stats = make(map[uint16]*DialStats)
+	}
+	s := m.stats[port]
+	if s == nil {
+		s = &DialStats{}
+		m.stats[port] = s
+	}
+	return s
+}
+
+// Record 记录一次连接结果，返回失败原因；连续被拒绝达到RefusedAlert时alert为true
+func (m *DialStatsMap) Record(port uint16, err error) (kind string, alert bool) {
+	s := m.get(port)
+	if err == nil {
+		atomic.AddInt64(&s.Success, 1)
+		atomic.StoreInt64(&s.Consecutive, 0)
+		return "", false
+	}
+	kind = classifyDialError(err)
+	switch kind {
+	case DialRefused:
+		atomic.AddInt64(&s.Refused, 1)
+		return kind, atomic.AddInt64(&s.Consecutive, 1) == RefusedAlert
+	case DialTimeout:
+		atomic.AddInt64(&s.Timeout, 1)
+	case DialDNS:
+		atomic.AddInt64(&s.DNS, 1)
+	default:
+		atomic.AddInt64(&s.Other, 1)
+	}
+	return kind, false
+}
+
+// ServeHTTP GET /dial 以JSON输出各映射的连接统计
+func (m *DialStatsMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	out := make(map[uint16]DialStats, len(m.stats))
+	for port, s := range m.stats {
+		out[port] = DialStats{
+			Success:     atomic.LoadInt64(&s.Success),
+			Refused:     atomic.LoadInt64(&s.Refused),
+			Timeout:     atomic.LoadInt64(&s.Timeout),
+			DNS:         atomic.LoadInt64(&s.DNS),
+			Other:       atomic.LoadInt64(&s.Other),
+			Consecutive: atomic.LoadInt64(&s.Consecutive),
+		}
+	}
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 服务发现的默认设置
+const (
+	DiscoverDir      = "dir"           // 内置的目录来源
+	DiscoverInterval = 2 * time.Second // 默认检查间隔
+	DiscoverDebounce = 5 * time.Second // 默认等待发现结果稳定的时间
+)
+
+// Discoverer 服务发现来源，返回当前应当映射的服务，外网端口到内网地址
+type Discoverer interface {
+	Discover() (map[uint16]string, error)
+}
+
+// DiscovererFunc 函数形式的发现来源
+type DiscovererFunc func() (map[uint16]string, error)
+
+// Discover 实现Discoverer
+func (f DiscovererFunc) Discover() (map[uint16]string, error) {
+	return f()
+}
+
+var (
+	discoverMu  sync.RWMutex
+	discoverers = map[string]Discoverer{}
+)
+
+// RegisterDiscoverer 注册发现来源，客户端通过discover.source按名称引用，不能使用内置的名称
+func RegisterDiscoverer(name string, d Discoverer) {
+	discoverMu.Lock()
+	defer discoverMu.Unlock()
+	discoverers[name] = d
+}
+
+// DiscoverConfig 从本机的服务来源自动添加与关闭映射
+type DiscoverConfig struct {
+	Source   string          `json:"source"`   // 注册的发现来源名称，为空使用内置的dir
+	Dir      string          `json:"dir"`      // dir来源监视的目录
+	Interval int             `json:"interval"` // 检查间隔(秒)，默认2
+	Debounce int             `json:"debounce"` // 发现结果保持不变该时间(秒)后才添加或关闭映射，默认5，负数不等待
+	Map      ClientMapConfig `json:"map"`      // 发现的映射共用的设置，inner与outer由来源决定
+
+	source Discoverer
+}
+
+// Init 校验配置并查找发现来源
+func (c *DiscoverConfig) Init() error {
+	switch {
+	case c.Interval < 0:
+		return errors.New("discover interval must not be negative")
+	case c.Map.Dir != nil || c.Map.ForwardProxy != "" || c.Map.When != nil:
+		return errors.New("discover map can't use dir, forward_proxy or when")
+	}
+	if c.Source == "" || c.Source == DiscoverDir {
+		if c.Dir == "" {
+			return errors.New("discover source dir needs a dir")
+		}
+		c.source = dirDiscoverer(c.Dir)
+		return nil
+	}
+	discoverMu.RLock()
+	defer discoverMu.RUnlock()
+	d, ok := discoverers[c.Source]
+	if !ok {
+		return fmt.Errorf("unknown discover source %q", c.Source)
+	}
+	c.source = d
+	return nil
+}
+
+// dirDiscoverer 目录中名为"<外网端口>.sock"的Unix域套接字映射到该端口，
+// 名为"<外网端口>.addr"的文件内容为内网地址(如容器启动时写入的172.17.0.5:80)，其余文件忽略
+type dirDiscoverer string
+
+func (dir dirDiscoverer) Discover() (map[uint16]string, error) {
+	files, err := ioutil.ReadDir(string(dir))
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[uint16]string)
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		port, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), ext), 10, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+		path := filepath.Join(string(dir), fi.Name())
+		switch {
+		case ext == ".sock" && fi.Mode()&os.ModeSocket != 0:
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				continue
+			}
+			found[uint16(port)] = UnixScheme + abs
+		case ext == ".addr" && fi.Mode().IsRegular():
+			// 文件可能正在写入，读取失败或为空时本次忽略
+			b, err := ioutil.ReadFile(path)
+			if addr := strings.TrimSpace(string(b)); err == nil && addr != "" {
+				found[uint16(port)] = addr
+			}
+		}
+	}
+	return found, nil
+}
+
+// sameServices 两次发现的结果是否相同
+func sameServices(a, b map[uint16]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for port, inner := range a {
+		if v, ok := b[port]; !ok || v != inner {
+			return false
+		}
+	}
+	return true
+}
+
+// watchDiscover 定期检查发现来源，结果保持debounce不变后添加新出现的映射、关闭消失的映射，内网地址变化的先关闭再添加；ctx取消后返回
+func watchDiscover(ctx context.Context, c *DiscoverConfig, add func(ClientMapConfig) error, remove func(uint16) bool) {
+	interval, debounce := DiscoverInterval, DiscoverDebounce
+	if c.Interval > 0 {
+		interval = time.Duration(c.Interval) * time.Second
+	}
+	if c.Debounce != 0 {
+		debounce = time.Duration(c.Debounce) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// known 已处理的发现结果，added 其中添加成功的端口，只关闭自己添加的映射
+	var known, pending = map[uint16]string{}, map[uint16]string{}
+	var added = make(map[uint16]bool)
+	var since time.Time
+	var failing bool
+	for {
+		found, err := c.source.Discover()
+		switch {
+		case err != nil:
+			if !failing {
+				logger.Warn("Service discovery failed:", err)
+			}
+			failing = true
+		case !sameServices(found, pending):
+			failing = false
+			pending, since = found, time.Now()
+		default:
+			failing = false
+		}
+		if err == nil && time.Since(since) >= debounce && !sameServices(known, pending) {
+			for port, inner := range known {
+				if v, ok := pending[port]; ok && v == inner {
+					continue
+				}
+				if added[port] {
+					logger.Infof("Discovered service %v for :%v is gone", inner, port)
+					remove(port)
+					delete(added, port)
+				}
+			}
+			for port, inner := range pending {
+				if v, ok := known[port]; ok && v == inner {
+					continue
+				}
+				m := c.Map
+				m.Inner, m.Outer = inner, port
+				logger.Infof("Discovered service %v for :%v", inner, port)
+				if err := add(m); err != nil {
+					logger.Errorf("Add port %v failed: %v", port, err)
+					continue
+				}
+				added[port] = true
+			}
+			known = pending
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
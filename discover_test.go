@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDiscoverDir 目录中出现的套接字与地址文件映射到对应端口，删除后关闭
+func TestDiscoverDir(t *testing.T) {
+	dir := t.TempDir()
+	sockPort, addrPort := freePort(t), freePort(t)
+	l, err := net.Listen("unix", filepath.Join(dir, fmt.Sprintf("%v.sock", sockPort)))
+	if err != nil {
+		t.Skip("unix sockets not available:", err)
+	}
+	serveEcho(t, l)
+	// 不是端口号或类型不符的文件忽略
+	for _, name := range []string{"readme.txt", "web.addr", "8080.sock"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("127.0.0.1:1"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err := dirDiscoverer(dir).Discover()
+	if err != nil || len(found) != 1 || found[sockPort] == "" {
+		t.Fatalf("Discover = %v, %v", found, err)
+	}
+
+	server := &ServerConfig{}
+	startServer(t, server)
+	client := &ClientConfig{
+		Key:      "test-key",
+		Server:   localAddr(server.Port),
+		Discover: &DiscoverConfig{Dir: dir, Interval: 1, Debounce: -1},
+	}
+	run(t, func(ctx context.Context) error { return DoClient(ctx, client) })
+	waitDial(t, localAddr(sockPort))
+	if got := roundTrip(t, localAddr(sockPort), []byte("ping")); string(got) != "ping" {
+		t.Fatalf("echo over unix socket %q", got)
+	}
+	addrFile := filepath.Join(dir, fmt.Sprintf("%v.addr", addrPort))
+	if err := ioutil.WriteFile(addrFile, []byte(echoServer(t)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitDial(t, localAddr(addrPort))
+	if got := roundTrip(t, localAddr(addrPort), []byte("pong")); string(got) != "pong" {
+		t.Fatalf("echo over tcp %q", got)
+	}
+	os.Remove(addrFile)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", localAddr(addrPort))
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("port still open after the service was gone")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := roundTrip(t, localAddr(sockPort), []byte("ping")); string(got) != "ping" {
+		t.Fatalf("unrelated mapping affected: %q", got)
+	}
+}
+
+func TestDiscoverInit(t *testing.T) {
+	RegisterDiscoverer("test-static", DiscovererFunc(func() (map[uint16]string, error) {
+		return map[uint16]string{1: "127.0.0.1:1"}, nil
+	}))
+	for _, c := range []DiscoverConfig{{}, {Source: "no-such-source"}, {Dir: "x", Interval: -1}, {Dir: "x", Map: ClientMapConfig{ForwardProxy: "http"}}} {
+		if err := c.Init(); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+	c := &DiscoverConfig{Source: "test-static"}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := c.source.Discover(); found[1] != "127.0.0.1:1" {
+		t.Errorf("registered source returned %v", found)
+	}
+}
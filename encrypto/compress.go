@@ -0,0 +1,59 @@
+package encrypto
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// compressor 压缩模式的读写状态，压缩在加密之前，解压在解密之后
+type compressor struct {
+	zw   *flate.Writer
+	zr   io.ReadCloser
+	wbuf []byte
+}
+
+// EnableCompress 对明文以DEFLATE压缩后再加密，双方必须同时开启；
+// 每次写入后同步刷新，对端不需要等待后续数据就能解压已收到的部分
+func (my *NCopy) EnableCompress() {
+	my.zip = &compressor{}
+}
+
+// sealWriter 将压缩后的数据交给加密层写出
+type sealWriter struct{ my *NCopy }
+
+func (w sealWriter) Write(p []byte) (int, error) {
+	// 加密会原地修改数据，不能修改压缩器的缓冲(无法压缩时为原始窗口)
+	z := w.my.zip
+	z.wbuf = append(z.wbuf[:0], p...)
+	return w.my.writeCrypt(z.wbuf)
+}
+
+// openReader 从加密层读取解密后的压缩数据
+type openReader struct{ my *NCopy }
+
+func (r openReader) Read(p []byte) (int, error) {
+	return r.my.readCrypt(p)
+}
+
+// writeCompressed 压缩p并刷新
+func (my *NCopy) writeCompressed(p []byte) (n int, err error) {
+	z := my.zip
+	if z.zw == nil {
+		if z.zw, err = flate.NewWriter(sealWriter{my}, flate.BestSpeed); err != nil {
+			return 0, err
+		}
+	}
+	if n, err = z.zw.Write(p); err != nil {
+		return n, err
+	}
+	return n, z.zw.Flush()
+}
+
+// readCompressed 读取并解压
+func (my *NCopy) readCompressed(p []byte) (int, error) {
+	z := my.zip
+	if z.zr == nil {
+		z.zr = flate.NewReader(openReader{my})
+	}
+	return z.zr.Read(p)
+}
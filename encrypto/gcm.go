@@ -0,0 +1,179 @@
+package encrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// 数据连接加密方式
+const (
+	CipherCTR = "ctr" // AES-CTR，只加密不认证，默认
+	CipherGCM = "gcm" // AES-GCM，每条记录独立认证，篡改后对端断开
+)
+
+// GCM模式下每个方向先发送 盐(16)，之后每条记录为 长度(2) 密文，长度作为附加数据参与认证
+const (
+	gcmSaltSize  = 16
+	gcmHeader    = 2
+	gcmMaxRecord = 16 * 1024
+)
+
+// ErrAuth 记录认证失败，数据被篡改或双方密钥、加密方式不一致
+var ErrAuth = errors.New("message authentication failed")
+
+// gcmStream 一个方向的AES-GCM状态
+type gcmStream struct {
+	aead  cipher.AEAD
+	nonce []byte
+	seq   uint64
+}
+
+// newGCMStream 由密钥、iv与该方向的随机盐派生本方向的密钥，
+// 每个连接每个方向的密钥都不同，记录序号作为nonce不会重复
+func newGCMStream(key, iv, salt []byte) (*gcmStream, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(iv)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil)[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmStream{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (g *gcmStream) next() []byte {
+	binary.BigEndian.PutUint64(g.nonce[len(g.nonce)-8:], g.seq)
+	g.seq++
+	return g.nonce
+}
+
+// gcm 认证加密模式的读写状态
+type gcm struct {
+	key, iv []byte
+	w, r    *gcmStream
+	hdrs    []byte      // 本次写出的各记录长度
+	wbuf    []byte      // 本次写出的各记录密文
+	bufs    net.Buffers // 本次写出的盐(首次)、长度与密文，复用底层数组
+	flat    []byte      // 不支持writev的连接合并后写出
+	rbuf    []byte
+	pending []byte
+}
+
+// EnableGCM 使用AES-GCM代替AES-CTR，双方必须同时开启
+func (my *NCopy) EnableGCM(key, iv []byte) {
+	my.gcm = &gcm{key: key, iv: iv}
+}
+
+// writeSealed 将p分为多条记录加密认证，首次写入时先发送本方向的盐；
+// 全部记录的长度与密文以writev一次写出，每次写入只有一次系统调用
+func (my *NCopy) writeSealed(p []byte) (n int, err error) {
+	g := my.gcm
+	bufs := g.bufs[:0]
+	if g.w == nil {
+		salt := make([]byte, gcmSaltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return 0, err
+		}
+		if g.w, err = newGCMStream(g.key, g.iv, salt); err != nil {
+			return 0, err
+		}
+		bufs = append(bufs, salt)
+	}
+	// 预先分配足够的容量，之后append不会扩容，已放入bufs的切片保持有效
+	records := (len(p) + gcmMaxRecord - 1) / gcmMaxRecord
+	if need := records * gcmHeader; cap(g.hdrs) < need {
+		g.hdrs = make([]byte, 0, need)
+	}
+	if need := len(p) + records*g.w.aead.Overhead(); cap(g.wbuf) < need {
+		g.wbuf = make([]byte, 0, need)
+	}
+	hdrs, wbuf := g.hdrs[:0], g.wbuf[:0]
+	for off := 0; off < len(p); {
+		chunk := p[off:]
+		if len(chunk) > gcmMaxRecord {
+			chunk = chunk[:gcmMaxRecord]
+		}
+		size := len(chunk) + g.w.aead.Overhead()
+		h, start := len(hdrs), len(wbuf)
+		hdrs = append(hdrs, uint8(size>>8), uint8(size))
+		wbuf = g.w.aead.Seal(wbuf, g.w.next(), chunk, hdrs[h:])
+		bufs = append(bufs, hdrs[h:], wbuf[start:])
+		off += len(chunk)
+	}
+	// WriteTo会消耗bufs，保留底层数组供下次使用
+	g.bufs = bufs[:0]
+	if err = my.writeBuffers(&bufs); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeBuffers TCP与Unix连接以writev写出，内核短写时由标准库继续写出剩余部分；
+// 其他连接(如TLS)逐段写出会产生很多小的写入，合并后一次写出
+func (my *NCopy) writeBuffers(bufs *net.Buffers) error {
+	switch my.conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		_, err := bufs.WriteTo(my.conn)
+		return err
+	}
+	g := my.gcm
+	g.flat = g.flat[:0]
+	for _, b := range *bufs {
+		g.flat = append(g.flat, b...)
+	}
+	_, err := writeFull(my.conn, g.flat)
+	return err
+}
+
+// readSealed 读取并校验一条记录，认证失败时关闭连接并返回ErrAuth
+func (my *NCopy) readSealed(p []byte) (n int, err error) {
+	g := my.gcm
+	if g.r == nil {
+		salt := make([]byte, gcmSaltSize)
+		if _, err = io.ReadFull(my.conn, salt); err != nil {
+			return 0, err
+		}
+		if g.r, err = newGCMStream(g.key, g.iv, salt); err != nil {
+			return 0, err
+		}
+	}
+	if len(g.pending) == 0 {
+		var hdr [gcmHeader]byte
+		if _, err = io.ReadFull(my.conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(hdr[:]))
+		if size < g.r.aead.Overhead() {
+			my.conn.Close()
+			return 0, ErrAuth
+		}
+		if cap(g.rbuf) < size {
+			g.rbuf = make([]byte, size)
+		}
+		record := g.rbuf[:size]
+		if _, err = io.ReadFull(my.conn, record); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if g.pending, err = g.r.aead.Open(record[:0], g.r.next(), record, hdr[:]); err != nil {
+			my.conn.Close()
+			return 0, ErrAuth
+		}
+	}
+	n = copy(p, g.pending)
+	g.pending = g.pending[n:]
+	return n, nil
+}
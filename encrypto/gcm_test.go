@@ -0,0 +1,139 @@
+package encrypto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// tcpPair 本机TCP连接的两端，另一端丢弃收到的数据
+func tcpPair(b *testing.B) net.Conn {
+	b.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { c.Close() })
+	return c
+}
+
+// TestGCMWritev 对端读取较慢时writev会短写，数据仍完整
+func TestGCMWritev(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	w, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	rc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	// 缩小发送缓冲，每次writev都写不完
+	w.(*net.TCPConn).SetWriteBuffer(4096)
+	var enc, dec NCopy
+	enc.Init(w, testKey, testIV, 0)
+	enc.EnableGCM(testKey, testIV)
+	dec.Init(rc, testKey, testIV, 0)
+	dec.EnableGCM(testKey, testIV)
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	go func() {
+		for off := 0; off < len(data); off += 3 * gcmMaxRecord {
+			end := off + 3*gcmMaxRecord
+			if end > len(data) {
+				end = len(data)
+			}
+			// GCM模式加密到单独的缓冲，不修改p
+			if _, err := enc.Write(data[off:end]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	rc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(&dec, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("mismatch after %v bytes", commonPrefix(got, data))
+	}
+}
+
+// writeSealedNaive 逐条记录分别写出长度与密文，作为writev的对照
+func writeSealedNaive(conn net.Conn, g *gcmStream, p []byte, buf []byte) error {
+	for off := 0; off < len(p); {
+		chunk := p[off:]
+		if len(chunk) > gcmMaxRecord {
+			chunk = chunk[:gcmMaxRecord]
+		}
+		size := len(chunk) + g.aead.Overhead()
+		hdr := []byte{uint8(size >> 8), uint8(size)}
+		if _, err := conn.Write(hdr); err != nil {
+			return err
+		}
+		if _, err := conn.Write(g.aead.Seal(buf[:0], g.next(), chunk, hdr)); err != nil {
+			return err
+		}
+		off += len(chunk)
+	}
+	return nil
+}
+
+// BenchmarkGCMWrite 比较一次writev与每条记录两次write的开销
+func BenchmarkGCMWrite(b *testing.B) {
+	for _, size := range []int{512, BufferSize, 4 * gcmMaxRecord} {
+		p := make([]byte, size)
+		b.Run("writev/"+strconv.Itoa(size), func(b *testing.B) {
+			var c NCopy
+			c.Init(tcpPair(b), testKey, testIV, 0)
+			c.EnableGCM(testKey, testIV)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("naive/"+strconv.Itoa(size), func(b *testing.B) {
+			conn := tcpPair(b)
+			g, err := newGCMStream(testKey, testIV, make([]byte, gcmSaltSize))
+			if err != nil {
+				b.Fatal(err)
+			}
+			buf := make([]byte, gcmMaxRecord+g.aead.Overhead())
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := writeSealedNaive(conn, g, p, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package encrypto
+
+import (
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt的参数，双方必须一致；N=2^15 r=8 需要约32MB内存
+const (
+	KDFCost        = 1 << 15 // N
+	KDFBlockSize   = 8       // r
+	KDFParallelism = 1       // p
+)
+
+// GetKeyIvKDF 通过scrypt从密码与盐计算出key iv，比GetKeyIv慢得多，每个会话只需计算一次
+func GetKeyIvKDF(passwd, salt string) (key []byte, iv []byte) {
+	dk, err := scrypt.Key([]byte(passwd), []byte(salt), KDFCost, KDFBlockSize, KDFParallelism, 32)
+	if err != nil {
+		// 只有参数不合法时出错，参数是常量
+		panic(err)
+	}
+	return dk[:16], dk[16:]
+}
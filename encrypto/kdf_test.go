@@ -0,0 +1,31 @@
+package encrypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGetKeyIvKDF(t *testing.T) {
+	key, iv := GetKeyIvKDF("password", "salt")
+	if len(key) != 16 || len(iv) != 16 {
+		t.Fatalf("got key %v bytes, iv %v bytes; want 16, 16", len(key), len(iv))
+	}
+	tests := []struct {
+		name         string
+		passwd, salt string
+		same         bool
+	}{
+		{"same input", "password", "salt", true},
+		{"other salt", "password", "salt2", false},
+		{"other password", "password2", "salt", false},
+	}
+	for _, tt := range tests {
+		k, v := GetKeyIvKDF(tt.passwd, tt.salt)
+		if same := bytes.Equal(k, key) && bytes.Equal(v, iv); same != tt.same {
+			t.Errorf("%v: derived the same key %v, want %v", tt.name, same, tt.same)
+		}
+	}
+	if md5Key, _ := GetKeyIv("password"); bytes.Equal(md5Key, key) {
+		t.Error("kdf key equals the md5 key")
+	}
+}
@@ -3,11 +3,52 @@ package encrypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"io"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
+// BufferSize 每个复制方向默认使用的缓冲大小
+const BufferSize = 10240
+
+// Logf 输出数据连接的异常(如校验失败)，默认使用标准库log，调用方可替换为分级日志
+var Logf = log.Printf
+
+// bufferPools 按大小区分的复制缓冲池(int -> *sync.Pool)，避免每个连接分配新的缓冲；
+// 同一进程中的服务端与客户端可以使用不同的大小
+var bufferPools sync.Map
+
+// getBuffer 从size大小的缓冲池取出缓冲，size不大于0时使用BufferSize
+func getBuffer(size int) *[]byte {
+	if size <= 0 {
+		size = BufferSize
+	}
+	p, ok := bufferPools.Load(size)
+	if !ok {
+		p, _ = bufferPools.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		})
+	}
+	return p.(*sync.Pool).Get().(*[]byte)
+}
+
+// putBuffer 归还缓冲到同样大小的缓冲池
+func putBuffer(b *[]byte) {
+	if p, ok := bufferPools.Load(len(*b)); ok {
+		p.(*sync.Pool).Put(b)
+	}
+}
+
 // GetMd5 获取key的md5
 func GetMd5(key string) []byte {
 	d5 := md5.New()
@@ -33,14 +74,55 @@ func GetKeyIv(passwd string) (key []byte, iv []byte) {
 	return key, iv
 }
 
+// IVSize 随机iv的长度
+const IVSize = aes.BlockSize
+
+// NewIV 生成数据连接使用的随机iv，密钥不变时每个连接的密钥流也不同
+func NewIV() ([]byte, error) {
+	iv := make([]byte, IVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	return iv, nil
+}
+
 // NStreamCrypt AES CTR加密算法
 type NStreamCrypt struct {
 	rstream cipher.Stream
 	wstream cipher.Stream
 }
 
-// Init 初始化
+// 派生两个方向iv的标签，客户端写出(服务端读取)为client
+var (
+	labelClient = []byte("pmap client->server")
+	labelServer = []byte("pmap server->client")
+)
+
+// directionIV 由密钥、连接的iv与方向标签派生该方向的iv
+func directionIV(key, iv, label []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(iv)
+	mac.Write(label)
+	return mac.Sum(nil)[:IVSize]
+}
+
+// Init 初始化，读写两个方向使用同一iv，密钥流相同；只用于不支持InitSplit的旧版本对端
 func (my *NStreamCrypt) Init(key, iv []byte) {
+	my.init(key, iv, iv)
+}
+
+// InitSplit 初始化，读写两个方向使用由iv派生的不同iv，两个方向的密文不会相互抵消；
+// client为客户端一侧，服务端一侧的读写方向与之相反
+func (my *NStreamCrypt) InitSplit(key, iv []byte, client bool) {
+	civ, siv := directionIV(key, iv, labelClient), directionIV(key, iv, labelServer)
+	if client {
+		my.init(key, siv, civ)
+	} else {
+		my.init(key, civ, siv)
+	}
+}
+
+func (my *NStreamCrypt) init(key, riv, wiv []byte) {
 	//指定加密、解密算法为AES，返回一个AES的Block接口对象
 	rblock, rerr := aes.NewCipher(key)
 	if rerr != nil {
@@ -50,8 +132,8 @@ func (my *NStreamCrypt) Init(key, iv []byte) {
 	if werr != nil {
 		panic(werr)
 	}
-	my.rstream = cipher.NewCTR(rblock, iv)
-	my.wstream = cipher.NewCTR(wblock, iv)
+	my.rstream = cipher.NewCTR(rblock, riv)
+	my.wstream = cipher.NewCTR(wblock, wiv)
 }
 
 // RCrypt 读时解密
@@ -68,24 +150,88 @@ func (my *NStreamCrypt) WCrypt(text []byte) {
 type NCopy struct {
 	conn  net.Conn
 	crypt *NStreamCrypt
+	sum   *checksum   // 诊断用的校验模式，为空不开启
+	gcm   *gcm        // 认证加密模式，为空使用AES-CTR
+	zip   *compressor // 压缩模式，为空不压缩
+	half  int32       // 已半关闭结束的复制方向数
+	size  int         // WCopy与RCopy使用的缓冲大小
 }
 
-// Init 初始化
-func (my *NCopy) Init(conn net.Conn, key, iv []byte) {
+// Init 初始化，bufSize为WCopy与RCopy复制时的缓冲大小，不大于0时使用BufferSize
+func (my *NCopy) Init(conn net.Conn, key, iv []byte, bufSize int) {
 	var c NStreamCrypt
 	c.Init(key, iv)
 	my.crypt = &c
 	my.conn = conn
+	my.size = bufSize
 }
 
-// Write 写入流时加密
+// InitSplit 初始化，两个方向使用不同的iv，见NStreamCrypt.InitSplit；bufSize同Init
+func (my *NCopy) InitSplit(conn net.Conn, key, iv []byte, client bool, bufSize int) {
+	var c NStreamCrypt
+	c.InitSplit(key, iv, client)
+	my.crypt = &c
+	my.conn = conn
+	my.size = bufSize
+}
+
+// Write 写入流时加密，未开启压缩时p会被原地加密
 func (my *NCopy) Write(p []byte) (n int, err error) {
+	if my.zip != nil {
+		return my.writeCompressed(p)
+	}
+	return my.writeCrypt(p)
+}
+
+// writeCrypt 加密后写出，p会被原地加密；短写时继续写出剩余部分，避免已消耗的密钥流与对端错位
+func (my *NCopy) writeCrypt(p []byte) (n int, err error) {
+	if my.gcm != nil {
+		return my.writeSealed(p)
+	}
+	if my.sum != nil {
+		return my.writeFrame(p)
+	}
 	my.crypt.WCrypt(p)
-	return my.conn.Write(p)
+	return writeFull(my.conn, p)
+}
+
+// writeFull 写出全部数据，返回实际写出的字节数
+func writeFull(w io.Writer, p []byte) (n int, err error) {
+	for n < len(p) {
+		var nn int
+		nn, err = w.Write(p[n:])
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		if nn == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
 }
 
 // Read 从流里面读时解密
 func (my *NCopy) Read(p []byte) (n int, err error) {
+	if my.zip != nil {
+		return my.readCompressed(p)
+	}
+	return my.readCrypt(p)
+}
+
+// readCrypt 读取并解密
+func (my *NCopy) readCrypt(p []byte) (n int, err error) {
+	if my.gcm != nil {
+		return my.readSealed(p)
+	}
+	if my.sum != nil {
+		return my.readFrame(p)
+	}
+	return my.readRaw(p)
+}
+
+// readRaw 读取并解密
+func (my *NCopy) readRaw(p []byte) (n int, err error) {
 	n, err = my.conn.Read(p)
 	if n > 0 {
 		my.crypt.RCrypt(p[:n])
@@ -98,17 +244,72 @@ func (my *NCopy) Close() error {
 	return my.conn.Close()
 }
 
-// WCopy 写的一端加密，读不加密
+// closeWriter 支持半关闭的连接，如*net.TCPConn与*tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// unwrapper 包装了另一个连接的连接
+type unwrapper interface {
+	Unwrap() net.Conn
+}
+
+// CloseWrite 关闭conn写的一端，对端读到EOF后仍可回复；conn及其包装的连接都不支持半关闭时返回false
+func CloseWrite(conn net.Conn) bool {
+	for {
+		if c, ok := conn.(closeWriter); ok {
+			return c.CloseWrite() == nil
+		}
+		w, ok := conn.(unwrapper)
+		if !ok {
+			return false
+		}
+		conn = w.Unwrap()
+	}
+}
+
+// closeWrite 关闭加密连接写的一端，压缩模式先写出结束块，对端解压时才能读到EOF
+func (my *NCopy) closeWrite() bool {
+	if z := my.zip; z != nil {
+		if z.zw == nil {
+			if _, err := my.writeCompressed(nil); err != nil {
+				return false
+			}
+		}
+		if z.zw.Close() != nil {
+			return false
+		}
+	}
+	return CloseWrite(my.conn)
+}
+
+// finish 一个复制方向结束：half表示已读到EOF并半关闭了写的一端，另一方向仍继续，两个方向都结束后关闭两端；
+// 出错或不支持半关闭时立即关闭两端，另一方向随之结束
+func (my *NCopy) finish(plain net.Conn, half bool) {
+	if half && atomic.AddInt32(&my.half, 1) < 2 {
+		return
+	}
+	plain.Close()
+	my.Close()
+}
+
+// WCopy 写的一端加密，读不加密；src读到EOF时半关闭dst，见finish
 func WCopy(dst *NCopy, src net.Conn) {
+	bp := getBuffer(dst.size)
+	var err error
 	defer func() {
-		src.Close()
-		dst.Close()
+		putBuffer(bp)
+		dst.finish(src, err == io.EOF && dst.closeWrite())
 	}()
-	buf := make([]byte, 10240)
+	buf := *bp
 	for {
-		n, err := src.Read(buf)
+		var n int
+		n, err = src.Read(buf)
 		if n > 0 {
-			(*dst).Write(buf[:n])
+			if _, werr := (*dst).Write(buf[:n]); werr != nil {
+				err = werr
+				return
+			}
 		}
 		if err != nil {
 			return
@@ -116,17 +317,23 @@ func WCopy(dst *NCopy, src net.Conn) {
 	}
 }
 
-// RCopy 读的一端解密，写不加密
+// RCopy 读的一端解密，写不加密；src读到EOF时半关闭dst，见finish
 func RCopy(dst net.Conn, src *NCopy) {
+	bp := getBuffer(src.size)
+	var err error
 	defer func() {
-		src.Close()
-		dst.Close()
+		putBuffer(bp)
+		src.finish(dst, err == io.EOF && CloseWrite(dst))
 	}()
-	buf := make([]byte, 10240)
+	buf := *bp
 	for {
-		n, err := (*src).Read(buf)
+		var n int
+		n, err = (*src).Read(buf)
 		if n > 0 {
-			dst.Write(buf[:n])
+			if _, werr := writeFull(dst, buf[:n]); werr != nil {
+				err = werr
+				return
+			}
 		}
 		if err != nil {
 			return
@@ -134,17 +341,21 @@ func RCopy(dst net.Conn, src *NCopy) {
 	}
 }
 
-// NetCopy 流复制处理
+// NetCopy 流复制处理，使用BufferSize大小的缓冲
 func NetCopy(dst, src net.Conn, msg string) {
+	bp := getBuffer(BufferSize)
 	defer func() {
+		putBuffer(bp)
 		src.Close()
 		dst.Close()
 	}()
-	buf := make([]byte, 10240)
+	buf := *bp
 	for {
 		n, err := src.Read(buf)
 		if n > 0 {
-			dst.Write(buf[:n])
+			if _, werr := writeFull(dst, buf[:n]); werr != nil {
+				return
+			}
 		}
 		if err != nil {
 			return
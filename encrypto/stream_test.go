@@ -0,0 +1,357 @@
+package encrypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testKey, testIV = GetKeyIv("0123456789abcdef")
+
+// tunnel 明文 -> WCopy -> 加密连接 -> RCopy -> 明文，返回写入端与读取端
+func tunnel(t *testing.T, setup func(w, r *NCopy)) (io.WriteCloser, io.Reader) {
+	t.Helper()
+	in, src := net.Pipe()
+	enc, dec := net.Pipe()
+	dst, out := net.Pipe()
+	var w, r NCopy
+	w.Init(enc, testKey, testIV, 0)
+	r.Init(dec, testKey, testIV, 0)
+	if setup != nil {
+		setup(&w, &r)
+	}
+	go WCopy(&w, src)
+	go RCopy(dst, &r)
+	t.Cleanup(func() {
+		in.Close()
+		out.Close()
+	})
+	return in, out
+}
+
+func TestCopyRoundTrip(t *testing.T) {
+	modes := []struct {
+		name  string
+		setup func(w, r *NCopy)
+	}{
+		{"ctr", nil},
+		{"checksum", func(w, r *NCopy) { w.EnableChecksum(); r.EnableChecksum() }},
+		{"gcm", func(w, r *NCopy) { w.EnableGCM(testKey, testIV); r.EnableGCM(testKey, testIV) }},
+		{"compress", func(w, r *NCopy) { w.EnableCompress(); r.EnableCompress() }},
+		{"gcm+compress", func(w, r *NCopy) {
+			w.EnableGCM(testKey, testIV)
+			r.EnableGCM(testKey, testIV)
+			w.EnableCompress()
+			r.EnableCompress()
+		}},
+	}
+	sizes := []int{0, 1, 100, BufferSize - 1, BufferSize, BufferSize + 1, 3*BufferSize + 7, gcmMaxRecord + 1, 1 << 20}
+	for _, mode := range modes {
+		for _, size := range sizes {
+			mode, size := mode, size
+			t.Run(mode.name+"/"+strconv.Itoa(size), func(t *testing.T) {
+				data := make([]byte, size)
+				rand.New(rand.NewSource(int64(size))).Read(data)
+				in, out := tunnel(t, mode.setup)
+				go func() {
+					in.Write(data)
+					in.Close()
+				}()
+				got, err := readAll(out, 10*time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("got %v bytes, want %v bytes (equal prefix %v)", len(got), len(data), commonPrefix(got, data))
+				}
+			})
+		}
+	}
+}
+
+// readAll 读取到EOF，超时返回错误
+func readAll(r io.Reader, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		b   []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, err := ioutil.ReadAll(r)
+		done <- result{b, err}
+	}()
+	select {
+	case res := <-done:
+		return res.b, res.err
+	case <-time.After(timeout):
+		return nil, io.ErrNoProgress
+	}
+}
+
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// shortConn 每次最多写出max字节，模拟发送缓冲将满时的短写；written达到failAfter后写入失败
+type shortConn struct {
+	net.Conn
+	max       int
+	failAfter int
+	written   int
+}
+
+var errBroken = errors.New("broken pipe")
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	if c.failAfter > 0 && c.written >= c.failAfter {
+		return 0, errBroken
+	}
+	if len(p) > c.max {
+		p = p[:c.max]
+	}
+	n, err := c.Conn.Write(p)
+	c.written += n
+	return n, err
+}
+
+func TestWriteFull(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		failAfter int
+		size      int
+		wantN     int
+		wantErr   error
+	}{
+		{"empty", 1, 0, 0, 0, nil},
+		{"single", 1, 0, 1, 1, nil},
+		{"short", 7, 0, 1000, 1000, nil},
+		{"fail midway", 100, 300, 1000, 300, errBroken},
+		{"zero progress", 0, 0, 10, 0, io.ErrShortWrite},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			go io.Copy(ioutil.Discard, b)
+			w := &shortConn{Conn: a, max: tt.max, failAfter: tt.failAfter}
+			n, err := writeFull(w, make([]byte, tt.size))
+			if n != tt.wantN || err != tt.wantErr {
+				t.Fatalf("writeFull = %v, %v; want %v, %v", n, err, tt.wantN, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCopyShortWrite 加密连接与明文连接都短写时数据仍完整，密钥流不错位
+func TestCopyShortWrite(t *testing.T) {
+	data := make([]byte, 5*BufferSize+3)
+	rand.New(rand.NewSource(1)).Read(data)
+	in, src := net.Pipe()
+	enc, dec := net.Pipe()
+	dst, out := net.Pipe()
+	var w, r NCopy
+	w.Init(&shortConn{Conn: enc, max: 333}, testKey, testIV, 0)
+	r.Init(dec, testKey, testIV, 0)
+	go WCopy(&w, src)
+	go RCopy(&shortConn{Conn: dst, max: 1001}, &r)
+	defer out.Close()
+	go func() {
+		in.Write(data)
+		in.Close()
+	}()
+	got, err := readAll(out, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %v bytes, want %v bytes (equal prefix %v)", len(got), len(data), commonPrefix(got, data))
+	}
+}
+
+// readSizeConn 记录每次Read的缓冲大小
+type readSizeConn struct {
+	net.Conn
+	sizes chan int
+}
+
+func (c *readSizeConn) Read(p []byte) (int, error) {
+	select {
+	case c.sizes <- len(p):
+	default:
+	}
+	return c.Conn.Read(p)
+}
+
+// TestCopyBufferSize 每个NCopy按Init时的大小分配缓冲，不同大小的连接互不影响
+func TestCopyBufferSize(t *testing.T) {
+	for _, size := range []int{0, 512, 4096} {
+		in, src := net.Pipe()
+		enc, dec := net.Pipe()
+		go io.Copy(ioutil.Discard, dec)
+		var w NCopy
+		w.Init(enc, testKey, testIV, size)
+		rc := &readSizeConn{Conn: src, sizes: make(chan int, 1)}
+		go WCopy(&w, rc)
+		want := size
+		if want == 0 {
+			want = BufferSize
+		}
+		if got := <-rc.sizes; got != want {
+			t.Errorf("Init with %v: read buffer %v, want %v", size, got, want)
+		}
+		in.Close()
+		dec.Close()
+	}
+}
+
+// TestCopyWriteError 写出失败时复制结束，两端的连接都被关闭
+func TestCopyWriteError(t *testing.T) {
+	t.Run("WCopy", func(t *testing.T) {
+		in, src := net.Pipe()
+		enc, dec := net.Pipe()
+		defer dec.Close()
+		go io.Copy(ioutil.Discard, dec)
+		var w NCopy
+		w.Init(&shortConn{Conn: enc, max: 100, failAfter: 250}, testKey, testIV, 0)
+		done := make(chan struct{})
+		go func() {
+			WCopy(&w, src)
+			close(done)
+		}()
+		go in.Write(make([]byte, 1000))
+		waitClosed(t, done, in)
+	})
+	t.Run("RCopy", func(t *testing.T) {
+		enc, dec := net.Pipe()
+		dst, out := net.Pipe()
+		defer out.Close()
+		go io.Copy(ioutil.Discard, out)
+		var w, r NCopy
+		w.Init(enc, testKey, testIV, 0)
+		r.Init(dec, testKey, testIV, 0)
+		done := make(chan struct{})
+		go func() {
+			RCopy(&shortConn{Conn: dst, max: 100, failAfter: 250}, &r)
+			close(done)
+		}()
+		go w.Write(make([]byte, 1000))
+		waitClosed(t, done, enc)
+	})
+}
+
+// waitClosed 等待复制结束，并确认对端连接已关闭
+func waitClosed(t *testing.T, done chan struct{}, peer net.Conn) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("copy did not stop after the write error")
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, peer); err != nil {
+		t.Fatalf("peer not closed: %v", err)
+	}
+}
+
+// TestNCopyWriteShort 底层连接短写时NCopy.Write写出全部数据，返回的长度为len(p)
+func TestNCopyWriteShort(t *testing.T) {
+	modes := []struct {
+		name  string
+		setup func(c *NCopy)
+	}{
+		{"ctr", func(c *NCopy) {}},
+		{"checksum", func(c *NCopy) { c.EnableChecksum() }},
+		{"gcm", func(c *NCopy) { c.EnableGCM(testKey, testIV) }},
+		{"compress", func(c *NCopy) { c.EnableCompress() }},
+	}
+	for _, mode := range modes {
+		mode := mode
+		t.Run(mode.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			var w, r NCopy
+			w.Init(&shortConn{Conn: a, max: 5}, testKey, testIV, 0)
+			r.Init(b, testKey, testIV, 0)
+			mode.setup(&w)
+			mode.setup(&r)
+			go func() {
+				defer a.Close()
+				for i := 0; i < 3; i++ {
+					p := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+					if n, err := w.Write(p); n != 1000 || err != nil {
+						t.Errorf("Write = %v, %v; want 1000, nil", n, err)
+						return
+					}
+				}
+			}()
+			var want []byte
+			for i := 0; i < 3; i++ {
+				want = append(want, bytes.Repeat([]byte{byte('a' + i)}, 1000)...)
+			}
+			// 压缩流没有结束块，读取到EOF时返回ErrUnexpectedEOF，只读取写出的长度
+			b.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(&r, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %v bytes, want %v bytes (equal prefix %v)", len(got), len(want), commonPrefix(got, want))
+			}
+		})
+	}
+}
+
+// TestInitSplit 两个方向加密相同的明文，密文不同，对端仍能解密
+func TestInitSplit(t *testing.T) {
+	iv, err := NewIV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("same plaintext in both directions "), 4)
+	seal := func(c *NStreamCrypt) []byte {
+		b := append([]byte(nil), plain...)
+		c.WCrypt(b)
+		return b
+	}
+	var client, server NStreamCrypt
+	client.InitSplit(testKey, iv, true)
+	server.InitSplit(testKey, iv, false)
+	up, down := seal(&client), seal(&server)
+	if bytes.Equal(up, down) {
+		t.Fatal("both directions produced the same ciphertext")
+	}
+	for _, c := range []struct {
+		name string
+		dec  *NStreamCrypt
+		data []byte
+	}{
+		{"server reads client", &server, up},
+		{"client reads server", &client, down},
+	} {
+		c.dec.RCrypt(c.data)
+		if !bytes.Equal(c.data, plain) {
+			t.Errorf("%v: decrypted %q", c.name, c.data)
+		}
+	}
+
+	// 旧的Init两个方向的密钥流相同，作为对照
+	var a, b NStreamCrypt
+	a.Init(testKey, iv)
+	b.Init(testKey, iv)
+	if !bytes.Equal(seal(&a), seal(&b)) {
+		t.Fatal("Init no longer shares the iv between directions")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NameMax 映射名称的最大字节数，ASSIGN中以1字节表示长度
+const NameMax = 255
+
+// errPoolExhausted 临时端口池中没有空闲端口
+var errPoolExhausted = errors.New("ephemeral port pool exhausted")
+
+// Assignment 临时端口的分配记录，由/ports输出，控制面按客户端与名称查找分配到的端口
+type Assignment struct {
+	Port   uint16    `json:"port"`
+	Client string    `json:"client,omitempty"` // 多密钥时为密钥名称
+	Addr   string    `json:"addr"`             // 客户端控制连接的地址
+	Name   string    `json:"name"`             // 客户端请求的服务名称
+	Since  time.Time `json:"since"`
+}
+
+// portPool 服务端分配给客户端的临时端口，映射的outer为0时从中随机选择空闲端口；
+// 同一客户端的同一名称重连后优先分配上次的端口，地址保持不变
+type portPool struct {
+	ports    PortSet
+	size     int
+	mu       sync.Mutex
+	assigned map[uint16]*Assignment
+	last     map[string]uint16 // 客户端与名称上次分配的端口
+}
+
+// newPortPool ports为空时不分配，Assign总是返回errPoolExhausted
+func newPortPool(ports PortSet) *portPool {
+	p := &portPool{ports: ports, assigned: make(map[uint16]*Assignment), last: make(map[string]uint16)}
+	for _, r := range ports {
+		p.size += int(r.max) - int(r.min) + 1
+	}
+	return p
+}
+
+// nth 池中第i个端口
+func (p *portPool) nth(i int) uint16 {
+	for _, r := range p.ports {
+		n := int(r.max) - int(r.min) + 1
+		if i < n {
+			return r.min + uint16(i)
+		}
+		i -= n
+	}
+	return 0
+}
+
+// Assign 为客户端的名称分配一个未分配且busy返回false的端口，端口在Release前不会再分配
+func (p *portPool) Assign(client, addr, name string, busy func(uint16) bool) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := client + "/" + name
+	var free = func(port uint16) bool {
+		_, ok := p.assigned[port]
+		return !ok && p.ports.Contains(port) && !busy(port)
+	}
+	port, ok := p.last[key]
+	if !ok || !free(port) {
+		port = 0
+		// 从随机位置开始顺序查找，端口不可预测，池快满时也能找到空闲端口
+		start := 0
+		if p.size > 0 {
+			start = rand.Intn(p.size)
+		}
+		for i := 0; i < p.size; i++ {
+			if pt := p.nth((start + i) % p.size); free(pt) {
+				port = pt
+				break
+			}
+		}
+		if port == 0 {
+			return 0, errPoolExhausted
+		}
+	}
+	p.assigned[port] = &Assignment{Port: port, Client: client, Addr: addr, Name: name, Since: time.Now()}
+	p.last[key] = port
+	return port, nil
+}
+
+// Release 归还端口，端口未分配时什么也不做
+func (p *portPool) Release(port uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.assigned, port)
+}
+
+// Snapshot 按端口排序的分配记录
+func (p *portPool) Snapshot() []Assignment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var list = make([]Assignment, 0, len(p.assigned))
+	for _, a := range p.assigned {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+	return list
+}
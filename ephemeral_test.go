@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPortPool(t *testing.T) {
+	pool := newPortPool(PortSet{{40000, 40001}, {40010, 40010}})
+	var busy = func(port uint16) bool { return port == 40001 }
+	a, err := pool.Assign("alice", "1.2.3.4:5", "web", busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pool.Assign("alice", "1.2.3.4:5", "api", busy)
+	if err != nil || a == b || a == 40001 || b == 40001 {
+		t.Fatalf("assigned %v and %v: %v", a, b, err)
+	}
+	if _, err := pool.Assign("bob", "5.6.7.8:9", "web", busy); err != errPoolExhausted {
+		t.Fatalf("exhausted pool: %v", err)
+	}
+	if list := pool.Snapshot(); len(list) != 2 || list[0].Port > list[1].Port || list[0].Client != "alice" {
+		t.Fatalf("snapshot %+v", list)
+	}
+	// 重连后同一客户端的同一名称分配到上次的端口
+	pool.Release(a)
+	pool.Release(b)
+	if got, _ := pool.Assign("alice", "1.2.3.4:6", "api", busy); got != b {
+		t.Errorf("api reassigned %v, want %v", got, b)
+	}
+	if _, err := newPortPool(nil).Assign("", "", "web", busy); err != errPoolExhausted {
+		t.Errorf("empty pool: %v", err)
+	}
+}
+
+// TestEphemeralPort 没有outer的映射由服务端分配端口，/ports按名称列出分配的端口，池满时其余映射失败
+func TestEphemeralPort(t *testing.T) {
+	admin := localAddr(freePort(t))
+	p, q := freePort(t), freePort(t)
+	server := &ServerConfig{Admin: admin, EphemeralPorts: PortSet{{p, p}, {q, q}}}
+	startServer(t, server)
+	echo := echoServer(t)
+	client := &ClientConfig{
+		Key:    "test-key",
+		Server: localAddr(server.Port),
+		Map:    []ClientMapConfig{{Inner: echo, Name: "web"}, {Inner: echo, Name: "api"}, {Inner: echo, Name: "extra"}},
+	}
+	run(t, func(ctx context.Context) error { return DoClient(ctx, client) })
+	waitDial(t, admin)
+	var assigned []Assignment
+	deadline := time.Now().Add(5 * time.Second)
+	for len(assigned) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("assigned %+v", assigned)
+		}
+		time.Sleep(50 * time.Millisecond)
+		resp, err := http.Get("http://" + admin + "/ports")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Assigned []Assignment `json:"assigned"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assigned = result.Assigned
+	}
+	names := make(map[string]bool)
+	for _, a := range assigned {
+		if a.Port != p && a.Port != q {
+			t.Errorf("port %v outside the pool", a.Port)
+		}
+		names[a.Name] = true
+		if got := roundTrip(t, localAddr(a.Port), []byte(a.Name)); string(got) != a.Name {
+			t.Errorf("%v: echo %q", a.Name, got)
+		}
+	}
+	if len(names) != 2 {
+		t.Errorf("names %v", names)
+	}
+}
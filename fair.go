@@ -0,0 +1,260 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WeightMax 映射带宽权重的上限
+const WeightMax = 1000
+
+// fairQueue 多个映射共享的带宽，令牌不足时按自计时公平排队(SCFQ)分配：
+// 每个请求的标签为max(系统虚拟时间, 所属映射上一个请求的标签)+字节数/权重，标签小的先取得令牌，
+// 争用时各映射得到的带宽与权重成正比，没有争用时一个映射可以用满全部带宽
+type fairQueue struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	vtime   float64 // 最近一个取得令牌的请求的标签
+	seq     uint64
+	waiting fairHeap
+	timer   *time.Timer
+}
+
+// fairFlow 一个映射在fairQueue中的状态
+type fairFlow struct {
+	weight float64
+	finish float64 // 该映射上一个请求的标签
+}
+
+// fairRequest 排队中的请求
+type fairRequest struct {
+	n     float64
+	tag   float64
+	seq   uint64 // 标签相同时先来先得
+	ready chan struct{}
+	gone  bool // 连接已关闭，放弃等待
+}
+
+type fairHeap []*fairRequest
+
+func (h fairHeap) Len() int { return len(h) }
+func (h fairHeap) Less(i, j int) bool {
+	if h[i].tag != h[j].tag {
+		return h[i].tag < h[j].tag
+	}
+	return h[i].seq < h[j].seq
+}
+func (h fairHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fairHeap) Push(x interface{}) { *h = append(*h, x.(*fairRequest)) }
+func (h *fairHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func newFairQueue(rate float64) *fairQueue {
+	// 与tokenBucket相同，允许一秒内的突发
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &fairQueue{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill 按经过的时间补充令牌，调用时须持有mu
+func (q *fairQueue) refill() {
+	now := time.Now()
+	q.tokens += now.Sub(q.last).Seconds() * q.rate
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+	q.last = now
+}
+
+// Wait 为f取出n个令牌，需要排队时等待，done关闭时放弃并返回false
+func (q *fairQueue) Wait(f *fairFlow, n int, done <-chan struct{}) bool {
+	q.mu.Lock()
+	tag := f.finish
+	if tag < q.vtime {
+		tag = q.vtime
+	}
+	tag += float64(n) / f.weight
+	f.finish = tag
+	q.refill()
+	if len(q.waiting) == 0 && q.enough(float64(n)) {
+		q.tokens -= float64(n)
+		q.vtime = tag
+		q.mu.Unlock()
+		return true
+	}
+	q.seq++
+	r := &fairRequest{n: float64(n), tag: tag, seq: q.seq, ready: make(chan struct{})}
+	heap.Push(&q.waiting, r)
+	q.dispatch()
+	q.mu.Unlock()
+	select {
+	case <-r.ready:
+		return true
+	case <-done:
+		q.mu.Lock()
+		r.gone = true
+		q.mu.Unlock()
+		return false
+	}
+}
+
+// enough 令牌是否足够n，n大于突发量时令牌满即可，之后透支
+func (q *fairQueue) enough(n float64) bool {
+	if n > q.burst {
+		n = q.burst
+	}
+	return q.tokens >= n
+}
+
+// dispatch 按标签顺序唤醒令牌足够的请求，令牌不足时定时再试，调用时须持有mu
+func (q *fairQueue) dispatch() {
+	q.refill()
+	for len(q.waiting) > 0 {
+		r := q.waiting[0]
+		if r.gone {
+			heap.Pop(&q.waiting)
+			continue
+		}
+		if !q.enough(r.n) {
+			break
+		}
+		heap.Pop(&q.waiting)
+		q.tokens -= r.n
+		q.vtime = r.tag
+		close(r.ready)
+	}
+	if len(q.waiting) == 0 || q.timer != nil {
+		return
+	}
+	need := q.waiting[0].n
+	if need > q.burst {
+		need = q.burst
+	}
+	d := time.Duration((need - q.tokens) / q.rate * float64(time.Second))
+	q.timer = time.AfterFunc(d, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.timer = nil
+		q.dispatch()
+	})
+}
+
+// fairLimit 服务端全部映射共享的带宽限制，in为访问者发往内网服务的方向，out为内网服务发往访问者的方向
+type fairLimit struct {
+	in, out *fairQueue // 为nil不限制该方向
+}
+
+// newFairLimit 单位为字节/秒，both为两个方向共同的设置，in、out不为0时覆盖；都为0时返回nil
+func newFairLimit(both, in, out int64) (*fairLimit, error) {
+	if both < 0 || in < 0 || out < 0 {
+		return nil, fmt.Errorf("bad bandwidth %v/%v/%v, must not be negative", both, in, out)
+	}
+	if in == 0 {
+		in = both
+	}
+	if out == 0 {
+		out = both
+	}
+	if in == 0 && out == 0 {
+		return nil, nil
+	}
+	var l fairLimit
+	if in > 0 {
+		l.in = newFairQueue(float64(in))
+	}
+	if out > 0 {
+		l.out = newFairQueue(float64(out))
+	}
+	return &l, nil
+}
+
+// fairShare 一个映射在共享带宽中的份额
+type fairShare struct {
+	limit   *fairLimit
+	in, out fairFlow
+}
+
+// Share 权重为weight的映射的份额，weight为0时为1；没有共享带宽限制时返回nil
+func (l *fairLimit) Share(weight int) *fairShare {
+	if l == nil {
+		return nil
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	return &fairShare{limit: l, in: fairFlow{weight: float64(weight)}, out: fairFlow{weight: float64(weight)}}
+}
+
+// Wrap 返回按份额读写的外网连接，映射的全部连接共用一个份额
+func (s *fairShare) Wrap(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return &fairConn{Conn: conn, share: s, done: make(chan struct{})}
+}
+
+// fairChunk 每次排队的最大字节数，越小各映射交替越均匀
+const fairChunk = 16 * 1024
+
+// fairConn 读取后按in排队，写入前按out排队，连接关闭时不再等待
+type fairConn struct {
+	net.Conn
+	share *fairShare
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (c *fairConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *fairConn) Read(p []byte) (int, error) {
+	q := c.share.limit.in
+	if q != nil && len(p) > fairChunk {
+		p = p[:fairChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 && q != nil {
+		q.Wait(&c.share.in, n, c.done)
+	}
+	return n, err
+}
+
+func (c *fairConn) Write(p []byte) (n int, err error) {
+	q := c.share.limit.out
+	if q == nil {
+		return c.Conn.Write(p)
+	}
+	for len(p) > 0 {
+		k := len(p)
+		if k > fairChunk {
+			k = fairChunk
+		}
+		if !q.Wait(&c.share.out, k, c.done) {
+			return n, io.ErrClosedPipe
+		}
+		m, err := c.Conn.Write(p[:k])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (c *fairConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// contend 各映射以两个连接持续取令牌，返回d时间内各映射取得的字节数
+func contend(q *fairQueue, weights []int, d time.Duration) []int64 {
+	got := make([]int64, len(weights))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, w := range weights {
+		f := &fairFlow{weight: float64(w)}
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for q.Wait(f, fairChunk, done) {
+					atomic.AddInt64(&got[i], fairChunk)
+				}
+			}(i)
+		}
+	}
+	time.Sleep(d)
+	close(done)
+	wg.Wait()
+	return got
+}
+
+// TestFairQueue 争用时各映射得到的带宽与权重成正比，只有一个映射时可以用满全部带宽
+func TestFairQueue(t *testing.T) {
+	const rate = 4 << 20
+	q := newFairQueue(rate)
+	// 跳过开始时的突发，只看排队后的分配
+	q.tokens = 0
+	got := contend(q, []int{4, 1}, 500*time.Millisecond)
+	ratio := float64(got[0]) / float64(got[1])
+	t.Logf("weights 4:1 got %v:%v bytes, ratio %.2f", got[0], got[1], ratio)
+	if ratio < 3 || ratio > 5.5 {
+		t.Errorf("weights 4:1 got ratio %.2f", ratio)
+	}
+	if total := got[0] + got[1]; total > rate*3/4 {
+		t.Errorf("%v bytes in 500ms exceeds the rate", total)
+	}
+
+	q = newFairQueue(rate)
+	q.tokens = 0
+	got = contend(q, []int{1}, 500*time.Millisecond)
+	if got[0] < rate*2/5 || got[0] > rate*3/4 {
+		t.Errorf("single mapping got %v bytes in 500ms at %v bytes/s", got[0], rate)
+	}
+}
+
+// BenchmarkFairQueue 报告权重4:1的两个映射争用时实际得到的带宽比例
+func BenchmarkFairQueue(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		q := newFairQueue(8 << 20)
+		q.tokens = 0
+		got := contend(q, []int{4, 1}, 200*time.Millisecond)
+		b.ReportMetric(float64(got[0])/float64(got[1]), "ratio")
+	}
+}
@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// syscall包中未定义TCP Fast Open相关选项
+const (
+	tcpFastOpen        = 23
+	tcpFastOpenConnect = 30
+)
+
+// FastOpenQueue 监听端口等待完成握手的TFO请求队列长度
+const FastOpenQueue = 256
+
+// fastOpenListen 在监听socket上开启TCP Fast Open，内核未开启时由sysctl决定是否生效
+func fastOpenListen(lc *net.ListenConfig) *net.ListenConfig {
+	prev := lc.Control
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		if prev != nil {
+			if err := prev(network, address, c); err != nil {
+				return err
+			}
+		}
+		return setsockoptInt(c, syscall.IPPROTO_TCP, tcpFastOpen, FastOpenQueue)
+	}
+	return lc
+}
+
+// dialer fastOpen为true时以TCP_FASTOPEN_CONNECT连接，首个数据包随SYN发出
+func dialer(fastOpen bool) *net.Dialer {
+	if !fastOpen {
+		return &net.Dialer{}
+	}
+	return &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setsockoptInt(c, syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+		},
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// fastOpenListen 非Linux平台不支持TCP Fast Open
+func fastOpenListen(lc *net.ListenConfig) *net.ListenConfig {
+	logger.Warn("TCP Fast Open is only supported on linux, ignored")
+	return lc
+}
+
+// dialer 非Linux平台不支持TCP Fast Open
+func dialer(fastOpen bool) *net.Dialer {
+	if fastOpen {
+		logger.Warn("TCP Fast Open is only supported on linux, ignored")
+	}
+	return &net.Dialer{}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+)
+
+// DirConfig 通过隧道公开的本地目录
+type DirConfig struct {
+	Path     string `json:"path"`     // 本地目录
+	Listing  bool   `json:"listing"`  // 允许列出目录内容，关闭时只能访问已知文件名或目录下的index.html
+	User     string `json:"user"`     // Basic认证用户名，为空不认证
+	Password string `json:"password"` // Basic认证密码
+}
+
+// dirServer 进程内的HTTP文件服务，隧道连接通过内存管道直接交给它处理
+type dirServer struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newDirServer 校验目录并启动文件服务
+func newDirServer(outer uint16, cfg *DirConfig) (*dirServer, error) {
+	fi, err := os.Stat(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New(cfg.Path + " is not a directory")
+	}
+	var fs http.FileSystem = http.Dir(cfg.Path)
+	if !cfg.Listing {
+		fs = noListingFS{fs}
+	}
+	var h http.Handler = http.FileServer(fs)
+	if cfg.User != "" {
+		h = basicAuth(h, cfg.User, cfg.Password)
+	} else {
+		logger.Warnf("%v is shared on port %v without authentication, anyone who can reach the port can read it", cfg.Path, outer)
+	}
+	ds := &dirServer{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	go http.Serve(ds, h)
+	logger.Infof("Sharing directory %v on port %v", cfg.Path, outer)
+	return ds, nil
+}
+
+// Dial 返回与文件服务相连的内存管道
+func (ds *dirServer) Dial() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	select {
+	case ds.conns <- c2:
+		return c1, nil
+	case <-ds.done:
+		return nil, errors.New("file server closed")
+	}
+}
+
+// Accept 实现net.Listener
+func (ds *dirServer) Accept() (net.Conn, error) {
+	select {
+	case c := <-ds.conns:
+		return c, nil
+	case <-ds.done:
+		return nil, errors.New("file server closed")
+	}
+}
+
+// Close 实现net.Listener
+func (ds *dirServer) Close() error {
+	ds.once.Do(func() { close(ds.done) })
+	return nil
+}
+
+// Addr 实现net.Listener
+func (ds *dirServer) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// noListingFS 目录没有index.html时返回不存在，禁止列出目录内容
+type noListingFS struct {
+	fs http.FileSystem
+}
+
+func (n noListingFS) Open(name string) (http.File, error) {
+	f, err := n.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		index, err := n.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// basicAuth 校验Basic认证
+func basicAuth(h http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pmap"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ForwardsMax /forwards单独列出的连接数量，其余按速率从高到低截断后合计
+const ForwardsMax = 100
+
+// Forward 已对接的转发连接
+type Forward struct {
+	In    int64    // 外网访问者发来的字节数
+	Out   int64    // 发回外网访问者的字节数
+	Key   string   // 客户端密钥
+	Port  uint16   // 外网端口
+	Outer net.Conn // 外网连接
+	Data  net.Conn // 客户端数据连接
+	Start time.Time
+
+	// 最近一个采样周期的速率(字节/秒)
+	lastIn, lastOut int64
+	rateIn, rateOut float64
+}
+
+// ForwardTable 已对接的转发连接，控制连接断开后仍保留直到转发结束
+type ForwardTable struct {
+	mu       sync.Mutex
+	forwards map[*Forward]struct{}
+}
+
+// NewForwardTable 创建连接表，interval大于0时按该间隔采样各连接的速率
+func NewForwardTable(interval time.Duration) *ForwardTable {
+	t := &ForwardTable{forwards: make(map[*Forward]struct{})}
+	if interval > 0 {
+		go t.sample(interval)
+	}
+	return t
+}
+
+// Add 登记连接
+func (t *ForwardTable) Add(fw *Forward) {
+	t.mu.Lock()
+	t.forwards[fw] = struct{}{}
+	t.mu.Unlock()
+}
+
+// Remove 转发结束后移除
+func (t *ForwardTable) Remove(fw *Forward) {
+	t.mu.Lock()
+	delete(t.forwards, fw)
+	t.mu.Unlock()
+}
+
+// Close 关闭匹配的连接，key为空或port为0时不按该项过滤，返回关闭的数量
+func (t *ForwardTable) Close(key string, port uint16) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var n int
+	for fw := range t.forwards {
+		if (key == "" || fw.Key == key) && (port == 0 || fw.Port == port) {
+			fw.Outer.Close()
+			fw.Data.Close()
+			n++
+		}
+	}
+	return n
+}
+
+func (t *ForwardTable) sample(interval time.Duration) {
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for range tk.C {
+		t.mu.Lock()
+		for fw := range t.forwards {
+			in, out := atomic.LoadInt64(&fw.In), atomic.LoadInt64(&fw.Out)
+			fw.rateIn = float64(in-fw.lastIn) / interval.Seconds()
+			fw.rateOut = float64(out-fw.lastOut) / interval.Seconds()
+			fw.lastIn, fw.lastOut = in, out
+		}
+		t.mu.Unlock()
+	}
+}
+
+// ForwardStat 单个连接的流量
+type ForwardStat struct {
+	Port    uint16  `json:"port"`
+	Remote  string  `json:"remote"`
+	In      int64   `json:"in"`
+	Out     int64   `json:"out"`
+	RateIn  float64 `json:"rate_in"`  // 字节/秒
+	RateOut float64 `json:"rate_out"` // 字节/秒
+	Seconds float64 `json:"seconds"`
+}
+
+// ForwardOthers 超出ForwardsMax的连接合计
+type ForwardOthers struct {
+	Count   int     `json:"count"`
+	RateIn  float64 `json:"rate_in"`
+	RateOut float64 `json:"rate_out"`
+}
+
+// ServeHTTP GET /forwards[?key=&port=] 各转发连接的流量与最近采样周期的速率
+func (t *ForwardTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	pt, _ := strconv.ParseUint(r.FormValue("port"), 10, 16)
+	var stats []ForwardStat
+	t.mu.Lock()
+	for fw := range t.forwards {
+		if (key != "" && fw.Key != key) || (pt != 0 && uint64(fw.Port) != pt) {
+			continue
+		}
+		stats = append(stats, ForwardStat{
+			Port:    fw.Port,
+			Remote:  fw.Outer.RemoteAddr().String(),
+			In:      atomic.LoadInt64(&fw.In),
+			Out:     atomic.LoadInt64(&fw.Out),
+			RateIn:  fw.rateIn,
+			RateOut: fw.rateOut,
+			Seconds: time.Since(fw.Start).Seconds(),
+		})
+	}
+	t.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].RateIn+stats[i].RateOut > stats[j].RateIn+stats[j].RateOut
+	})
+	var result struct {
+		Forwards []ForwardStat `json:"forwards"`
+		Others   ForwardOthers `json:"others"`
+	}
+	if len(stats) > ForwardsMax {
+		for _, s := range stats[ForwardsMax:] {
+			result.Others.Count++
+			result.Others.RateIn += s.RateIn
+			result.Others.RateOut += s.RateOut
+		}
+		stats = stats[:ForwardsMax]
+	}
+	result.Forwards = stats
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 外网端口的代理协议，访问者在请求中指定目标地址，客户端连接该地址
+const (
+	ForwardSOCKS5 = "socks5"
+	ForwardHTTP   = "http" // HTTP CONNECT
+)
+
+// ForwardTimeOut 等待访问者发送代理请求的超时时间
+const ForwardTimeOut = 10 * time.Second
+
+// SOCKS5的固定取值
+const (
+	socksVersion     = 5
+	socksNoAuth      = 0x00
+	socksNoMethod    = 0xff
+	socksConnect     = 0x01
+	socksIPv4        = 0x01
+	socksDomain      = 0x03
+	socksIPv6        = 0x04
+	socksSucceeded   = 0x00
+	socksFailure     = 0x01
+	socksUnsupported = 0x07
+)
+
+// validForward 是否是支持的代理协议
+func validForward(mode string) bool {
+	return mode == ForwardSOCKS5 || mode == ForwardHTTP
+}
+
+// forwardConn 已读取代理请求的访问者连接，客户端对接后回复成功，未对接就关闭时回复失败
+type forwardConn struct {
+	net.Conn
+	dst   string
+	mode  string
+	once  sync.Once
+	timer *time.Timer // 超时未对接时关闭
+}
+
+func (c *forwardConn) Unwrap() net.Conn { return c.Conn }
+
+// acceptForward 读取访问者的代理请求，返回请求的目标地址(host:port)；
+// 客户端连接目标失败时不会对接，expire之后仍未对接就回复失败并关闭，访问者不必一直等待
+func acceptForward(conn net.Conn, mode string, expire time.Duration) (*forwardConn, error) {
+	conn.SetReadDeadline(time.Now().Add(ForwardTimeOut))
+	defer conn.SetReadDeadline(time.Time{})
+	var dst string
+	var err error
+	switch mode {
+	case ForwardSOCKS5:
+		dst, err = readSocksRequest(conn)
+	case ForwardHTTP:
+		dst, conn, err = readConnectRequest(conn)
+	default:
+		err = fmt.Errorf("unknown forward proxy %q", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) > 0xff {
+		// NEWSOCKET中目标地址的长度为1字节
+		return nil, fmt.Errorf("destination %.32q... is too long", dst)
+	}
+	c := &forwardConn{Conn: conn, dst: dst, mode: mode}
+	c.timer = time.AfterFunc(expire, func() { c.Close() })
+	return c, nil
+}
+
+// readSocksRequest 只支持无认证的CONNECT
+func readSocksRequest(conn net.Conn) (string, error) {
+	// VER NMETHODS METHODS
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("not a socks5 request, version %#02x", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	var noAuth bool
+	for _, m := range methods {
+		noAuth = noAuth || m == socksNoAuth
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoMethod})
+		return "", errors.New("socks5 client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		conn.Write(socksReply(socksUnsupported))
+		return "", fmt.Errorf("unsupported socks5 command %#02x", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		name, err := readAddr(conn)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		conn.Write(socksReply(socksFailure))
+		return "", fmt.Errorf("unknown socks5 address type %#02x", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// validPort 端口须为数字，不接受服务名
+func validPort(port string) bool {
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && n > 0
+}
+
+// socksReply BND.ADDR与BND.PORT对访问者没有意义，固定为0.0.0.0:0
+func socksReply(rep uint8) []byte {
+	return []byte{socksVersion, rep, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+// readConnectRequest 只支持CONNECT，返回的连接会重放请求之后已读取的数据
+func readConnectRequest(conn net.Conn) (string, net.Conn, error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", nil, err
+	}
+	if req.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n"))
+		return "", nil, fmt.Errorf("unsupported http method %v", req.Method)
+	}
+	if host, port, err := net.SplitHostPort(req.Host); err != nil || host == "" || !validPort(port) {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return "", nil, fmt.Errorf("bad CONNECT host %q", req.Host)
+	}
+	if n := br.Buffered(); n > 0 {
+		// 访问者没有等待回复就发送的数据
+		peeked, _ := br.Peek(n)
+		return req.Host, newPeekConn(conn, peeked), nil
+	}
+	return req.Host, conn, nil
+}
+
+// reply 只回复一次，已回复失败时不能再回复成功
+func (c *forwardConn) reply(ok bool) (err error) {
+	err = io.ErrClosedPipe
+	c.once.Do(func() {
+		var msg []byte
+		switch {
+		case c.mode == ForwardSOCKS5 && ok:
+			msg = socksReply(socksSucceeded)
+		case c.mode == ForwardSOCKS5:
+			msg = socksReply(socksFailure)
+		case ok:
+			msg = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+		default:
+			msg = []byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+		}
+		_, err = c.Conn.Write(msg)
+	})
+	return
+}
+
+// Established 客户端已连接目标地址，回复访问者成功，之后开始转发
+func (c *forwardConn) Established() error {
+	c.timer.Stop()
+	return c.reply(true)
+}
+
+func (c *forwardConn) Close() error {
+	c.timer.Stop()
+	c.reply(false)
+	return c.Conn.Close()
+}
@@ -1,3 +1,5 @@
 module pmap
 
 go 1.14
+
+require golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
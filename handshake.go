@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// TestTimeOut 测试连接的超时时间
+const TestTimeOut = 10 * time.Second
+
+// ProtocolVersion 握手协议版本，START之后发送；不兼容的握手变化时增加，服务端拒绝高于自己的版本
+const ProtocolVersion = 4
+
+// 各协议版本增加的内容，客户端按配置使用的功能发送所需的最低版本，不必要求服务端升级
+const (
+	versionBase      = 1 // START之后发送版本
+	versionForward   = 2 // 映射的forward_proxy，NEWSOCKET携带目标地址
+	versionBatch     = 3 // control_compress，控制命令合并压缩为BATCH
+	versionEphemeral = 4 // outer为0的映射由服务端分配端口，以ASSIGN回复
+)
+
+// startVersion 配置需要的最低协议版本
+func (c *ClientConfig) startVersion() uint8 {
+	if len(c.ephemeral) > 0 {
+		return versionEphemeral
+	}
+	if c.ControlCompress {
+		return versionBatch
+	}
+	for _, m := range c.Map {
+		if m.ForwardProxy != "" {
+			return versionForward
+		}
+	}
+	return versionBase
+}
+
+// PreviewMax 日志中无法解析的客户端配置的最大预览字节数
+const PreviewMax = 64
+
+// errNoReply 发送START后服务端没有回复就断开，不认识协议版本的旧版服务端会这样
+var errNoReply = errors.New("no reply to START")
+
+// handshakeErrors 握手失败时服务端返回的错误
+var handshakeErrors = map[uint8]string{
+	ERROR_PWD:        "Wrong password",
+	ERROR_BUSY:       "Port is occupied",
+	ERROR_LIMIT_PORT: "Does not meet the port range",
+	ERROR_TLS:        "Server rejected TLS config",
+	ERROR_QUOTA:      "Exceeded key quota",
+	ERROR_CLOCK:      "Clock skew with server is too large, check the system time",
+	ERROR_TOTP:       "Missing or wrong TOTP code",
+	ERROR_RETRY:      "Server is temporarily unavailable, retrying",
+	ERROR_KDF:        "KDF salt does not match the server",
+	ERROR_VERSION:    "Unsupported protocol version, upgrade the server",
+	ERROR_BADCONFIG:  "Server rejected config: invalid JSON",
+	ERROR_MAPPINGS:   "Too many mappings",
+	ERROR_POOL:       "No free port in the server's ephemeral pool",
+	ERROR:            "Server rejected mapping config",
+}
+
+// handshakeError 错误码对应的说明
+func handshakeError(code uint8) string {
+	if msg, ok := handshakeErrors[code]; ok {
+		return msg
+	}
+	return "Unknown error"
+}
+
+// configPreview 无法解析的客户端配置的片段，有出错位置时取其附近，否则取开头
+func configPreview(data []byte, err error) string {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	}
+	start := offset - PreviewMax/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + PreviewMax
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	preview := fmt.Sprintf("%q", data[start:end])
+	if start > 0 {
+		preview = "..." + preview
+	}
+	if end < int64(len(data)) {
+		preview += "..."
+	}
+	return preview
+}
+
+// successCode 握手成功的结果，SUCCESS_IV、SUCCESS_KDF、SUCCESS_COMPRESS与SUCCESS_SPLIT_IV同时表示服务端支持的数据连接参数
+func successCode(code uint8) bool {
+	return code == SUCCESS || code == SUCCESS_IV || code == SUCCESS_KDF || code == SUCCESS_COMPRESS || code == SUCCESS_SPLIT_IV
+}
+
+// portError 错误码之后带有出错的外网端口(2字节)
+func portError(code uint8) bool {
+	return code == ERROR_BUSY || code == ERROR_LIMIT_PORT
+}
+
+// rejectMessage 握手失败的说明，arg不为0时带上出错的端口、服务端支持的版本或允许的映射数量
+func rejectMessage(code uint8, arg uint16) string {
+	switch {
+	case arg == 0:
+		return handshakeError(code)
+	case code == ERROR_VERSION:
+		return fmt.Sprintf("Server only supports protocol version %v, upgrade the server", arg)
+	case code == ERROR_MAPPINGS:
+		return fmt.Sprintf("Too many mappings, server allows at most %v", arg)
+	}
+	return fmt.Sprintf("%v: %v", handshakeError(code), arg)
+}
+
+// transientError 服务端暂时性的错误，客户端应重试；其余错误需修改配置，重试也不会成功
+func transientError(code uint8) bool {
+	return code == ERROR_RETRY
+}
+
+// rejectError 握手被拒绝后客户端的处理：返回nil时稍后重连，否则以返回的错误退出；
+// refreshing为主动刷新后的重连，服务端可能尚未释放端口
+func rejectError(code uint8, arg uint16, refreshing bool) error {
+	switch {
+	case transientError(code):
+		return nil
+	case code == ERROR_BUSY && refreshing:
+		return nil
+	case code == ERROR_BADCONFIG:
+		// 配置在本地已校验，多为两边版本不兼容
+		return fmt.Errorf("%v, the client and server versions may be incompatible", rejectMessage(code, arg))
+	}
+	return errors.New(rejectMessage(code, arg))
+}
+
+// clientHandshake 发送START并读取服务端的结果，成功时同时返回服务端公告；
+// 服务端支持随机iv、KDF、压缩或分方向iv时成功的结果为SUCCESS_IV、SUCCESS_KDF、SUCCESS_COMPRESS或SUCCESS_SPLIT_IV；
+// ERROR_BUSY与ERROR_LIMIT_PORT时arg为出错的外网端口，旧版服务端不发送时为0，ERROR_VERSION时为服务端支持的最高版本，ERROR_MAPPINGS时为允许的映射数量；
+// version为0时按旧格式不发送版本；dryRun为true时服务端只校验，不打开端口；nonce为会话的认证挑战，建立备用连接时使用
+func clientHandshake(conn net.Conn, config *ClientConfig, dryRun bool, version uint8) (code uint8, banner string, arg uint16, nonce []byte, err error) {
+	hello := *config
+	hello.Time = time.Now().Unix()
+	hello.Banner = true
+	hello.DryRun = dryRun
+	hello.RandomIV = true
+	hello.Compress = true
+	hello.SplitIV = true
+	hello.Heartbeat = int(pingInterval(config.PingInterval) / time.Second)
+	// 先取得认证挑战，START中只发送应答，不发送key
+	// AUTH -> nonce
+	if _, err = conn.Write([]byte{AUTH}); err != nil {
+		return 0, "", 0, nil, err
+	}
+	nonce = make([]byte, AuthNonceSize)
+	if _, err = io.ReadFull(conn, nonce); err != nil {
+		return 0, "", 0, nil, fmt.Errorf("no auth challenge from server, the server may need an upgrade: %v", err)
+	}
+	hello.Key = ""
+	hello.Proof = authProof(config.Key, nonce)
+	hello.TOTPSecret = ""
+	hello.AllowInner = nil
+	hello.Discover = nil
+	if config.TOTPSecret != "" {
+		if hello.TOTP, err = TOTPCode(config.TOTPSecret, time.Now()); err != nil {
+			return 0, "", 0, nil, err
+		}
+	}
+	// 本地目录配置(含认证密码)与允许列表只在客户端使用，不发给服务端
+	hello.Map = append([]ClientMapConfig(nil), config.Map...)
+	for i := range hello.Map {
+		hello.Map[i].Dir = nil
+		hello.Map[i].AllowInner = nil
+		hello.Map[i].When = nil
+	}
+	clinfo, _ := json.Marshal(&hello)
+	// 添加字节缓冲
+	var buffer bytes.Buffer
+	// 发送客户端信息
+	// START [version] info_len info
+	buffer.Write([]byte{START})
+	if version != 0 {
+		buffer.Write([]byte{version})
+	}
+	binary.Write(&buffer, binary.BigEndian, uint64(len(clinfo)))
+	buffer.Write(clinfo)
+	if _, err = conn.Write(buffer.Bytes()); err != nil {
+		return 0, "", 0, nil, err
+	}
+	// 读取返回信息
+	// SUCCESS banner_len banner / ERROR / BUSY port / LIMIT_PORT port / ERROR_VERSION version / ERROR_MAPPINGS max
+	var recvcmd = make([]byte, 1)
+	if _, err = io.ReadAtLeast(conn, recvcmd, 1); err != nil {
+		// 不认识版本的旧版服务端会断开连接
+		return 0, "", 0, nil, fmt.Errorf("%w, the server may need an upgrade: %v", errNoReply, err)
+	}
+	if !successCode(recvcmd[0]) {
+		switch {
+		case portError(recvcmd[0]):
+			// 旧版服务端只发送错误码后关闭连接，读不到端口
+			p := make([]byte, 2)
+			if _, err := io.ReadFull(conn, p); err == nil {
+				arg = binary.BigEndian.Uint16(p)
+			}
+		case recvcmd[0] == ERROR_MAPPINGS:
+			p := make([]byte, 2)
+			if _, err := io.ReadFull(conn, p); err == nil {
+				arg = binary.BigEndian.Uint16(p)
+			}
+		case recvcmd[0] == ERROR_VERSION:
+			v := make([]byte, 1)
+			if _, err := io.ReadFull(conn, v); err == nil {
+				arg = uint16(v[0])
+			}
+		}
+		return recvcmd[0], "", arg, nil, nil
+	}
+	// 服务端公告
+	blen := make([]byte, 2)
+	if _, err = io.ReadAtLeast(conn, blen, 2); err != nil {
+		return 0, "", 0, nil, err
+	}
+	if n := int(blen[0])<<8 | int(blen[1]); n > 0 {
+		b := make([]byte, n)
+		if _, err = io.ReadAtLeast(conn, b, n); err != nil {
+			return 0, "", 0, nil, err
+		}
+		banner = string(b)
+	}
+	return recvcmd[0], banner, 0, nonce, nil
+}
+
+// clientTLSConfig 连接服务端使用的TLS配置，未开启tls时返回nil
+func clientTLSConfig(config *ClientConfig) (*tls.Config, error) {
+	if !config.TLS {
+		return nil, nil
+	}
+	cfg := newTLSConfig()
+	cfg.ServerName = config.TLSName
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(config.Server)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+	cfg.InsecureSkipVerify = config.TLSInsecure
+	// 服务端按ALPN区分pmap连接与共用端口的其他TLS服务
+	cfg.NextProtos = []string{ALPNControl}
+	if config.TLSCA != "" {
+		pem, err := ioutil.ReadFile(config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", config.TLSCA)
+		}
+	}
+	// 每个数据连接都要握手，复用会话减少开销
+	cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	return cfg, nil
+}
+
+// dialServer 连接服务端，cfg不为nil时完成TLS握手后返回，之后的命令格式不变
+func dialServer(d *net.Dialer, addr string, cfg *tls.Config) (net.Conn, error) {
+	if cfg == nil {
+		return d.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(d, "tcp", addr, cfg)
+}
+
+// TestConnect 对服务端做一次完整握手，校验密钥、端口范围等配置后断开，不运行隧道，返回进程退出码
+func TestConnect(config *ClientConfig) int {
+	tlsConfig, err := clientTLSConfig(config)
+	if err != nil {
+		logger.Error("Bad tls config:", err)
+		return ExitConfig
+	}
+	d := dialer(config.FastOpen)
+	d.Timeout = TestTimeOut
+	conn, err := dialServer(d, config.Server, tlsConfig)
+	if err != nil {
+		logger.Error("Can't connect to server:", err)
+		return ExitNetwork
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(TestTimeOut))
+	code, banner, arg, _, err := clientHandshake(conn, config, true, config.startVersion())
+	if err != nil {
+		logger.Error("Handshake failed:", err)
+		return ExitNetwork
+	}
+	if transientError(code) {
+		logger.Error("Server error:", handshakeError(code))
+		return ExitNetwork
+	}
+	if !successCode(code) {
+		if portError(code) && arg != 0 {
+			logMapStatus(config, code, arg)
+		}
+		logger.Error("Server rejected:", rejectMessage(code, arg))
+		return ExitRejected
+	}
+	if config.KDFSalt != "" && code != SUCCESS_KDF && code != SUCCESS_COMPRESS && code != SUCCESS_SPLIT_IV {
+		logger.Error("Server does not support kdf, upgrade the server")
+		return ExitRejected
+	}
+	if banner != "" {
+		logger.Infof("Server notice: %s", banner)
+	}
+	for _, m := range config.Map {
+		logger.Infof("%v->:%v ok", m.Label(), m.Outer)
+	}
+	logger.Infof("Handshake succeeded, %v mappings accepted", len(config.Map))
+	return ExitOK
+}
+
+// logMapStatus 服务端按顺序校验映射，在出错的端口停止；之前的映射已通过，之后的没有校验
+func logMapStatus(config *ClientConfig, code uint8, port uint16) {
+	var failed bool
+	for _, m := range config.Map {
+		switch {
+		case failed:
+			logger.Infof("%v->:%v not checked", m.Label(), m.Outer)
+		case m.Outer == port:
+			failed = true
+			logger.Errorf("%v->:%v %v", m.Label(), m.Outer, handshakeError(code))
+		default:
+			logger.Infof("%v->:%v ok", m.Label(), m.Outer)
+		}
+	}
+}
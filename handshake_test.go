@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRejectError(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       uint8
+		arg        uint16
+		refreshing bool
+		retry      bool
+		msg        string // 退出时错误信息包含的内容
+	}{
+		{"transient", ERROR_RETRY, 0, false, true, ""},
+		{"transient after refresh", ERROR_RETRY, 0, true, true, ""},
+		{"busy after refresh", ERROR_BUSY, 0, true, true, ""},
+		{"busy", ERROR_BUSY, 8080, false, false, "8080"},
+		{"password", ERROR_PWD, 0, false, false, handshakeError(ERROR_PWD)},
+		{"port range", ERROR_LIMIT_PORT, 22, true, false, "22"},
+		{"tls", ERROR_TLS, 443, false, false, handshakeError(ERROR_TLS)},
+		{"quota", ERROR_QUOTA, 0, false, false, handshakeError(ERROR_QUOTA)},
+		{"clock", ERROR_CLOCK, 0, false, false, handshakeError(ERROR_CLOCK)},
+		{"totp", ERROR_TOTP, 0, false, false, handshakeError(ERROR_TOTP)},
+		{"kdf", ERROR_KDF, 0, false, false, handshakeError(ERROR_KDF)},
+		{"version", ERROR_VERSION, 1, false, false, "version 1"},
+		{"bad config", ERROR_BADCONFIG, 0, false, false, "versions may be incompatible"},
+		{"mappings", ERROR_MAPPINGS, 4, false, false, "at most 4"},
+		{"generic", ERROR, 0, true, false, handshakeError(ERROR)},
+		{"unknown", 0xff, 0, false, false, "Unknown error"},
+	}
+	for _, tt := range tests {
+		err := rejectError(tt.code, tt.arg, tt.refreshing)
+		if (err == nil) != tt.retry {
+			t.Errorf("%v: rejectError = %v, want retry %v", tt.name, err, tt.retry)
+			continue
+		}
+		if err != nil && !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%v: error %q does not mention %q", tt.name, err, tt.msg)
+		}
+	}
+}
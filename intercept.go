@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// InterceptInfo 拦截器创建时可用的映射信息
+type InterceptInfo struct {
+	Port uint16 // 外网端口
+	Key  string // 客户端密钥
+}
+
+// Interceptor 转发路径上的拦截器，每个连接调用一次Wrap；
+// 返回的连接Read得到访问者发来的数据，Write写出发回访问者的数据，可在其中观察或修改字节流。
+// 数据是连续的字节流，一次Read/Write不对应任何消息边界，需要自行缓冲
+type Interceptor interface {
+	Wrap(conn net.Conn, info InterceptInfo) net.Conn
+}
+
+// InterceptorFunc 函数形式的拦截器
+type InterceptorFunc func(conn net.Conn, info InterceptInfo) net.Conn
+
+// Wrap 实现Interceptor
+func (f InterceptorFunc) Wrap(conn net.Conn, info InterceptInfo) net.Conn {
+	return f(conn, info)
+}
+
+var (
+	interceptorMu sync.RWMutex
+	interceptors  = map[string]Interceptor{
+		// pass 不做任何处理，用于验证配置
+		"pass": InterceptorFunc(func(conn net.Conn, info InterceptInfo) net.Conn { return conn }),
+	}
+)
+
+// RegisterInterceptor 注册拦截器，映射通过intercept按名称引用
+func RegisterInterceptor(name string, i Interceptor) {
+	interceptorMu.Lock()
+	defer interceptorMu.Unlock()
+	interceptors[name] = i
+}
+
+// lookupInterceptors 按名称查找拦截器
+func lookupInterceptors(names []string) ([]Interceptor, error) {
+	interceptorMu.RLock()
+	defer interceptorMu.RUnlock()
+	list := make([]Interceptor, 0, len(names))
+	for _, name := range names {
+		i, ok := interceptors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown interceptor %q", name)
+		}
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// intercept 按顺序包装外网连接，列表中的第一个最靠近访问者
+func intercept(conn net.Conn, list []Interceptor, info InterceptInfo) net.Conn {
+	for _, i := range list {
+		conn = i.Wrap(conn, info)
+	}
+	return conn
+}
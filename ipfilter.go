@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// BanTime 默认的认证失败计数与封禁时间
+const BanTime = 10 * time.Minute
+
+// ipFilter 控制端口的地址允许与拒绝列表
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// normalizeIP IPv4映射的IPv6地址(::ffff:a.b.c.d)转为IPv4形式，双栈监听收到的IPv4访问者是这种地址
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// parseNet 解析IP或网段，单个IP为只含该地址的网段；IPv4映射的网段(如::ffff:10.0.0.0/104)统一转为IPv4网段，
+// 与写成10.0.0.0/8的规则相同，匹配时不依赖两种形式的转换
+func parseNet(s string) (*net.IPNet, bool) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		ones, bits := ipnet.Mask.Size()
+		if v4 := ipnet.IP.To4(); v4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+			ipnet = &net.IPNet{IP: v4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+		}
+		return ipnet, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+	ip = normalizeIP(ip)
+	bits := 8 * len(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+}
+
+// parseNets 解析IP或网段列表
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		ipnet, ok := parseNet(e)
+		if !ok {
+			return nil, fmt.Errorf("bad IP or CIDR %q", e)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// newIPFilter 两个列表都为空时返回nil，不限制
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	var f ipFilter
+	var err error
+	if f.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	ip = normalizeIP(ip)
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed 拒绝列表优先，允许列表为空时不在拒绝列表中的地址都允许
+func (f *ipFilter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil || containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// remoteIP 连接的对端IP，IPv4映射的地址转为IPv4形式，无法解析时返回nil
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return normalizeIP(ip)
+	}
+	return nil
+}
+
+// banEntry 单个IP的认证失败记录
+type banEntry struct {
+	fails int
+	first time.Time // 本轮计数的第一次失败
+	until time.Time // 封禁结束时间
+}
+
+// authBans 按IP统计认证失败，period内失败limit次后封禁period
+type authBans struct {
+	limit  int
+	period time.Duration
+	mu     sync.Mutex
+	ips    map[string]*banEntry
+}
+
+// newAuthBans limit<=0时返回nil，不封禁
+func newAuthBans(limit int, period time.Duration) *authBans {
+	if limit <= 0 {
+		return nil
+	}
+	return &authBans{limit: limit, period: period, ips: make(map[string]*banEntry)}
+}
+
+// Banned 该IP是否在封禁中
+func (b *authBans) Banned(ip net.IP) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.ips[ip.String()]
+	return e != nil && time.Now().Before(e.until)
+}
+
+// Fail 记录一次认证失败，达到次数开始封禁时返回true
+func (b *authBans) Fail(ip net.IP) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	e := b.ips[ip.String()]
+	if e == nil || now.Sub(e.first) > b.period {
+		e = &banEntry{first: now}
+		b.ips[ip.String()] = e
+	}
+	e.fails++
+	if e.fails < b.limit {
+		return false
+	}
+	e.until = now.Add(b.period)
+	e.fails, e.first = 0, e.until
+	return true
+}
+
+// Success 认证成功后清除该IP的失败计数
+func (b *authBans) Success(ip net.IP) {
+	if b == nil || ip == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.ips, ip.String())
+}
+
+// Prune 清除过期的记录
+func (b *authBans) Prune() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for ip, e := range b.ips {
+		if now.After(e.until) && now.Sub(e.first) > b.period {
+			delete(b.ips, ip)
+		}
+	}
+}
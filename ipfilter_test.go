@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		ip          string
+		want        bool
+	}{
+		{"ipv4 in allow", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"ipv4 outside allow", []string{"10.0.0.0/8"}, nil, "192.168.1.1", false},
+		{"ipv6 in allow", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"ipv6 outside allow", []string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+		{"ipv6 against ipv4 rule", []string{"10.0.0.0/8"}, nil, "::a01:203", false},
+		{"mapped against ipv4 rule", []string{"10.0.0.0/8"}, nil, "::ffff:10.1.2.3", true},
+		{"mapped outside ipv4 rule", []string{"10.0.0.0/8"}, nil, "::ffff:192.168.1.1", false},
+		{"ipv4 against mapped rule", []string{"::ffff:10.0.0.0/104"}, nil, "10.1.2.3", true},
+		{"ipv4 outside mapped rule", []string{"::ffff:10.0.0.0/104"}, nil, "11.1.2.3", false},
+		{"ipv4 against mapped single ip", []string{"::ffff:10.1.2.3"}, nil, "10.1.2.3", true},
+		{"all mapped addresses", []string{"::ffff:0:0/96"}, nil, "172.16.0.1", true},
+		{"mapped in deny", nil, []string{"10.0.0.0/8"}, "::ffff:10.1.2.3", false},
+		{"ipv4 in mapped deny", []string{"0.0.0.0/0"}, []string{"::ffff:10.1.2.3"}, "10.1.2.3", false},
+		{"ipv6 not in ipv4 deny", nil, []string{"10.0.0.0/8"}, "2001:db8::1", true},
+	}
+	for _, tt := range tests {
+		f, err := newIPFilter(tt.allow, tt.deny)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if got := f.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%v: Allowed(%v) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteIPMapped(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skip("no dual-stack listener:", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", portOf(l.Addr())))
+		if err == nil {
+			defer c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ip := remoteIP(c)
+	if len(ip) != net.IPv4len || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("remoteIP = %v (%v bytes), want 127.0.0.1 in IPv4 form", ip, len(ip))
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
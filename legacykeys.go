@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// legacyKey 对象中一个旧写法的字段名，start为其引号在输入中的位置
+type legacyKey struct {
+	name  string
+	start int64
+}
+
+// jsonFrame 正在读取的对象或数组
+type jsonFrame struct {
+	object  bool
+	wantKey bool            // 对象中下一个字符串是字段名
+	keys    map[string]bool // 对象中出现的字段名
+	legacy  []legacyKey
+}
+
+// legacyKeys 旧版本配置中非必配字段以"-"开头、以"-"分隔单词，如"-kill-ack"，现在写作"kill_ack"；
+// 在解析配置之前一次改写全部层级对象中的旧写法，两种写法同时出现在一个对象中时以新写法为准，旧写法原样保留并被忽略；
+// 改写为等长的` "kill_ack"`，解析错误的位置仍对应原始输入；不是合法的JSON时原样返回，由调用者报告错误
+func legacyKeys(data []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var stack []*jsonFrame
+	out, copied := data, false
+	// value 读完一个值，外层是对象时下一个字符串是字段名
+	value := func() {
+		if n := len(stack); n > 0 && stack[n-1].object {
+			stack[n-1].wantKey = true
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if len(stack) > 0 {
+				return data
+			}
+			return out
+		}
+		top := (*jsonFrame)(nil)
+		if n := len(stack); n > 0 {
+			top = stack[n-1]
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{':
+				stack = append(stack, &jsonFrame{object: true, wantKey: true, keys: make(map[string]bool)})
+			case '[':
+				stack = append(stack, &jsonFrame{})
+			default:
+				stack = stack[:len(stack)-1]
+				if top.object {
+					for _, k := range top.legacy {
+						name := strings.Replace(k.name[1:], "-", "_", -1)
+						if top.keys[name] {
+							continue
+						}
+						if !copied {
+							out, copied = append([]byte(nil), data...), true
+						}
+						copy(out[k.start:], ` "`+name+`"`)
+					}
+				}
+				value()
+			}
+		case string:
+			if top == nil || !top.wantKey {
+				value()
+				break
+			}
+			top.wantKey = false
+			top.keys[t] = true
+			// 只改写不含转义的旧写法，转义后的字段名与原文不同
+			end := dec.InputOffset()
+			start := end - int64(len(t)) - 2
+			if strings.HasPrefix(t, "-") && start >= 0 && string(data[start:end]) == `"`+t+`"` {
+				top.legacy = append(top.legacy, legacyKey{t, start})
+			}
+		default:
+			value()
+		}
+	}
+}
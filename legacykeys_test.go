@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLegacyKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		old, snake string
+	}{
+		{"server",
+			`{"server": {"key": "k", "port": 8808, "-kill-ack": true, "-tls-cert": "c.pem", "-ban-after": 5, "-limit-port": [9000, 9100]}}`,
+			`{"server": {"key": "k", "port": 8808, "kill_ack": true, "tls_cert": "c.pem", "ban_after": 5, "limit_port": "9000-9100"}}`},
+		{"client and mappings",
+			`{"client": {"key": "k", "server": "s:1", "-kdf-salt": "x", "-allow-inner": ["10.0.0.0/8"],
+				"map": [{"inner": "a:1", "outer": 2, "-forward-proxy": "socks5", "-inner-tls-name": "n", "-bandwidth-in": 10}]}}`,
+			`{"client": {"key": "k", "server": "s:1", "kdf_salt": "x", "allow_inner": ["10.0.0.0/8"],
+				"map": [{"inner": "a:1", "outer": 2, "forward_proxy": "socks5", "inner_tls_name": "n", "bandwidth_in": 10}]}}`},
+		{"instances and top level",
+			`{"-log-level": "debug", "-tls-policy": {"min_version": "1.3"}, "-clients": [{"key": "k", "-mux": true}], "-servers": [{"key": "k", "-reuse-port": true}]}`,
+			`{"log_level": "debug", "tls_policy": {"min_version": "1.3"}, "clients": [{"key": "k", "mux": true}], "servers": [{"key": "k", "reuse_port": true}]}`},
+	}
+	for _, tt := range tests {
+		var old, snake Config
+		if err := json.Unmarshal(legacyKeys([]byte(tt.old)), &old); err != nil {
+			t.Fatalf("%v: old names: %v", tt.name, err)
+		}
+		if err := json.Unmarshal([]byte(tt.snake), &snake); err != nil {
+			t.Fatalf("%v: new names: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(old, snake) {
+			t.Errorf("%v: old names decode to %+v, new names to %+v", tt.name, old, snake)
+		}
+	}
+}
+
+// TestLegacyKeysPrecedence 新旧写法同时出现时以新写法为准
+func TestLegacyKeysPrecedence(t *testing.T) {
+	for _, data := range []string{
+		`{"-buffer-size": 1, "buffer_size": 2}`,
+		`{"buffer_size": 2, "-buffer-size": 1}`,
+	} {
+		var c ClientConfig
+		if err := json.Unmarshal(legacyKeys([]byte(data)), &c); err != nil {
+			t.Fatal(err)
+		}
+		if c.BufferSize != 2 {
+			t.Errorf("%s: buffer size %v, want 2", data, c.BufferSize)
+		}
+	}
+	var c ClientConfig
+	if err := json.Unmarshal(legacyKeys([]byte(`["not an object"]`)), &c); err == nil {
+		t.Error("decoded a non-object config")
+	}
+}
+
+// TestLegacyKeysErrorPosition 有旧写法时LoadConfig报告的错误位置仍对应原始文件
+func TestLegacyKeysErrorPosition(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"type",
+			"{\"client\": {\"key\": \"k\", \"-kdf-salt\": \"x\",\n  \"map\": [{\"-forward-proxy\": \"socks5\",\n    \"outer\": \"80\"}]}}",
+			"line 3, column 18"},
+		{"syntax",
+			"{\"server\": {\"-kill-ack\": true,\n  \"port\": 8808,,\n  \"key\": \"k\"}}",
+			"line 2, column 17"},
+		{"precedence",
+			"{\"server\": {\"-buffer-size\": 1, \"buffer_size\": 2,\n  \"port\": -1}}",
+			"line 2, column 13"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want position %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestMarshalSnakeCase 输出的配置(如START中发送的客户端配置)只使用新写法
+func TestMarshalSnakeCase(t *testing.T) {
+	b, err := json.Marshal(&ClientConfig{Key: "k", KDFSalt: "x", Map: []ClientMapConfig{{Outer: 1, ForwardProxy: "socks5"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(b, &fields)
+	if _, ok := fields["kdf_salt"]; !ok {
+		t.Errorf("kdf_salt missing in %s", b)
+	}
+	for k := range fields {
+		if k[0] == '-' {
+			t.Errorf("legacy key %q in %s", k, b)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// activityConn 记录最近一次读写的时间
+type activityConn struct {
+	net.Conn
+	last *int64
+}
+
+func (c *activityConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// limitForward 转发连接空闲超过idle或存活超过lifetime后关闭两端，为0不限制；
+// 返回记录读写时间的外网连接与转发结束时停止计时的函数
+func limitForward(fw *Forward, idle, lifetime time.Duration, onClose func(reason string)) (net.Conn, func()) {
+	var timers []*time.Timer
+	var closed int32
+	var closeBoth = func(reason string) {
+		if atomic.CompareAndSwapInt32(&closed, 0, 1) {
+			fw.Outer.Close()
+			fw.Data.Close()
+			onClose(reason)
+		}
+	}
+	var outer = fw.Outer
+	if idle > 0 {
+		var t *time.Timer
+		outer, t = idleTimer(fw.Outer, idle, func() {
+			closeBoth("idle")
+		})
+		timers = append(timers, t)
+	}
+	if lifetime > 0 {
+		timers = append(timers, time.AfterFunc(lifetime, func() {
+			closeBoth("max lifetime")
+		}))
+	}
+	return outer, func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}
+}
+
+// idleTimer conn没有读写超过idle后调用fire，返回记录读写时间的连接与计时器
+func idleTimer(conn net.Conn, idle time.Duration, fire func()) (net.Conn, *time.Timer) {
+	var last = time.Now().UnixNano()
+	var t *time.Timer
+	t = time.AfterFunc(idle, func() {
+		// 期间有读写时顺延到最近一次读写后的idle
+		remain := time.Duration(atomic.LoadInt64(&last)+int64(idle)) - time.Duration(time.Now().UnixNano())
+		if remain > 0 {
+			t.Reset(remain)
+			return
+		}
+		fire()
+	})
+	return &activityConn{Conn: conn, last: &last}, t
+}
+
+// mappingTimeout 映射的设置(秒)优先于全局设置，映射为0时使用全局设置，为-1时不限制
+func mappingTimeout(mapping, global int) (time.Duration, error) {
+	switch {
+	case mapping < -1:
+		return 0, fmt.Errorf("bad timeout %v, must be -1, 0 or positive", mapping)
+	case mapping == -1:
+		return 0, nil
+	case mapping > 0:
+		return time.Duration(mapping) * time.Second, nil
+	}
+	return time.Duration(global) * time.Second, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level 日志级别
+type Level int32
+
+const (
+	LevelDebug Level = iota // 逐个连接的细节，排查问题时开启
+	LevelInfo               // 端口打开关闭、认证成功等正常事件
+	LevelWarn               // 连接被拒绝、内网服务不可达等可恢复的异常
+	LevelError              // 配置错误、监听失败等需要处理的错误
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel 解析debug、info、warn或error，为空时为info
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be debug, info, warn or error", s)
+}
+
+// 日志格式
+const (
+	LogText = "text" // 标准库log的格式，前面加上级别
+	LogJSON = "json" // 每行一个JSON对象，便于日志系统解析
+)
+
+// Logger 分级日志，低于设置级别的日志不输出；仍写到标准库log的输出
+type Logger struct {
+	level int32
+	json  int32
+	mu    sync.Mutex
+}
+
+// logger 进程内共用的日志
+var logger = &Logger{level: int32(LevelInfo)}
+
+// SetLevel 设置输出的最低级别
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// SetFormat 设置text或json格式，为空时为text
+func (l *Logger) SetFormat(format string) error {
+	switch format {
+	case "", LogText:
+		atomic.StoreInt32(&l.json, 0)
+	case LogJSON:
+		atomic.StoreInt32(&l.json, 1)
+	default:
+		return fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+	return nil
+}
+
+// Enabled 该级别的日志是否输出
+func (l *Logger) Enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(&l.level)
+}
+
+func (l *Logger) output(level Level, msg string) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+	if atomic.LoadInt32(&l.json) == 0 {
+		log.Output(3, strings.ToUpper(level.String())+" "+msg)
+		return
+	}
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	enc.Encode(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), level.String(), msg})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	log.Writer().Write(line.Bytes())
+}
+
+// Debugf 按格式输出debug级别的日志，Info、Warn、Error同理
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, v...))
+}
+
+// Debug 以log.Println的方式输出debug级别的日志，Info、Warn、Error同理
+func (l *Logger) Debug(v ...interface{}) {
+	l.output(LevelDebug, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Info(v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Warn(v ...interface{}) {
+	l.output(LevelWarn, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.output(LevelError, fmt.Sprintln(v...))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// PortStats 单个外网端口的累计统计，端口关闭后保留，重新打开时继续累计
+type PortStats struct {
+	In             int64 // 外网访问者发来的字节数
+	Out            int64 // 发回外网访问者的字节数
+	Active         int64 // 正在转发的连接数
+	Total          int64 // 已对接的连接总数
+	RejectedWait   int64 // 等待对接的连接已满(wait_max)被拒绝的连接数
+	RejectedLimit  int64 // 超出max_conns或accept_rate被拒绝的连接数
+	RejectedMemory int64 // 超出客户端内存预算被拒绝的连接数
+
+	client string // 最近打开该端口的客户端名称
+}
+
+// PortStatsMap 各端口的统计，键为外网端口
+type PortStatsMap struct {
+	mu    sync.Mutex
+	stats map[uint16]*PortStats
+}
+
+// Open 端口打开时取得统计并记录客户端名称
+func (m *PortStatsMap) Open(port uint16, client string) *PortStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stats == nil {
+		m.stats = make(map[uint16]*PortStats)
+	}
+	s := m.stats[port]
+	if s == nil {
+		s = &PortStats{}
+		m.stats[port] = s
+	}
+	s.client = client
+	return s
+}
+
+// PortStat /ports输出的单个端口统计
+type PortStat struct {
+	Port           uint16 `json:"port"`
+	Client         string `json:"client,omitempty"`
+	Open           bool   `json:"open"`
+	Waiting        int    `json:"waiting"`  // 当前等待对接的连接数
+	WaitMax        int    `json:"wait_max"` // 等待对接的连接数上限
+	In             int64  `json:"in"`
+	Out            int64  `json:"out"`
+	Active         int64  `json:"active"`
+	Total          int64  `json:"total"`
+	RejectedWait   int64  `json:"rejected_wait"`
+	RejectedLimit  int64  `json:"rejected_limit"`
+	RejectedMemory int64  `json:"rejected_memory"`
+}
+
+// ClientStat /ports输出的按客户端合计
+type ClientStat struct {
+	Client string `json:"client"`
+	Ports  int    `json:"ports"`
+	In     int64  `json:"in"`
+	Out    int64  `json:"out"`
+	Active int64  `json:"active"`
+	Total  int64  `json:"total"`
+}
+
+// Snapshot 按端口排序的统计，waiting查询端口当前等待对接的连接数与上限，端口未打开时返回false
+func (m *PortStatsMap) Snapshot(waiting func(port uint16) (int, int, bool)) []PortStat {
+	m.mu.Lock()
+	var stats = make([]PortStat, 0, len(m.stats))
+	for port, s := range m.stats {
+		stats = append(stats, PortStat{
+			Port:           port,
+			Client:         s.client,
+			In:             atomic.LoadInt64(&s.In),
+			Out:            atomic.LoadInt64(&s.Out),
+			Active:         atomic.LoadInt64(&s.Active),
+			Total:          atomic.LoadInt64(&s.Total),
+			RejectedWait:   atomic.LoadInt64(&s.RejectedWait),
+			RejectedLimit:  atomic.LoadInt64(&s.RejectedLimit),
+			RejectedMemory: atomic.LoadInt64(&s.RejectedMemory),
+		})
+	}
+	m.mu.Unlock()
+	for i := range stats {
+		stats[i].Waiting, stats[i].WaitMax, stats[i].Open = waiting(stats[i].Port)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Port < stats[j].Port })
+	return stats
+}
+
+// clientStats 按客户端合计端口统计
+func clientStats(ports []PortStat) []ClientStat {
+	var index = make(map[string]int)
+	var clients []ClientStat
+	for _, p := range ports {
+		i, ok := index[p.Client]
+		if !ok {
+			i = len(clients)
+			index[p.Client] = i
+			clients = append(clients, ClientStat{Client: p.Client})
+		}
+		c := &clients[i]
+		c.Ports++
+		c.In += p.In
+		c.Out += p.Out
+		c.Active += p.Active
+		c.Total += p.Total
+	}
+	return clients
+}
+
+// portsHandler GET /ports 各端口与各客户端的流量与连接统计，以及临时端口的分配记录(JSON)
+func portsHandler(m *PortStatsMap, waiting func(port uint16) (int, int, bool), pool *portPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var result struct {
+			Ports    []PortStat   `json:"ports"`
+			Clients  []ClientStat `json:"clients"`
+			Assigned []Assignment `json:"assigned"` // 临时端口的分配记录
+		}
+		result.Ports = m.Snapshot(waiting)
+		result.Clients = clientStats(result.Ports)
+		result.Assigned = pool.Snapshot()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// metricsHandler GET /metrics 以Prometheus文本格式输出端口统计
+func metricsHandler(m *PortStatsMap, waiting func(port uint16) (int, int, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ports := m.Snapshot(waiting)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		var metric = func(name, kind, help string, value func(p *PortStat) int64) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+			for i := range ports {
+				fmt.Fprintf(w, "%s{port=\"%d\",client=%q} %d\n", name, ports[i].Port, ports[i].Client, value(&ports[i]))
+			}
+		}
+		metric("pmap_port_open", "gauge", "Whether the port is currently open.", func(p *PortStat) int64 {
+			if p.Open {
+				return 1
+			}
+			return 0
+		})
+		metric("pmap_port_waiting", "gauge", "Connections waiting for the client to pick them up.", func(p *PortStat) int64 {
+			return int64(p.Waiting)
+		})
+		metric("pmap_port_wait_max", "gauge", "Maximum number of waiting connections.", func(p *PortStat) int64 {
+			return int64(p.WaitMax)
+		})
+		metric("pmap_port_connections_active", "gauge", "Connections being forwarded.", func(p *PortStat) int64 {
+			return p.Active
+		})
+		metric("pmap_port_connections_total", "counter", "Connections forwarded.", func(p *PortStat) int64 {
+			return p.Total
+		})
+		fmt.Fprintf(w, "# HELP pmap_port_bytes_total Bytes forwarded, in is from the visitor.\n# TYPE pmap_port_bytes_total counter\n")
+		for _, p := range ports {
+			fmt.Fprintf(w, "pmap_port_bytes_total{port=\"%d\",client=%q,direction=\"in\"} %d\n", p.Port, p.Client, p.In)
+			fmt.Fprintf(w, "pmap_port_bytes_total{port=\"%d\",client=%q,direction=\"out\"} %d\n", p.Port, p.Client, p.Out)
+		}
+		fmt.Fprintf(w, "# HELP pmap_port_rejected_total Connections rejected.\n# TYPE pmap_port_rejected_total counter\n")
+		for _, p := range ports {
+			fmt.Fprintf(w, "pmap_port_rejected_total{port=\"%d\",client=%q,reason=\"wait\"} %d\n", p.Port, p.Client, p.RejectedWait)
+			fmt.Fprintf(w, "pmap_port_rejected_total{port=\"%d\",client=%q,reason=\"limit\"} %d\n", p.Port, p.Client, p.RejectedLimit)
+			fmt.Fprintf(w, "pmap_port_rejected_total{port=\"%d\",client=%q,reason=\"memory\"} %d\n", p.Port, p.Client, p.RejectedMemory)
+		}
+	}
+}
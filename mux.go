@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 多路复用连接上的帧：cmd(1) stream(4) n(4) [data]
+const (
+	_ uint8 = iota
+	// MUX_SYN 客户端打开新的流
+	MUX_SYN
+	// MUX_DATA 流的数据，n为数据长度
+	MUX_DATA
+	// MUX_WINDOW 接收方已读取n字节，发送方可以继续发送
+	MUX_WINDOW
+	// MUX_FIN 发送方关闭了流，n为muxFinClose或muxFinWrite
+	MUX_FIN
+)
+
+// MUX_FIN的n：完全关闭时对端的写入失败；只关闭写的一端时对端读到EOF，仍可发送数据
+const (
+	muxFinClose = 0
+	muxFinWrite = 1
+)
+
+const (
+	MuxHeaderSize = 9
+	MuxFrameMax   = 16 * 1024  // 单帧最大数据长度
+	MuxWindow     = 256 * 1024 // 每个流默认的接收窗口，接收方最多缓冲该数量的未读数据
+	MuxWindowMax  = 16 << 20   // 接收窗口的上限
+	MuxBacklog    = 64         // 服务端等待处理的新流数量
+)
+
+// muxWindow 配置的接收窗口，0为默认值，须在MuxFrameMax与MuxWindowMax之间
+func muxWindow(n int) (int, error) {
+	if n == 0 {
+		return MuxWindow, nil
+	}
+	if n < MuxFrameMax || n > MuxWindowMax {
+		return 0, fmt.Errorf("mux window %v out of range [%v, %v]", n, MuxFrameMax, MuxWindowMax)
+	}
+	return n, nil
+}
+
+// errMuxUnsupported 服务端不回复MUX就关闭连接，旧版服务端不认识该命令时会这样
+var errMuxUnsupported = errors.New("server does not support mux")
+
+// muxHandshake 客户端在新的数据连接上请求多路复用：MUX window(4) -> SUCCESS window(4)，返回服务端的接收窗口；
+// 只有服务端未回复就关闭时返回errMuxUnsupported，服务端拒绝或回复不完整时返回其他错误
+func muxHandshake(conn net.Conn, window int) (int, error) {
+	req := []byte{MUX, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(req[1:], uint32(window))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	res := make([]byte, 5)
+	if _, err := io.ReadFull(conn, res[:1]); err != nil {
+		if err == io.EOF {
+			return 0, errMuxUnsupported
+		}
+		return 0, err
+	}
+	if res[0] != SUCCESS {
+		// 支持MUX的服务端拒绝了请求，如不接受该接收窗口
+		return 0, fmt.Errorf("server rejected mux (code %#02x), check mux_window", res[0])
+	}
+	if _, err := io.ReadFull(conn, res[1:]); err != nil {
+		return 0, fmt.Errorf("short mux reply: %v", err)
+	}
+	return muxWindow(int(binary.BigEndian.Uint32(res[1:])))
+}
+
+// ErrMuxClosed 多路复用连接已断开
+var ErrMuxClosed = errors.New("mux session closed")
+
+// muxTimeout 流的读写超时，与net.Conn的超时错误一致
+type muxTimeout struct{}
+
+func (muxTimeout) Error() string   { return "i/o timeout" }
+func (muxTimeout) Timeout() bool   { return true }
+func (muxTimeout) Temporary() bool { return true }
+
+// muxSession 在一个连接上承载多个数据连接，每个流对应一个外网连接；
+// 流只由客户端打开，每个流按接收窗口做流量控制，慢速的流不会阻塞其他流；
+// 双方在建立连接时交换各自的接收窗口，window限制本端缓冲，peerWindow是每个流初始可发送的字节数
+type muxSession struct {
+	conn       net.Conn
+	window     int
+	peerWindow int
+	wmu        sync.Mutex // 帧写出锁
+	mu         sync.Mutex
+	streams    map[uint32]*muxStream
+	nextID     uint32
+	idle       bool // 没有流时关闭
+	accept     chan *muxStream
+	die        chan struct{}
+	once       sync.Once
+}
+
+func newMuxSession(conn net.Conn, window, peerWindow int) *muxSession {
+	s := &muxSession{
+		conn:       conn,
+		window:     window,
+		peerWindow: peerWindow,
+		streams:    make(map[uint32]*muxStream),
+		accept:     make(chan *muxStream, MuxBacklog),
+		die:        make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Close 断开连接，所有流的读写返回错误
+func (s *muxSession) Close() error {
+	s.once.Do(func() {
+		close(s.die)
+		s.conn.Close()
+	})
+	return nil
+}
+
+// IsClosed 连接是否已断开
+func (s *muxSession) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseWhenIdle 不再打开新的流，已有的流全部关闭后断开连接
+func (s *muxSession) CloseWhenIdle() {
+	s.mu.Lock()
+	s.idle = true
+	empty := len(s.streams) == 0
+	s.mu.Unlock()
+	if empty {
+		s.Close()
+	}
+}
+
+// Open 打开新的流
+func (s *muxSession) Open() (net.Conn, error) {
+	s.mu.Lock()
+	if s.idle {
+		s.mu.Unlock()
+		return nil, ErrMuxClosed
+	}
+	s.nextID++
+	st := newMuxStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.mu.Unlock()
+	if err := s.writeFrame(MUX_SYN, st.id, 0, nil); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept 等待客户端打开的流
+func (s *muxSession) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, ErrMuxClosed
+	}
+}
+
+func (s *muxSession) writeFrame(cmd uint8, id uint32, n uint32, data []byte) error {
+	var frame = make([]byte, MuxHeaderSize+len(data))
+	frame[0] = cmd
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], n)
+	copy(frame[MuxHeaderSize:], data)
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return ErrMuxClosed
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	closeIdle := s.idle && len(s.streams) == 0
+	s.mu.Unlock()
+	if closeIdle {
+		s.Close()
+	}
+}
+
+func (s *muxSession) readLoop() {
+	defer s.Close()
+	var hdr [MuxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			return
+		}
+		cmd, id, n := hdr[0], binary.BigEndian.Uint32(hdr[1:5]), binary.BigEndian.Uint32(hdr[5:9])
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		switch cmd {
+		case MUX_SYN:
+			if st != nil {
+				return
+			}
+			st = newMuxStream(s, id)
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			default:
+				s.mu.Lock()
+				delete(s.streams, id)
+				s.mu.Unlock()
+				// 等待处理的新流已满，拒绝该流，不阻塞其他流的帧；
+				// 不在读取协程中写出，避免双方都在等对端读取
+				go s.writeFrame(MUX_FIN, id, muxFinClose, nil)
+			}
+		case MUX_DATA:
+			if n > MuxFrameMax {
+				return
+			}
+			data := make([]byte, n)
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				return
+			}
+			if st != nil && !st.push(data) {
+				// 超出接收窗口，对端没有遵守流量控制
+				return
+			}
+		case MUX_WINDOW:
+			if st != nil {
+				st.grant(int(n))
+			}
+		case MUX_FIN:
+			if st != nil {
+				st.finish(n == muxFinClose)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// muxStream 多路复用连接上的一个流，实现net.Conn
+type muxStream struct {
+	sess *muxSession
+	id   uint32
+
+	mu            sync.Mutex
+	buf           []byte // 已收到未读取的数据
+	unacked       int    // 已读取未通知对端的字节数
+	credit        int    // 还能发送的字节数
+	closed        bool   // 本端已关闭
+	wclosed       bool   // 本端已关闭写的一端
+	finished      bool   // 对端已关闭写的一端，读完缓冲后返回EOF
+	reset         bool   // 对端已完全关闭，不再接收数据
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newMuxStream(sess *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		sess:     sess,
+		id:       id,
+		credit:   sess.peerWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait 等待通知、超时或连接断开
+func (st *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return muxTimeout{}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return muxTimeout{}
+	case <-st.sess.die:
+		return ErrMuxClosed
+	}
+}
+
+// push 收到数据，超出接收窗口时返回false
+func (st *muxStream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		// 本端已关闭，丢弃
+		return true
+	}
+	if len(st.buf)+len(data) > st.sess.window {
+		return false
+	}
+	st.buf = append(st.buf, data...)
+	notify(st.readable)
+	return true
+}
+
+func (st *muxStream) grant(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+// finish 对端关闭了流，all为false时只关闭了写的一端
+func (st *muxStream) finish(all bool) {
+	st.mu.Lock()
+	st.finished = true
+	st.reset = st.reset || all
+	done := st.closed
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if len(st.buf) > 0 {
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			if len(st.buf) == 0 {
+				st.buf = nil
+			}
+			st.unacked += n
+			var ack int
+			if st.unacked >= st.sess.window/2 {
+				// 攒够半个窗口再通知，减少窗口帧
+				ack, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+			if ack > 0 {
+				st.sess.writeFrame(MUX_WINDOW, st.id, uint32(ack), nil)
+			}
+			return n, nil
+		}
+		if st.finished {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		st.mu.Lock()
+		if st.closed || st.wclosed || st.reset {
+			st.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if st.credit == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err = st.wait(st.writable, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		k := len(p)
+		if k > st.credit {
+			k = st.credit
+		}
+		if k > MuxFrameMax {
+			k = MuxFrameMax
+		}
+		st.credit -= k
+		st.mu.Unlock()
+		if err = st.sess.writeFrame(MUX_DATA, st.id, uint32(k), p[:k]); err != nil {
+			return n, err
+		}
+		n += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// CloseWrite 关闭写的一端并通知对端，已写出的数据全部送达后对端读到EOF，本端仍可读取
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.wclosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.wclosed = true
+	st.mu.Unlock()
+	notify(st.writable)
+	return st.sess.writeFrame(MUX_FIN, st.id, muxFinWrite, nil)
+}
+
+// Close 关闭流并通知对端，双方都关闭后移除；已写出的数据在关闭帧之前送达，对端读完后才返回EOF
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf = nil
+	done := st.finished
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	err := st.sess.writeFrame(MUX_FIN, st.id, muxFinClose, nil)
+	if done || err != nil {
+		st.sess.remove(st.id)
+	}
+	return err
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
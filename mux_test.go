@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxPair 经内存管道连接的一对多路复用连接，client打开流，server接受；参数为双方的接收窗口
+func muxPair(t *testing.T, clientWin, serverWin int) (client, server *muxSession) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server = newMuxSession(a, clientWin, serverWin), newMuxSession(b, serverWin, clientWin)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+// acceptTimeout 等待对端打开的流
+func acceptTimeout(t *testing.T, s *muxSession) net.Conn {
+	t.Helper()
+	done := make(chan net.Conn, 1)
+	go func() {
+		st, _ := s.Accept()
+		done <- st
+	}()
+	select {
+	case st := <-done:
+		if st == nil {
+			t.Fatal("session closed")
+		}
+		return st
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream accepted")
+	}
+	return nil
+}
+
+// TestMuxBacklogFull 等待处理的新流已满时拒绝新流，其他流的帧照常处理
+func TestMuxBacklogFull(t *testing.T) {
+	client, server := muxPair(t, MuxWindow, MuxWindow)
+	streams := make([]net.Conn, MuxBacklog+1)
+	for i := range streams {
+		st, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = st
+	}
+	rejected := streams[MuxBacklog]
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("stream over the backlog: Read = %v, want EOF", err)
+	}
+	if _, err := rejected.Write([]byte("x")); err == nil {
+		t.Fatal("write to a rejected stream succeeded")
+	}
+	rejected.Close()
+
+	// 排队的流仍可接受并收发数据
+	if _, err := streams[0].Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	st := acceptTimeout(t, server)
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(st, got); err != nil || string(got) != "ping" {
+		t.Fatalf("read %q, %v; want ping", got, err)
+	}
+}
+
+// TestMuxFlowControl 对端不读取时最多发送一个接收窗口，读取后可以继续发送
+func TestMuxFlowControl(t *testing.T) {
+	client, server := muxPair(t, MuxWindow, MuxWindow)
+	w, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := acceptTimeout(t, server)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2*MuxWindow/16)
+	w.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := w.Write(data)
+	if n != MuxWindow {
+		t.Fatalf("wrote %v bytes without a reader, want %v", n, MuxWindow)
+	}
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Fatalf("Write error = %v, want timeout", err)
+	}
+
+	w.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data[n:])
+		done <- err
+	}()
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestMuxWindowConfig(t *testing.T) {
+	tests := []struct {
+		n       int
+		want    int
+		wantErr bool
+	}{
+		{0, MuxWindow, false},
+		{MuxFrameMax, MuxFrameMax, false},
+		{MuxWindowMax, MuxWindowMax, false},
+		{1 << 20, 1 << 20, false},
+		{MuxFrameMax - 1, 0, true},
+		{MuxWindowMax + 1, 0, true},
+		{-1, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := muxWindow(tt.n)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("muxWindow(%v) = %v, %v; want %v, error %v", tt.n, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// writeUntilBlocked 对端不读取时写出的字节数
+func writeUntilBlocked(t *testing.T, w net.Conn, size int) int {
+	t.Helper()
+	w.SetWriteDeadline(time.Now().Add(300 * time.Millisecond))
+	n, err := w.Write(make([]byte, size))
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Fatalf("Write = %v, %v; want a timeout", n, err)
+	}
+	w.SetWriteDeadline(time.Time{})
+	return n
+}
+
+// TestMuxWindow 每个方向最多发送对端的接收窗口
+func TestMuxWindow(t *testing.T) {
+	tests := []struct {
+		name                 string
+		clientWin, serverWin int
+	}{
+		{"default", MuxWindow, MuxWindow},
+		{"small client", MuxFrameMax, MuxWindow},
+		{"large server", MuxWindow, 4 * MuxWindow},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := muxPair(t, tt.clientWin, tt.serverWin)
+			c, err := client.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := acceptTimeout(t, server)
+			if n := writeUntilBlocked(t, c, 2*tt.serverWin); n != tt.serverWin {
+				t.Errorf("client sent %v bytes, want the server window %v", n, tt.serverWin)
+			}
+			if n := writeUntilBlocked(t, s, 2*tt.clientWin); n != tt.clientWin {
+				t.Errorf("server sent %v bytes, want the client window %v", n, tt.clientWin)
+			}
+		})
+	}
+}
+
+// TestMuxSlowStream 一个流的接收方不读取，同一连接上的其他流照常传输
+func TestMuxSlowStream(t *testing.T) {
+	client, server := muxPair(t, MuxWindow, MuxWindow)
+	slow, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowPeer := acceptTimeout(t, server)
+	defer slowPeer.Close()
+	// 填满慢速流的窗口，之后的写入一直阻塞
+	go slow.Write(make([]byte, 4*MuxWindow))
+
+	fast, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastPeer := acceptTimeout(t, server)
+	data := bytes.Repeat([]byte("fast"), MuxWindow)
+	go func() {
+		fast.Write(data)
+		fast.Close()
+	}()
+	fastPeer.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := ioutil.ReadAll(fastPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("fast stream got %v bytes, want %v", len(got), len(data))
+	}
+}
+
+// TestMuxCloseFlush 写入后立即关闭，接收方缓慢读取仍能读到全部数据，之后读到EOF
+func TestMuxCloseFlush(t *testing.T) {
+	client, server := muxPair(t, MuxWindow, MuxFrameMax)
+	w, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := acceptTimeout(t, server)
+	data := make([]byte, 8*MuxFrameMax+123)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		if _, err := w.Write(data); err != nil {
+			t.Error(err)
+		}
+		w.Close()
+	}()
+	r.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var got []byte
+	buf := make([]byte, 1000)
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read after %v bytes: %v", len(got), err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %v bytes, want %v", len(got), len(data))
+	}
+}
+
+// TestMuxCloseWrite 只关闭写的一端时对端读到EOF后仍可回复
+func TestMuxCloseWrite(t *testing.T) {
+	client, server := muxPair(t, MuxWindow, MuxWindow)
+	c, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := acceptTimeout(t, server)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(*muxStream).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("more")); err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+	req, err := ioutil.ReadAll(s)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("server read %q, %v", req, err)
+	}
+	if _, err := s.Write([]byte("response")); err != nil {
+		t.Fatalf("reply after the peer closed its write side: %v", err)
+	}
+	s.Close()
+	resp, err := ioutil.ReadAll(c)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("client read %q, %v", resp, err)
+	}
+	c.Close()
+
+	// 双方都关闭后移除
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, m := streamCount(client), streamCount(server)
+		if n == 0 && m == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("streams left: client %v, server %v", n, m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func streamCount(s *muxSession) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// TestMuxCloseReset 对端完全关闭后写入失败
+func TestMuxCloseReset(t *testing.T) {
+	client, server := muxPair(t, MuxWindow, MuxWindow)
+	c, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := acceptTimeout(t, server)
+	s.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read = %v, want EOF", err)
+	}
+	if _, err := c.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("Write = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+// TestMuxHandshake 只有服务端不回复就关闭时才视为不支持MUX，拒绝与不完整的回复是错误
+func TestMuxHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   []byte
+		win     int
+		wantErr error // 不为nil时要求返回该错误
+		wantOK  bool
+	}{
+		{"old server closes", nil, 0, errMuxUnsupported, false},
+		{"rejected", []byte{ERROR_BADCONFIG}, 0, nil, false},
+		{"short reply", []byte{SUCCESS, 0, 1}, 0, nil, false},
+		{"accepted", []byte{SUCCESS, 0, 0x02, 0, 0}, 0x20000, nil, true},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			io.ReadFull(server, make([]byte, 5))
+			server.Write(tt.reply)
+			server.Close()
+		}()
+		win, err := muxHandshake(client, MuxWindow)
+		client.Close()
+		switch {
+		case tt.wantOK && (err != nil || win != tt.win):
+			t.Errorf("%v: window %v, %v; want %v", tt.name, win, err, tt.win)
+		case !tt.wantOK && err == nil:
+			t.Errorf("%v: no error", tt.name)
+		case tt.wantErr != nil && err != tt.wantErr:
+			t.Errorf("%v: %v, want %v", tt.name, err, tt.wantErr)
+		case !tt.wantOK && tt.wantErr == nil && err == errMuxUnsupported:
+			t.Errorf("%v: treated as unsupported", tt.name)
+		}
+	}
+}
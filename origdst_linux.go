@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST netfilter中获取重定向前目标地址的选项，IPv4与IPv6取值相同
+const soOriginalDst = 80
+
+// originalDst 获取经iptables REDIRECT/TPROXY重定向前的目标地址
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("original destination requires a plain tcp connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var ipv6 = false
+	if la, ok := tc.LocalAddr().(*net.TCPAddr); ok && la.IP.To4() == nil {
+		ipv6 = true
+	}
+	var addr string
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6: family(2) port(2) flowinfo(4) addr(16)
+			info, e := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if e != nil {
+				serr = e
+				return
+			}
+			// 端口为网络字节序
+			pb := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			port := int(pb[0])<<8 | int(pb[1])
+			addr = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(port))
+			return
+		}
+		// sockaddr_in: family(2) port(2) addr(4)
+		mreq, e := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if e != nil {
+			serr = e
+			return
+		}
+		port := int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3])
+		ip := net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	})
+	if err != nil {
+		return "", err
+	}
+	return addr, serr
+}
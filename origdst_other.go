@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst 非Linux平台不支持透明代理
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.New("transparent proxy is only supported on linux")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// PeekTimeOut 读取连接首部数据的超时时间
+const PeekTimeOut = 10 * time.Second
+
+// peekConn 先返回已预读的数据，再继续读取原连接
+type peekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newPeekConn(conn net.Conn, peeked []byte) *peekConn {
+	return &peekConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(peeked), conn),
+	}
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekConn) Unwrap() net.Conn { return c.Conn }
+
+// recordConn 只读连接，记录读取到的数据，用于解析ClientHello
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+var errHelloDone = errors.New("client hello received")
+
+// peekClientHello 解析TLS ClientHello，返回的连接会重放已读取的数据；不是TLS时hello为nil
+func peekClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	var hello *tls.ClientHelloInfo
+	rc := &recordConn{Conn: conn}
+	conn.SetReadDeadline(time.Now().Add(PeekTimeOut))
+	err := tls.Server(rc, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			info := *h
+			hello = &info
+			return nil, errHelloDone
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	if hello != nil {
+		err = nil
+	}
+	return hello, newPeekConn(conn, rc.buf.Bytes()), err
+}
+
+// TLSCheckConfig 透传TLS端口的ClientHello校验
+type TLSCheckConfig struct {
+	Versions []string `json:"versions"` // 允许的TLS版本，如["1.2", "1.3"]，为空不限制
+	ALPN     []string `json:"alpn"`     // 允许的ALPN协议，为空不限制
+	LogOnly  bool     `json:"log_only"` // 只记录不拒绝
+
+	versions []uint16
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Init 校验并解析配置
+func (c *TLSCheckConfig) Init() error {
+	c.versions = c.versions[:0]
+	for _, v := range c.Versions {
+		ver, ok := tlsVersions[v]
+		if !ok {
+			return fmt.Errorf("unknown tls version %q", v)
+		}
+		c.versions = append(c.versions, ver)
+	}
+	return nil
+}
+
+// Check 校验ClientHello，返回拒绝原因
+func (c *TLSCheckConfig) Check(hello *tls.ClientHelloInfo) error {
+	if hello == nil {
+		return errors.New("not a tls client hello")
+	}
+	if len(c.versions) > 0 && !intersectUint16(c.versions, hello.SupportedVersions) {
+		return fmt.Errorf("unacceptable tls versions %x", hello.SupportedVersions)
+	}
+	if len(c.ALPN) > 0 && !intersectString(c.ALPN, hello.SupportedProtos) {
+		return fmt.Errorf("unacceptable alpn %q", hello.SupportedProtos)
+	}
+	return nil
+}
+
+func intersectUint16(a, b []uint16) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func intersectString(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,46 +3,470 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"pmap/encrypto"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 // ServerConfig 服务端配置
 type ServerConfig struct {
-	Key       string   `json:"key"`         // 配对密码
-	Port      uint16   `json:"port"`        // 控制监听端口
-	LimitPort []uint16 `json:"-limit-port"` // 开端口范围
+	Key       string  `json:"key"`        // 配对密码
+	Port      uint16  `json:"port"`       // 控制监听端口
+	LimitPort PortSet `json:"limit_port"` // 允许客户端使用的端口，如"8000-8100,9000,9443"，为空不限制
+	KillAck   bool    `json:"kill_ack"`   // 收到KILL后先回复确认再关闭
+	KillToken string  `json:"kill_token"` // KILL需携带的口令，为空则不校验
+	TLSCert   string  `json:"tls_cert"`   // 终止TLS使用的证书
+	TLSKey    string  `json:"tls_key"`    // 终止TLS使用的私钥
+	// 控制连接待发送命令队列长度，队列写满说明客户端不再读取控制连接
+	ControlQueue int `json:"control_queue"`
+	// 多密钥配置文件，配置后忽略key，收到SIGHUP时重新加载
+	AuthFile string `json:"auth_file"`
+	// 以SO_REUSEPORT监听控制端口，新进程可绑定相同端口，旧进程收到SIGUSR2后排空退出；映射端口不设置
+	ReusePort bool `json:"reuse_port"`
+	// 每个客户端转发缓冲可用内存，超出后拒绝新连接，0不限制；多密钥时使用密钥的memory_bytes
+	ClientMemory int64 `json:"client_memory"`
+	// 每个客户端最多的映射数量与全部映射端口同时存在的连接数量，0不限制；多密钥时密钥的max_mappings、max_conns不为0时优先
+	MaxMappings    int `json:"max_mappings"`
+	ClientMaxConns int `json:"client_max_conns"`
+	// 管理接口监听地址，如127.0.0.1:8809，为空不开启
+	Admin string `json:"admin"`
+	// 管理接口/events保留的最近事件数量，默认100
+	Events int `json:"events"`
+	// 数据连接发送端口与id的超时时间(秒)，默认5秒
+	DataTimeout int `json:"data_timeout"`
+	// 控制端口与映射端口开启TCP Fast Open(仅Linux)
+	FastOpen bool `json:"fast_open"`
+	// 控制端口与映射端口接受的连接的TCP keepalive间隔(秒)，默认30，负数不开启
+	KeepAlive int `json:"keepalive"`
+	// 允许的客户端时钟偏差(秒)，默认300秒，负数不校验
+	MaxSkew int `json:"max_skew"`
+	// 认证成功后发给客户端的公告，如服务状态、使用条款、配额说明
+	Banner string `json:"banner"`
+	// 等待中的连接超时后再保留的时间(秒)，期间迟到的数据连接仍可对接，0立即回收
+	WaitGrace int `json:"wait_grace"`
+	// 转发连接空闲超时与最长存活时间(秒)，0不限制，映射可单独设置
+	IdleTimeout int `json:"idle_timeout"`
+	MaxLifetime int `json:"max_lifetime"`
+	// 连接关闭日志的采样：每N个连接记录一个，字节数或持续时间(秒)达到阈值的总是记录，都为0时不记录
+	LogSample   int   `json:"log_sample"`
+	LogBytes    int64 `json:"log_bytes"`
+	LogDuration int   `json:"log_duration"`
+	// 管理接口/forwards采样各转发连接速率的间隔(秒)，0不采样
+	RateInterval int `json:"rate_interval"`
+	// 只接受挑战应答认证，拒绝在START中明文发送key的旧版客户端
+	HMACOnly bool `json:"hmac_only"`
+	// 每个端口同时等待客户端对接的连接数量，超出后新连接直接关闭，默认10，最大256
+	WaitMax int `json:"wait_max"`
+	// 等待对接的连接已满时，新连接等待空位的时间(毫秒)，默认1000，负数直接关闭
+	WaitSlot int `json:"wait_slot"`
+	// 转发时每个方向的缓冲大小(字节)，默认10240
+	BufferSize int `json:"buffer_size"`
+	// 多路复用连接上每个流的接收窗口(字节)，默认262144，范围16384至16777216
+	MuxWindow int `json:"mux_window"`
+	// 数据连接密钥派生(scrypt)使用的盐，配置了相同盐的客户端使用派生的密钥，其余客户端仍使用旧的md5派生
+	KDFSalt string `json:"kdf_salt"`
+	// 收到SIGINT/SIGTERM后等待已对接连接结束的时间(秒)，超时后强制关闭，默认10，负数不等待
+	ShutdownGrace int `json:"shutdown_grace"`
+	// 每个映射端口同时存在的连接数量与每秒接受的新连接数量，超出后新连接直接关闭，0不限制
+	MaxConns   int     `json:"max_conns"`
+	AcceptRate float64 `json:"accept_rate"`
+	// 映射端口每个连接开始与结束时调用的审计回调名称，需在服务端注册，内置log写入audit类事件日志
+	Audit []string `json:"audit"`
+	// 控制端口(含数据连接)使用TLS，证书为tls_cert与tls_key，开启后只接受开启tls的客户端
+	ControlTLS bool `json:"control_tls"`
+	// 开启control_tls时，ClientHello没有携带ALPN pmap/1的连接不解密，原样转发到该地址(如本机的HTTPS服务)，两者共用一个端口
+	ControlFallback string `json:"control_fallback"`
+	// 控制端口与映射端口监听的本机地址，默认0.0.0.0，映射可单独设置
+	Bind string `json:"bind"`
+	// 允许与拒绝连接控制端口的地址(IP或网段)，拒绝优先，允许列表为空时不限制；在Accept后立即检查
+	ControlAllow []string `json:"control_allow"`
+	ControlDeny  []string `json:"control_deny"`
+	// 全部映射共享的带宽上限(字节/秒)，in为访问者发往内网服务，out为内网服务发往访问者，不为0时覆盖bandwidth，0不限制；
+	// 多个映射同时传输时按映射的weight分配
+	Bandwidth    int64 `json:"bandwidth"`
+	BandwidthIn  int64 `json:"bandwidth_in"`
+	BandwidthOut int64 `json:"bandwidth_out"`
+	// 分配给客户端的临时端口，如"30000-39999"，映射的outer为0时从中随机选择，须同时满足limit_port，为空不分配
+	EphemeralPorts PortSet `json:"ephemeral_ports"`
+	// 同一IP在ban_time(秒，默认600)内认证失败该次数后，ban_time内拒绝其连接控制端口，0不封禁
+	BanAfter int `json:"ban_after"`
+	BanTime  int `json:"ban_time"`
 }
 
 // ClientMapConfig 客户端map配置
 type ClientMapConfig struct {
-	Inner string `json:"inner"`
-	Outer uint16 `json:"outer"`
+	Inner            string `json:"inner"`
+	Outer            uint16 `json:"outer"`
+	TLS              bool   `json:"tls"`                // 服务端在外网端口终止TLS
+	InnerTLS         bool   `json:"inner_tls"`          // 客户端以TLS连接内网服务
+	InnerTLSName     string `json:"inner_tls_name"`     // 校验内网服务证书使用的域名，默认取Inner的主机名
+	InnerTLSInsecure bool   `json:"inner_tls_insecure"` // 不校验内网服务证书
+	Transparent      bool   `json:"transparent"`        // 透明代理，客户端连接重定向前的原始目标地址，仅支持Linux
+	// 外网端口作为socks5或http(CONNECT)代理，客户端连接访问者请求的目标地址，受allow_inner限制，忽略inner，需服务端支持
+	ForwardProxy string `json:"forward_proxy"`
+	// 透传TLS时服务端校验ClientHello，拒绝非TLS及不符合版本/ALPN要求的连接
+	TLSCheck *TLSCheckConfig `json:"tls_check"`
+	// 按首部数据识别协议并转发到不同的内网地址，未识别的转发到inner
+	Detect []DetectRule `json:"detect"`
+	// 客户端以内置HTTP文件服务公开本地目录，忽略inner
+	Dir *DirConfig `json:"dir"`
+	// 外网端口只在指定时段接受连接
+	Schedule *ScheduleConfig `json:"schedule"`
+	// 诊断模式：数据连接对明文计算累计校验和，发现复制或加解密的实现错误，不是安全功能
+	Checksum bool `json:"checksum"`
+	// 转发连接空闲超时与最长存活时间(秒)，优先于服务端的全局设置，0使用全局设置，-1不限制
+	IdleTimeout int `json:"idle_timeout"`
+	MaxLifetime int `json:"max_lifetime"`
+	// 服务端在转发路径上按顺序使用的拦截器名称，需在服务端注册
+	Intercept []string `json:"intercept"`
+	// 协议，tcp或udp，默认tcp
+	Proto string `json:"proto"`
+	// 外网端口同时存在的连接数量与每秒接受的新连接数量，只能比服务端的设置更严格，0使用服务端的设置
+	MaxConns   int     `json:"max_conns"`
+	AcceptRate float64 `json:"accept_rate"`
+	// 外网端口监听的服务端本机地址，如127.0.0.1，为空使用服务端的bind
+	Bind string `json:"bind"`
+	// 客户端连接内网服务后先发送PROXY协议头(1为v1文本，2为v2二进制)，传递访问者的真实地址，0不发送，不支持udp
+	ProxyProtocol int `json:"proxy_protocol"`
+	// 数据连接对明文压缩后再加密，适合慢速链路上的文本协议，需服务端支持
+	Compress bool `json:"compress"`
+	// 多个内网服务地址，新连接按balance选择，连接失败时尝试下一个；inner不为空时也是其中之一
+	Backends []string `json:"backends"`
+	// 多个内网服务的选择方式，round-robin(默认)轮询，least-conn选择转发中连接最少的
+	Balance string `json:"balance"`
+	// 连接失败的内网服务在该时间(秒)内排在最后，0不标记
+	BackendCooldown int `json:"backend_cooldown"`
+	// 该映射允许转发的内网地址，代替客户端的allow_inner
+	AllowInner []string `json:"allow_inner"`
+	// 映射的带宽限制(字节/秒)，端口上的全部连接共享；in为访问者发往内网服务，out为内网服务发往访问者，不为0时覆盖bandwidth，0不限制
+	Bandwidth    int64 `json:"bandwidth"`
+	BandwidthIn  int64 `json:"bandwidth_in"`
+	BandwidthOut int64 `json:"bandwidth_out"`
+	// 预先建立的备用数据连接数量，服务端有新连接时直接在备用连接上通知，省去每个连接建立数据连接的时间，需服务端支持
+	Spare int `json:"spare"`
+	// 服务端配置了全局带宽时，多个映射争用带宽时按权重分配，默认1，最大1000；如交互式SSH设为8、批量备份为1
+	Weight int `json:"weight"`
+	// 映射只在本机条件成立时打开(如开发服务器运行时)，条件变化时客户端在运行中添加或关闭映射，不能与dir、forward_proxy一起使用
+	When *WhenConfig `json:"when"`
+	// 服务名称，outer为0时由服务端从ephemeral_ports分配端口，服务端按客户端与名称记录分配的端口，需服务端支持
+	Name string `json:"name"`
+
+	assigned  bool // outer由服务端的临时端口池分配
+	dir       *dirServer
+	lb        *balancer
+	allow     allowList
+	keepAlive time.Duration // 内网服务连接的keepalive间隔，负数不开启
+}
+
+// Label 日志中代表该映射的内网地址，共享目录为目录路径，代理端口为代理协议
+func (m *ClientMapConfig) Label() string {
+	switch {
+	case m.Dir != nil:
+		return m.Dir.Path
+	case m.ForwardProxy != "":
+		return m.ForwardProxy + " proxy"
+	}
+	return m.Inner
+}
+
+// Dial 连接内网服务
+func (m *ClientMapConfig) Dial() (net.Conn, error) {
+	if m.dir != nil {
+		return m.dir.Dial()
+	}
+	if m.Inner == StdioInner {
+		return dialStdio()
+	}
+	if m.lb != nil {
+		return m.lb.Dial(m.dialAddr)
+	}
+	return m.dialAddr(m.Inner)
+}
+
+// dialAddr 连接地址为addr的内网服务
+func (m *ClientMapConfig) dialAddr(addr string) (net.Conn, error) {
+	if m.Proto == ProtoUDP {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return newDatagramConn(conn), nil
+	}
+	var d = &net.Dialer{KeepAlive: m.keepAlive}
+	network, address := splitNetwork(addr)
+	if !m.InnerTLS {
+		return d.Dial(network, address)
+	}
+	name := m.InnerTLSName
+	if name == "" {
+		if network == "unix" {
+			return nil, fmt.Errorf("inner_tls_name is required for %v", addr)
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		name = host
+	}
+	cfg := newTLSConfig()
+	cfg.ServerName = name
+	cfg.InsecureSkipVerify = m.InnerTLSInsecure
+	return tls.DialWithDialer(d, network, address, cfg)
+}
+
+// normalize 规范化内网地址，包括协议识别规则的地址，校验PROXY协议配置，配置了多个内网服务时创建负载均衡
+func (m *ClientMapConfig) normalize() error {
+	switch {
+	case len(m.Backends) > 0 && (m.Dir != nil || m.Inner == StdioInner || m.Transparent):
+		return fmt.Errorf("backends can't be used with dir, stdio or transparent mappings, port %v", m.Outer)
+	case m.Balance != "" && m.Balance != BalanceRoundRobin && m.Balance != BalanceLeastConn:
+		return fmt.Errorf("unknown balance mode %q for port %v, must be round-robin or least-conn", m.Balance, m.Outer)
+	case m.ProxyProtocol < 0 || m.ProxyProtocol > ProxyV2:
+		return fmt.Errorf("bad proxy protocol version %v for port %v, must be 1 or 2", m.ProxyProtocol, m.Outer)
+	case m.ProxyProtocol != 0 && (m.Proto == ProtoUDP || m.Dir != nil || m.Inner == StdioInner):
+		return fmt.Errorf("proxy protocol is only supported for tcp inner services, port %v", m.Outer)
+	case m.Proto == ProtoUDP && strings.HasPrefix(m.Inner, UnixScheme):
+		return fmt.Errorf("unix socket inner is not supported for udp, port %v", m.Outer)
+	case m.ForwardProxy != "" && !validForward(m.ForwardProxy):
+		return fmt.Errorf("unknown forward proxy %q for port %v, must be socks5 or http", m.ForwardProxy, m.Outer)
+	case m.ForwardProxy != "" && (m.Proto == ProtoUDP || m.Dir != nil || m.Inner == StdioInner || m.Transparent || len(m.Backends) > 0 || len(m.Detect) > 0):
+		return fmt.Errorf("forward_proxy can't be used with udp, dir, stdio, transparent, backends or detect, port %v", m.Outer)
+	}
+	if m.Dir != nil || m.Inner == StdioInner {
+		return nil
+	}
+	var err error
+	if m.Inner != "" {
+		if m.Inner, err = normalizeAddr(m.Inner); err != nil {
+			return fmt.Errorf("bad inner address for port %v: %v", m.Outer, err)
+		}
+	}
+	for i := range m.Detect {
+		if m.Detect[i].Inner == "" {
+			continue
+		}
+		if m.Detect[i].Inner, err = normalizeAddr(m.Detect[i].Inner); err != nil {
+			return fmt.Errorf("bad detect inner address for port %v: %v", m.Outer, err)
+		}
+	}
+	if len(m.Backends) == 0 {
+		return nil
+	}
+	var addrs []string
+	if m.Inner != "" {
+		addrs = append(addrs, m.Inner)
+	}
+	for _, b := range m.Backends {
+		addr, err := normalizeAddr(b)
+		if err != nil {
+			return fmt.Errorf("bad backend address for port %v: %v", m.Outer, err)
+		}
+		if addr != m.Inner {
+			addrs = append(addrs, addr)
+		}
+	}
+	// 日志中以第一个内网服务代表该映射
+	m.Inner = addrs[0]
+	m.lb = newBalancer(m.Outer, addrs, m.Balance, time.Duration(m.BackendCooldown)*time.Second)
+	return nil
+}
+
+// UnixScheme 内网地址为Unix域套接字时的前缀，如unix:/var/run/docker.sock
+const UnixScheme = "unix:"
+
+// splitNetwork 按前缀区分内网地址的网络类型，没有前缀时为tcp
+func splitNetwork(addr string) (network, address string) {
+	if strings.HasPrefix(addr, UnixScheme) {
+		return "unix", strings.TrimPrefix(addr, UnixScheme)
+	}
+	return "tcp", addr
+}
+
+// normalizeAddr 将地址规范为net.JoinHostPort的格式，IPv6地址加上方括号；
+// 兼容未加方括号的IPv6地址如"::1:8080"，此时最后一个冒号之后为端口；Unix域套接字地址只检查路径不为空
+func normalizeAddr(addr string) (string, error) {
+	if network, path := splitNetwork(addr); network == "unix" {
+		if path == "" {
+			return "", errors.New("empty unix socket path")
+		}
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		i := strings.LastIndex(addr, ":")
+		if i < 0 || net.ParseIP(addr[:i]) == nil {
+			return "", err
+		}
+		host, port = addr[:i], addr[i+1:]
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
 }
 
 // ClientConfig 客户端配置
 type ClientConfig struct {
-	Key    string            `json:"key"`
-	Server string            `json:"server"`
-	Map    []ClientMapConfig `json:"map"`
+	Key       string            `json:"key"`
+	Server    string            `json:"server"`
+	Map       []ClientMapConfig `json:"map"`
+	KillToken string            `json:"kill_token"` // 发送KILL时携带的口令
+	// 认证成功后将映射表写入文件或POST到指定地址，便于脚本获取外网地址
+	PublishFile string `json:"publish_file"`
+	PublishURL  string `json:"publish_url"`
+	// 客户端管理接口监听地址，如127.0.0.1:8810，为空不开启
+	Admin string `json:"admin"`
+	// 控制连接空闲(未收到服务端命令)超过该时间(秒)后主动重连，刷新NAT映射，0不开启
+	Refresh int `json:"refresh"`
+	// 连接服务端时使用TCP Fast Open(仅Linux)，节省数据连接的一次往返
+	FastOpen bool `json:"fast_open"`
+	// 控制连接、数据连接与内网服务连接的TCP keepalive间隔(秒)，默认30，负数不开启
+	KeepAlive int `json:"keepalive"`
+	// 握手时客户端的Unix时间(秒)，由客户端发送START时填写，不需要配置
+	Time int64 `json:"time,omitempty"`
+	// 客户端能接收SUCCESS后的公告，由客户端填写，不需要配置
+	Banner bool `json:"banner,omitempty"`
+	// 只校验配置，服务端不打开端口，由-testconnect填写，不需要配置
+	DryRun bool `json:"dry_run,omitempty"`
+	// 同时建立中(连接服务端与内网服务)的连接数量上限，默认64
+	DialConcurrency int `json:"dial_concurrency"`
+	// 启动时检查每个内网服务是否可达：warn只输出警告，strict有不可达的服务时拒绝启动，为空不检查
+	CheckBackends string `json:"check_backends"`
+	// 生成TOTP验证码的base32密钥，只在客户端使用，不发给服务端
+	TOTPSecret string `json:"totp_secret"`
+	// 握手时的TOTP验证码，由客户端填写，不需要配置
+	TOTP string `json:"totp,omitempty"`
+	// 数据连接加密方式：ctr(默认)或gcm，gcm需要服务端支持
+	Cipher string `json:"cipher"`
+	// 数据连接使用随机iv，由客户端填写，不需要配置
+	RandomIV bool `json:"random_iv,omitempty"`
+	// 对认证挑战的应答HMAC-SHA256(key, nonce)，由客户端填写，此时不发送key
+	Proof []byte `json:"proof,omitempty"`
+	// 数据连接密钥派生(scrypt)使用的盐，须与服务端一致，为空使用旧的md5派生
+	KDFSalt string `json:"kdf_salt"`
+	// 转发时每个方向的缓冲大小(字节)，默认10240
+	BufferSize int `json:"buffer_size"`
+	// 收到SIGINT/SIGTERM后等待已对接连接结束的时间(秒)，超时后强制关闭，默认10，负数不等待
+	ShutdownGrace int `json:"shutdown_grace"`
+	// 以TLS连接服务端(控制连接与数据连接)，服务端需开启control_tls
+	TLS         bool   `json:"tls"`
+	TLSCA       string `json:"tls_ca"`       // 校验服务端证书的CA证书文件(PEM)，为空使用系统CA
+	TLSName     string `json:"tls_name"`     // 校验服务端证书使用的域名，默认取server的主机名
+	TLSInsecure bool   `json:"tls_insecure"` // 不校验服务端证书
+	// 控制连接心跳间隔(秒)，默认30，负数不发送；超过ping_timeout(秒，默认10)没有回复时重连
+	PingInterval int `json:"ping_interval"`
+	PingTimeout  int `json:"ping_timeout"`
+	// 心跳、ADD_PORT等控制命令合并写出的间隔(毫秒)，须小于心跳间隔，0逐个立即写出；KILL不等待
+	ControlBatch int `json:"control_batch"`
+	// 合并的控制命令以DEFLATE压缩为BATCH帧，需配置control_batch，需服务端支持协议版本3
+	ControlCompress bool `json:"control_compress"`
+	// 心跳间隔(秒)，服务端据此判断客户端失联，由客户端填写，不需要配置
+	Heartbeat int `json:"heartbeat,omitempty"`
+	// 客户端支持映射的压缩，由客户端填写，不需要配置
+	Compress bool `json:"compress,omitempty"`
+	// 客户端支持数据连接两个方向使用不同的iv，由客户端填写，不需要配置
+	SplitIV bool `json:"split_iv,omitempty"`
+	// 重连间隔的上限(秒)，默认60；每次重连失败后间隔乘以retry_factor，默认2，认证成功后恢复为1秒
+	RetryMax    int     `json:"retry_max"`
+	RetryFactor float64 `json:"retry_factor"`
+	// 所有数据连接复用一个到服务端的连接，省去每个连接的建立与握手，需服务端支持
+	Mux bool `json:"mux"`
+	// 多路复用连接上每个流的接收窗口(字节)，默认262144，范围16384至16777216
+	MuxWindow int `json:"mux_window"`
+	// 允许转发的内网地址(IP、网段或主机名，可加端口)，透明代理等由服务端指定的目标也须在其中，不配置时不限制；只在客户端使用
+	AllowInner []string `json:"allow_inner"`
+	// 从本机的服务来源(默认为目录)自动添加与关闭映射，只在客户端使用
+	Discover *DiscoverConfig `json:"discover"`
+
+	ephemeral []ClientMapConfig // outer为0的映射，每次认证成功后请求服务端分配端口
+}
+
+// PublishedMap 对外公布的映射
+type PublishedMap struct {
+	Inner  string `json:"inner"`
+	Public string `json:"public"`
+}
+
+// PublishMap 公布映射表，失败只记录日志不影响隧道
+func PublishMap(config *ClientConfig) {
+	if config.PublishFile == "" && config.PublishURL == "" {
+		return
+	}
+	host, _, err := net.SplitHostPort(config.Server)
+	if err != nil {
+		logger.Warn("Publish map failed", err)
+		return
+	}
+	var maps = make([]PublishedMap, 0, len(config.Map))
+	for _, m := range config.Map {
+		maps = append(maps, PublishedMap{
+			Inner:  m.Inner,
+			Public: net.JoinHostPort(host, fmt.Sprint(m.Outer)),
+		})
+	}
+	data, _ := json.Marshal(maps)
+	if config.PublishFile != "" {
+		if err := ioutil.WriteFile(config.PublishFile, data, 0644); err != nil {
+			logger.Warn("Publish map to file failed", err)
+		}
+	}
+	if config.PublishURL != "" {
+		client := http.Client{Timeout: PublishTimeOut}
+		resp, err := client.Post(config.PublishURL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			logger.Warn("Publish map to url failed", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			logger.Warn("Publish map to url failed", resp.Status)
+		}
+	}
 }
 
 // Config 配置
 type Config struct {
 	Server *ServerConfig `json:"server"`
 	Client *ClientConfig `json:"client"`
+	// 同一进程中另外运行的服务端与客户端，如连接多个服务端，各自独立运行，一个出错退出时其余继续运行，全部退出后进程退出
+	Servers []*ServerConfig `json:"servers"`
+	Clients []*ClientConfig `json:"clients"`
+	TLS     *TLSPolicy      `json:"tls_policy"` // 所有TLS监听与连接的加密策略
+	// 日志级别debug、info(默认)、warn或error，格式text(默认)或json，命令行的-log-level与-log-format优先
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+}
+
+// setupLogger 设置日志级别与格式，为空时不修改
+func setupLogger(level, format string) error {
+	if level != "" {
+		l, err := ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		logger.SetLevel(l)
+	}
+	if format != "" {
+		return logger.SetFormat(format)
+	}
+	return nil
 }
 
 const (
@@ -67,19 +491,136 @@ const (
 	ERROR_BUSY
 	// ERROR_LIMIT_PORT 不满足端口范围
 	ERROR_LIMIT_PORT
+	// ERROR_TLS 服务端无法满足映射的TLS配置
+	ERROR_TLS
+	// ERROR_QUOTA 超出密钥的映射数量或流量配额
+	ERROR_QUOTA
+	// RECONNECT 服务端即将重启，客户端需重新连接
+	RECONNECT
+	// ERROR_CLOCK 客户端与服务端时钟偏差过大
+	ERROR_CLOCK
+	// ERROR_TOTP 缺少或错误的TOTP验证码
+	ERROR_TOTP
+	// ERROR_RETRY 服务端暂时无法处理，客户端稍后重试
+	ERROR_RETRY
+	// SUCCESS_IV 处理成功，数据连接在NEWCONN后发送随机iv
+	SUCCESS_IV
+	// AUTH 请求认证挑战，服务端回复随机数，客户端在START中发送应答而不是key
+	AUTH
+	// SUCCESS_KDF 处理成功，数据连接使用随机iv与KDF派生的密钥
+	SUCCESS_KDF
+	// ERROR_KDF 客户端与服务端的KDF盐不一致
+	ERROR_KDF
+	// KILL_PORT 关闭单个映射端口，其余映射不受影响
+	KILL_PORT
+	// ADD_PORT 运行时添加映射，服务端以 ADD_PORT port(2) code(1) 回复结果
+	ADD_PORT
+	// PING 客户端心跳，服务端回复PONG
+	PING
+	// PONG 心跳回复，服务端认证成功后先主动发送一次，表示支持心跳
+	PONG
+	// NEWSOCKET_PROXY 开启PROXY协议的映射的新连接，在NEWSOCKET之后附带访问者地址与外网端口地址
+	NEWSOCKET_PROXY
+	// SUCCESS_COMPRESS 处理成功，服务端支持映射的压缩，同时表示随机iv与KDF(客户端配置了盐时)
+	SUCCESS_COMPRESS
+	// MUX 客户端建立多路复用连接，服务端回复SUCCESS后该连接承载多个数据连接
+	MUX
+	// SPARE 客户端预先建立的备用数据连接，服务端回复SUCCESS后保留，有新连接时在其上发送NEWSOCKET
+	SPARE
+	// ERROR_VERSION 服务端不支持客户端的协议版本，之后1字节为服务端支持的最高版本
+	ERROR_VERSION
+	// ERROR_BADCONFIG 服务端无法解析START中的客户端配置
+	ERROR_BADCONFIG
+	// ERROR_MAPPINGS 映射数量超过服务端的限制，握手时之后2字节为允许的数量
+	ERROR_MAPPINGS
+	// SUCCESS_SPLIT_IV 处理成功，数据连接的两个方向使用由随机iv派生的不同iv，同时表示SUCCESS_COMPRESS支持的参数
+	SUCCESS_SPLIT_IV
+	// BATCH 客户端合并压缩的多个控制命令，BATCH len(2) 压缩数据，解压后与逐个发送的命令相同
+	BATCH
+	// ASSIGN outer为0的ADD_PORT的回复，ASSIGN port(2) code(1) name_len(1) name，失败时port为0
+	ASSIGN
+	// ERROR_POOL 临时端口池未配置或没有空闲端口
+	ERROR_POOL
 )
 
 const (
-	// RetryTime 断线重连时间
+	// RetryTime 断线重连的初始间隔
 	RetryTime          = time.Second
+	RetryMax           = time.Minute // 默认的重连间隔上限
 	TcpKeepAlivePeriod = 30 * time.Second
 	WaitTimeOut        = 30 * time.Second // 连接等待超时时间
-	WaitMax            = 10
+	WaitMax            = 10               // 每个端口默认同时等待对接的连接数量
+	WaitLimit          = 256              // NEWSOCKET的id为1字节，等待对接的连接数量上限
+	WaitSlot           = time.Second      // 等待对接的连接已满时新连接默认等待空位的时间
+	KillWaitTime       = 3 * time.Second  // 退出时等待服务端确认KILL的时间
+	ControlQueueSize   = 64               // 控制连接默认待发送命令队列长度
+	PublishTimeOut     = 10 * time.Second // 公布映射表的请求超时时间
+	DataTimeOut        = 5 * time.Second  // 数据连接发送端口与id的默认超时时间
+	HandshakeTimeOut   = 10 * time.Second // 客户端发送START及配置的超时时间
+	HandshakeMax       = 1024 * 1024      // START中配置的最大字节数
+	MaxClockSkew       = 5 * time.Minute  // 默认允许的客户端与服务端时钟偏差
+	BannerMax          = 4096             // 公告最大字节数
+	DialConcurrency    = 64               // 客户端默认同时建立中的连接数量
+	ShutdownGrace      = 10 * time.Second // 退出时默认等待已对接连接结束的时间
+	BindAll            = "0.0.0.0"        // 默认监听的本机地址
+	PingInterval       = 30 * time.Second // 客户端默认发送心跳的间隔
+	PingTimeOut        = 10 * time.Second // 默认等待心跳回复的时间
+	HeartbeatMiss      = 3                // 服务端连续该数量的心跳间隔没有收到命令时断开客户端
+	SpareMax           = 64               // 每个端口保留的备用数据连接数量上限
+	AssignTries        = 8                // 分配的临时端口被占用时换端口重试的次数
 )
 
 func Recover() {
 	if err := recover(); err != nil {
-		log.Println(err)
+		logger.Error("Recovered from panic:", err)
+	}
+}
+
+// gracePeriod 退出时等待已对接连接的时间，0使用默认值，负数不等待
+func gracePeriod(seconds int) time.Duration {
+	switch {
+	case seconds == 0:
+		return ShutdownGrace
+	case seconds < 0:
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// keepAlivePeriod TCP keepalive间隔，0使用默认值，负数不开启(与net.Dialer、net.ListenConfig的约定一致)
+func keepAlivePeriod(seconds int) time.Duration {
+	switch {
+	case seconds == 0:
+		return TcpKeepAlivePeriod
+	case seconds < 0:
+		return -1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// pingInterval 客户端心跳间隔，0使用默认值，负数不发送心跳
+func pingInterval(seconds int) time.Duration {
+	switch {
+	case seconds == 0:
+		return PingInterval
+	case seconds < 0:
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// waitTimeout 等待wg结束，超时返回false
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
 	}
 }
 
@@ -89,16 +630,149 @@ type Worker struct {
 }
 
 type Resource struct {
-	Listener   net.Listener
-	WaitWorker [WaitMax]*Worker // 工作负载
-	Running    bool
-	mu         sync.Mutex // 工作负载锁
+	Key         string          // 认证使用的密钥
+	CryptKey    []byte          // 数据连接加密使用的key，由密钥派生
+	CryptIV     []byte          // 数据连接未使用随机iv时的iv
+	Used        *int64          // 密钥已用流量
+	Quota       int64           // 密钥流量配额，0不限制
+	Transparent bool            // 透明代理，NEWSOCKET携带原始目标地址
+	Forward     string          // 外网端口的代理协议，NEWSOCKET携带访问者请求的目标地址
+	TLSCheck    *TLSCheckConfig // 透传TLS时校验ClientHello
+	Budget      memoryBudget    // 客户端可同时转发的连接数，同一客户端的端口共享，为nil不限制
+	ClientLimit *connLimiter    // 客户端全部端口共享的并发连接数限制，为nil不限制
+	Detect      []DetectRule    // 协议识别规则，NEWSOCKET携带匹配的规则序号
+	Schedule    *ScheduleConfig // 接受连接的时段，为空不限制
+	Checksum    bool            // 数据连接开启校验模式
+	Cipher      string          // 数据连接加密方式
+	RandomIV    bool            // 数据连接在NEWCONN后发送随机iv
+	SplitIV     bool            // 数据连接两个方向使用由随机iv派生的不同iv
+	Grace       int64           // 等待超时后保留的秒数，期间不回收
+	SlotWait    time.Duration   // 等待对接的连接已满时新连接等待空位的时间，0不等待
+	IdleTimeout time.Duration   // 转发连接空闲超时，0不限制
+	MaxLifetime time.Duration   // 转发连接最长存活时间，0不限制
+	Intercept   []Interceptor   // 转发路径上的拦截器
+	Limit       *connLimiter    // 并发连接数与接受速率限制，为nil不限制
+	Bandwidth   *bandwidth      // 带宽限制，为nil不限制
+	Share       *fairShare      // 在服务端全局带宽中的份额，为nil不限制
+	Stats       *PortStats      // 端口的累计统计
+	ProxyAddr   bool            // NEWSOCKET_PROXY携带访问者地址，客户端发送PROXY协议头
+	Compress    bool            // 数据连接压缩
+	Assigned    bool            // 端口由临时端口池分配，关闭时归还
+	tee         atomic.Value    // *Tee 调试用的数据复制
+	Listener    net.Listener
+	cancel      context.CancelFunc // 关闭该端口
+	WaitWorker  []*Worker          // 工作负载，长度为等待对接的连接数量上限
+	Spares      chan net.Conn      // 客户端预先建立的备用数据连接，映射未开启spare时为nil
+	SpareAuth   *spareAuth         // 校验备用连接属于该会话，会话未经挑战认证时为nil
+	closeOnce   sync.Once
+	freed       chan struct{} // 有空位时关闭，通知等待空位的新连接
+	Running     bool
+	mu          sync.Mutex // 工作负载锁
+}
+
+// ControlWriter 控制连接写队列，所有命令由单独的协程写出，避免客户端不读取时阻塞Accept
+type ControlWriter struct {
+	conn  net.Conn
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewControlWriter 创建写队列，调用Run后才开始写出
+func NewControlWriter(conn net.Conn, size int) *ControlWriter {
+	if size <= 0 {
+		size = ControlQueueSize
+	}
+	return &ControlWriter{
+		conn:  conn,
+		queue: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+}
+
+// Run 依次写出队列中的命令
+func (w *ControlWriter) Run() {
+	for {
+		select {
+		case b := <-w.queue:
+			if _, err := w.conn.Write(b); err != nil {
+				w.Close()
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Send 命令入队，队列已满或已关闭时返回false
+func (w *ControlWriter) Send(b []byte) bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	select {
+	case w.queue <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 停止写出并关闭控制连接
+func (w *ControlWriter) Close() {
+	w.once.Do(func() {
+		close(w.done)
+		w.conn.Close()
+	})
 }
 
 // 新连接
 func (r *Resource) NewConn(conn net.Conn) (bool, uint8) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	return r.newConn(conn)
+}
+
+// WaitConn 等待对接的连接已满时最多等待d，期间有连接被取走或回收就重试，ctx取消时放弃
+func (r *Resource) WaitConn(ctx context.Context, conn net.Conn, d time.Duration) (bool, uint8) {
+	if d <= 0 {
+		return r.NewConn(conn)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		r.mu.Lock()
+		if ok, id := r.newConn(conn); ok {
+			r.mu.Unlock()
+			return ok, id
+		}
+		if r.freed == nil {
+			r.freed = make(chan struct{})
+		}
+		freed := r.freed
+		r.mu.Unlock()
+		select {
+		case <-freed:
+		case <-timer.C:
+			// 期间可能有连接超时，最后再试一次
+			return r.NewConn(conn)
+		case <-ctx.Done():
+			return false, 0
+		}
+	}
+}
+
+// release 通知等待空位的新连接，调用时须持有锁
+func (r *Resource) release() {
+	if r.freed != nil {
+		close(r.freed)
+		r.freed = nil
+	}
+}
+
+func (r *Resource) newConn(conn net.Conn) (bool, uint8) {
 	for i, v := range r.WaitWorker {
 		if v == nil {
 			r.WaitWorker[i] = &Worker{
@@ -107,8 +781,8 @@ func (r *Resource) NewConn(conn net.Conn) (bool, uint8) {
 			}
 			return true, uint8(i)
 		}
-		// 超时
-		if time.Now().Unix() > v.LastTime {
+		// 超时且超过宽限期
+		if time.Now().Unix() > v.LastTime+r.Grace {
 			v.Conn.Close()
 			r.WaitWorker[i] = &Worker{
 				Conn:     conn,
@@ -120,323 +794,3007 @@ func (r *Resource) NewConn(conn net.Conn) (bool, uint8) {
 	return false, 0
 }
 
-// DoServer 服务端处理
-func DoServer(config *ServerConfig) {
+// reap 关闭超时且超过宽限期的等待连接，归还其占用的并发数
+func (r *Resource) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, v := range r.WaitWorker {
+		if v != nil && time.Now().Unix() > v.LastTime+r.Grace {
+			v.Conn.Close()
+			r.WaitWorker[i] = nil
+			r.release()
+		}
+	}
+}
+
+// Tee 当前的数据复制，未开启时为nil
+func (r *Resource) Tee() *Tee {
+	t, _ := r.tee.Load().(*Tee)
+	return t
+}
+
+// SetTee 开启数据复制，替换已有的复制
+func (r *Resource) SetTee(t *Tee) {
+	r.mu.Lock()
+	old := r.Tee()
+	r.tee.Store(t)
+	r.mu.Unlock()
+	if old != nil {
+		old.Stop()
+	}
+}
+
+// clearTee 复制停止后移除
+func (r *Resource) clearTee(t *Tee) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Tee() == t {
+		r.tee.Store((*Tee)(nil))
+	}
+}
+
+// Take 取出等待中的连接用于对接，取出后超时清理不会再关闭该连接
+func (r *Resource) Take(id uint8) *Worker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if int(id) >= len(r.WaitWorker) {
+		return nil
+	}
+	wk := r.WaitWorker[id]
+	if wk == nil {
+		return nil
+	}
+	r.WaitWorker[id] = nil
+	r.release()
+	if wk.LastTime+r.Grace < time.Now().Unix() {
+		// 超时
+		wk.Conn.Close()
+		return nil
+	}
+	return wk
+}
+
+// killTokenOK KILL携带的口令是否正确，want为空则不校验；按常量时间比较，不泄露匹配的长度
+func killTokenOK(token []byte, want string) bool {
+	return want == "" || subtle.ConstantTimeCompare(token, []byte(want)) == 1
+}
+
+// DoServer 服务端处理，ctx取消后停止监听并返回；无法启动时返回错误
+func DoServer(ctx context.Context, config *ServerConfig) error {
 	if config == nil {
-		return
+		return nil
+	}
+	var waitMax = WaitMax
+	if config.WaitMax > 0 {
+		waitMax = config.WaitMax
+	}
+	if waitMax > WaitLimit {
+		return fmt.Errorf("server initialization error: wait_max must not exceed %v", WaitLimit)
+	}
+	var slotWait = WaitSlot
+	if config.WaitSlot != 0 {
+		slotWait = time.Duration(config.WaitSlot) * time.Millisecond
+	}
+	if config.MaxConns < 0 || config.AcceptRate < 0 {
+		return errors.New("server initialization error: max_conns and accept_rate must not be negative")
 	}
-	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", config.Port))
+	// 转发缓冲大小只作用于本服务端，同一进程中的其他实例不受影响
+	var bufSize = encrypto.BufferSize
+	if config.BufferSize > 0 {
+		bufSize = config.BufferSize
+	}
+	muxWin, err := muxWindow(config.MuxWindow)
 	if err != nil {
-		log.Println("Initialization error", err)
-		return
+		return fmt.Errorf("server initialization error: %v", err)
+	}
+	// 最近事件，通过管理接口查看
+	var events = NewEventLog(config.Events)
+	var adminMux = http.NewServeMux()
+	adminMux.Handle("/events", events)
+	// 外网端口终止TLS使用的证书
+	var tlsConfig *tls.Config
+	if config.TLSCert != "" || config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return fmt.Errorf("server initialization error: %v", err)
+		}
+		tlsConfig = newTLSConfig()
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.ControlTLS && tlsConfig == nil {
+		return errors.New("server initialization error: control_tls requires tls_cert and tls_key")
+	}
+	if config.ControlFallback != "" && !config.ControlTLS {
+		return errors.New("server initialization error: control_fallback requires control_tls")
+	}
+	// 多密钥配置
+	var keyStore *KeyStore
+	if config.AuthFile != "" {
+		var err error
+		keyStore, err = LoadKeyStore(config.AuthFile)
+		if err != nil {
+			return fmt.Errorf("server initialization error: %v", err)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for range hup {
+				if err := keyStore.Reload(); err != nil {
+					events.Println("error", "Reload auth file failed", err)
+				} else {
+					events.Println("auth", "Reload auth file", config.AuthFile)
+				}
+			}
+		}()
+	}
+	audit, err := lookupAuditHooks(config.Audit, events)
+	if err != nil {
+		return fmt.Errorf("server initialization error: %v", err)
+	}
+	shared, err := newFairLimit(config.Bandwidth, config.BandwidthIn, config.BandwidthOut)
+	if err != nil {
+		return fmt.Errorf("server initialization error: %v", err)
+	}
+	var ephemeral = newPortPool(config.EphemeralPorts)
+	var lc = listenConfig(config.ReusePort)
+	lc.KeepAlive = keepAlivePeriod(config.KeepAlive)
+	// 映射端口不设置SO_REUSEPORT，否则其他客户端可以绑定已映射的端口
+	var plc = &net.ListenConfig{KeepAlive: lc.KeepAlive}
+	if config.FastOpen {
+		lc = fastOpenListen(lc)
+		plc = fastOpenListen(plc)
+	}
+	var bind = config.Bind
+	if bind == "" {
+		bind = BindAll
+	}
+	lis, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(bind, strconv.Itoa(int(config.Port))))
+	if err != nil {
+		return fmt.Errorf("server initialization error: %v", err)
 	}
 	defer lis.Close()
+	var controlTLS *tls.Config
+	if config.ControlTLS {
+		controlTLS = controlTLSConfig(tlsConfig)
+	}
+	if config.ControlTLS && config.ControlFallback == "" {
+		// 握手在doconn首次读取时进行，受dataTimeout限制
+		lis = tls.NewListener(lis, controlTLS)
+	}
+	if config.Admin != "" {
+		if err := startAdmin(config.Admin, adminMux); err != nil {
+			return fmt.Errorf("server initialization error: %v", err)
+		}
+	}
 	// 端口-资源对应
 	var resourceMap = make(map[uint16]*Resource)
 	var resourceMu sync.Mutex
-	// 处理对客户端的监听
-	var dolisten = func(ctx context.Context, cconn net.Conn, port uint16) {
-		if resourceMap[port] == nil {
+	// 各端口的流量与连接统计
+	var portStats PortStatsMap
+	var waiting = func(port uint16) (int, int, bool) {
+		resourceMu.Lock()
+		rs := resourceMap[port]
+		resourceMu.Unlock()
+		if rs == nil {
+			return 0, 0, false
+		}
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		var n int
+		for _, v := range rs.WaitWorker {
+			if v != nil {
+				n++
+			}
+		}
+		return n, len(rs.WaitWorker), true
+	}
+	adminMux.HandleFunc("/ports", portsHandler(&portStats, waiting, ephemeral))
+	adminMux.HandleFunc("/metrics", metricsHandler(&portStats, waiting))
+	// 调试用的数据复制，只允许本机开启
+	adminMux.HandleFunc("/tee", func(w http.ResponseWriter, r *http.Request) {
+		if !localOnly(w, r) {
 			return
 		}
-		defer func() {
-			Recover()
-			defer Recover()
-			rs := resourceMap[port]
-			if rs == nil {
+		pt, err := strconv.ParseUint(r.FormValue("port"), 10, 16)
+		if err != nil {
+			http.Error(w, "bad port", http.StatusBadRequest)
+			return
+		}
+		resourceMu.Lock()
+		rsc := resourceMap[uint16(pt)]
+		resourceMu.Unlock()
+		if rsc == nil {
+			http.Error(w, "port is not mapped", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			limit, _ := strconv.ParseInt(r.FormValue("max_bytes"), 10, 64)
+			d, _ := time.ParseDuration(r.FormValue("duration"))
+			dir := r.FormValue("dir")
+			if dir == "" {
+				dir = TeeBoth
+			}
+			t, err := NewTee(uint16(pt), r.FormValue("target"), dir, limit, d, rsc.clearTee)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			for _, v := range rs.WaitWorker {
-				if v != nil && v.Conn != nil {
-					v.Conn.Close()
-				}
+			rsc.SetTee(t)
+			events.Add(LevelInfo, "server", fmt.Sprintf("Tee enabled on port %v to %v", pt, t.Target))
+		case http.MethodDelete:
+			if t := rsc.Tee(); t != nil {
+				t.Stop()
 			}
-			rs.Listener.Close()
+		case http.MethodGet:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if t := rsc.Tee(); t != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"port": t.Port, "target": t.Target, "dir": t.Dir})
+		} else {
+			json.NewEncoder(w).Encode(nil)
+		}
+	})
+	// 平滑重启：在线客户端与已对接的连接
+	var draining int32
+	var sessions = make(map[*ControlWriter]string) // 在线客户端及其密钥
+	var sessionMu sync.Mutex
+	var sessionWg, active sync.WaitGroup
+	// 退出时置位，之后不再对接新的连接；与active.Add同在activeMu下，Wait开始后不会再增加
+	var activeMu sync.Mutex
+	var stopped bool
+	// startForward 在active中登记对接的两个方向，退出中返回false
+	var startForward = func() bool {
+		activeMu.Lock()
+		defer activeMu.Unlock()
+		if stopped || ctx.Err() != nil {
+			return false
+		}
+		active.Add(2)
+		return true
+	}
+	// waitActive 不再对接新的连接，等待已对接的连接结束
+	var waitActive = func(d time.Duration) bool {
+		activeMu.Lock()
+		stopped = true
+		activeMu.Unlock()
+		if d < 0 {
+			active.Wait()
+			return true
+		}
+		return waitTimeout(&active, d)
+	}
+	// 断开使用该密钥的在线客户端，返回断开的数量
+	var disconnect = func(key string) int {
+		sessionMu.Lock()
+		defer sessionMu.Unlock()
+		var n int
+		for cw, k := range sessions {
+			if k == key {
+				cw.Close()
+				n++
+			}
+		}
+		return n
+	}
+	// 已对接的转发连接
+	var forwards = NewForwardTable(time.Duration(config.RateInterval) * time.Second)
+	adminMux.Handle("/forwards", forwards)
+	if sig := restartSignal(); config.ReusePort && sig != nil {
+		rs := make(chan os.Signal, 1)
+		signal.Notify(rs, sig)
+		go func() {
+			<-rs
+			events.Println("server", "Draining for restart")
+			atomic.StoreInt32(&draining, 1)
+			lis.Close()
+			// 映射端口不与新进程共用，停止监听后新进程才能绑定；已对接的连接不受影响
 			resourceMu.Lock()
-			delete(resourceMap, port)
+			for _, rs := range resourceMap {
+				rs.Listener.Close()
+			}
 			resourceMu.Unlock()
-			log.Println("Close port:", port)
+			sessionMu.Lock()
+			for cw := range sessions {
+				cw.Send([]byte{RECONNECT})
+			}
+			sessionMu.Unlock()
 		}()
-		log.Println("Open port:", port)
-		var rsc = resourceMap[port]
-		go func() {
-			defer Recover()
-			for {
-				outcon, err := rsc.Listener.Accept()
+	}
+	// 运行时注册与吊销密钥，只允许本机操作
+	if keyStore != nil {
+		adminMux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+			if !localOnly(w, r) {
+				return
+			}
+			switch r.Method {
+			case http.MethodPost:
+				var req struct {
+					Key string `json:"key"`
+					KeyConfig
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				kc := req.KeyConfig
+				if err := keyStore.Add(req.Key, &kc); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				events.Println("auth", "Registered key", kc.name())
+			case http.MethodDelete:
+				key := r.FormValue("key")
+				kc, _ := keyStore.Get(key)
+				ok, err := keyStore.Revoke(key)
 				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
-				// 通知客户端建立连接
-				ok, id := rsc.NewConn(outcon)
-				if ok {
-					var buffer bytes.Buffer
-					buffer.Write([]byte{NEWSOCKET})
-					buffer.Write([]byte{uint8(port >> 8), uint8(port & 0xff)})
-					buffer.Write([]byte{id})
-					opencmd := buffer.Bytes()
-					buffer.Reset()
-					cconn.Write(opencmd)
-				} else {
-					outcon.Close()
+				if !ok {
+					http.Error(w, "key not found", http.StatusNotFound)
+					return
 				}
-
+				// 断开使用该密钥的在线客户端，已对接的转发连接不随控制连接关闭，同/close一并关闭
+				sessions := disconnect(key)
+				closed := forwards.Close(key, 0)
+				events.Println("auth", fmt.Sprintf("Revoked key %v, closed %v connections and %v sessions", kc.name(), closed, sessions))
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			}
-		}()
-		<-ctx.Done()
+		})
 	}
-	// 处理客户端新连接
-	var doconn = func(conn net.Conn) {
-		defer Recover()
-		var cmd = make([]byte, 1)
-		if _, err = io.ReadAtLeast(conn, cmd, 1); err != nil {
-			conn.Close()
+	// 强制断开某个密钥或端口的全部转发连接，可同时断开控制连接、吊销密钥，只允许本机操作
+	adminMux.HandleFunc("/close", func(w http.ResponseWriter, r *http.Request) {
+		if !localOnly(w, r) {
 			return
 		}
-		switch cmd[0] {
-		case START:
-			defer conn.Close()
-			// 初始化
-			// START info_len info
-			info_len := make([]byte, 8)
-			if _, err = io.ReadAtLeast(conn, info_len, 8); err != nil {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key := r.FormValue("key")
+		var port uint16
+		if v := r.FormValue("port"); v != "" {
+			pt, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				http.Error(w, "bad port", http.StatusBadRequest)
 				return
 			}
-			var ilen = (uint64(info_len[0]) << 56) | (uint64(info_len[1]) << 48) | (uint64(info_len[2]) << 40) | (uint64(info_len[3]) << 32) | (uint64(info_len[4]) << 24) | (uint64(info_len[5]) << 16) | (uint64(info_len[6]) << 8) | (uint64(info_len[7]))
-			if ilen > 1024*1024 {
-				// 限制消息最大内存使用量 1M
+			port = uint16(pt)
+		}
+		if key == "" && port == 0 {
+			http.Error(w, "key or port is required", http.StatusBadRequest)
+			return
+		}
+		revoke := r.FormValue("revoke") == "1"
+		if (revoke || r.FormValue("disconnect") == "1") && key == "" {
+			http.Error(w, "disconnect and revoke require key", http.StatusBadRequest)
+			return
+		}
+		var result struct {
+			Closed   int  `json:"closed"`
+			Sessions int  `json:"sessions"`
+			Revoked  bool `json:"revoked"`
+		}
+		if revoke {
+			if keyStore == nil {
+				http.Error(w, "revoke requires auth_file", http.StatusBadRequest)
 				return
 			}
-			var clinfo = make([]byte, ilen)
-			if _, err = io.ReadAtLeast(conn, clinfo, int(ilen)); err != nil {
+			// 先吊销，防止客户端在断开后立即重连
+			ok, err := keyStore.Revoke(key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			var clicfg ClientConfig
-			if nil != json.Unmarshal(clinfo, &clicfg) {
-				return
+			result.Revoked = ok
+		}
+		if revoke || r.FormValue("disconnect") == "1" {
+			result.Sessions = disconnect(key)
+		}
+		result.Closed = forwards.Close(key, port)
+		name := fmt.Sprint("port ", port)
+		if key != "" {
+			var kc *KeyConfig
+			if keyStore != nil {
+				kc, _ = keyStore.Get(key)
 			}
-			if clicfg.Key != config.Key {
-				conn.Write([]byte{ERROR_PWD})
+			name = kc.name()
+			if port != 0 {
+				name = fmt.Sprint(name, " port ", port)
+			}
+		}
+		events.Println("auth", fmt.Sprintf("Admin closed %v connections and %v sessions of %v, revoked: %v",
+			result.Closed, result.Sessions, name, result.Revoked))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+	var dataTimeout = DataTimeOut
+	if config.DataTimeout > 0 {
+		dataTimeout = time.Duration(config.DataTimeout) * time.Second
+	}
+	// 处理客户端新连接，多路复用连接的每个流与备用连接也由此处理
+	var doconn func(conn net.Conn)
+	// 在备用连接上通知客户端，客户端随后在该连接上发送NEWCONN；备用连接已断开时改由控制连接通知
+	var useSpare = func(spare net.Conn, cw *ControlWriter, opencmd []byte) {
+		defer Recover()
+		first := make([]byte, 1)
+		spare.SetReadDeadline(time.Now().Add(dataTimeout))
+		_, err := spare.Write(opencmd)
+		if err == nil {
+			_, err = io.ReadFull(spare, first)
+		}
+		if err != nil || first[0] != NEWCONN {
+			spare.Close()
+			if !cw.Send(opencmd) {
+				cw.Close()
+			}
+			return
+		}
+		doconn(newPeekConn(spare, first))
+	}
+	// 处理对客户端的监听
+	// 关闭端口的监听与等待中的连接并移除端口，只移除rs自己，端口可能已被新会话重新打开；可重复调用
+	var closePort = func(port uint16, rs *Resource) {
+		rs.closeOnce.Do(func() {
+			defer Recover()
+			rs.cancel()
+			rs.Listener.Close()
+			rs.mu.Lock()
+			for i, v := range rs.WaitWorker {
+				if v != nil && v.Conn != nil {
+					v.Conn.Close()
+				}
+				rs.WaitWorker[i] = nil
+			}
+			rs.mu.Unlock()
+			if t := rs.Tee(); t != nil {
+				t.Stop()
+			}
+			resourceMu.Lock()
+			if resourceMap[port] == rs {
+				delete(resourceMap, port)
+			}
+			resourceMu.Unlock()
+			if rs.Assigned {
+				ephemeral.Release(port)
+			}
+			// 移除后再关闭备用连接，之后加入的由SPARE处理时关闭
+			for len(rs.Spares) > 0 {
+				(<-rs.Spares).Close()
+			}
+			events.Println("port", "Close port:", port)
+		})
+	}
+	// 处理对客户端的监听
+	var dolisten = func(ctx context.Context, cw *ControlWriter, port uint16, rsc *Resource) {
+		defer closePort(port, rsc)
+		events.Println("port", "Open port:", port)
+		// 处理外网新连接，控制连接无法写入时返回false
+		var handle = func(outcon net.Conn) bool {
+			if rsc.Schedule != nil && !rsc.Schedule.Open(time.Now()) {
+				outcon.Close()
+				return true
+			}
+			var dst string
+			if rsc.Transparent {
+				// 原始目标地址要从接受的TCP连接上读取，须在包装审计等连接之前
+				var err error
+				if dst, err = originalDst(baseConn(outcon)); err != nil || len(dst) > 0xff {
+					events.Println("error", "Can't get original destination", port, err)
+					outcon.Close()
+					return true
+				}
+			}
+			var ac *auditConn
+			if len(audit) > 0 {
+				// 在最内层记录访问者，随等待对接的连接到NEWCONN，关闭时发出close事件
+				ac = newAuditConn(outcon, audit, port)
+				outcon = ac
+			}
+			if rsc.Forward != "" {
+				fc, err := acceptForward(outcon, rsc.Forward, WaitTimeOut+time.Duration(rsc.Grace)*time.Second)
+				if err != nil {
+					events.Warnln("conn", "Bad forward proxy request", port, outcon.RemoteAddr(), err)
+					outcon.Close()
+					return true
+				}
+				dst, outcon = fc.dst, fc
+			}
+			var proto uint8 = DetectDefault
+			if len(rsc.Detect) > 0 {
+				proto, outcon = detectProto(outcon, rsc.Detect)
+			}
+			// 通知客户端建立连接
+			// 已满时短暂等待空位，客户端对接很快，突发连接不必直接关闭
+			ok, id := rsc.WaitConn(ctx, outcon, rsc.SlotWait)
+			if ok {
+				ac.Open(id)
+				var buffer bytes.Buffer
+				if rsc.ProxyAddr {
+					buffer.Write([]byte{NEWSOCKET_PROXY})
+				} else {
+					buffer.Write([]byte{NEWSOCKET})
+				}
+				buffer.Write([]byte{uint8(port >> 8), uint8(port & 0xff)})
+				buffer.Write([]byte{id})
+				if rsc.Transparent || rsc.Forward != "" {
+					// NEWSOCKET port id dst_len dst
+					buffer.Write([]byte{uint8(len(dst))})
+					buffer.WriteString(dst)
+				}
+				if len(rsc.Detect) > 0 {
+					// NEWSOCKET port id [dst_len dst] proto
+					buffer.Write([]byte{proto})
+				}
+				if rsc.ProxyAddr {
+					// NEWSOCKET_PROXY port id [dst_len dst] [proto] src_len src local_len local
+					for _, addr := range []string{outcon.RemoteAddr().String(), outcon.LocalAddr().String()} {
+						buffer.Write([]byte{uint8(len(addr))})
+						buffer.WriteString(addr)
+					}
+				}
+				opencmd := buffer.Bytes()
+				buffer.Reset()
+				select {
+				case spare := <-rsc.Spares:
+					// 有备用连接时不经过控制连接，客户端不必新建数据连接
+					go useSpare(spare, cw, opencmd)
+					return true
+				default:
+				}
+				if !cw.Send(opencmd) {
+					// 客户端不再读取控制连接，断开客户端
+					events.Println("error", "Client is not draining control connection, closing", port)
+					cw.Close()
+					return false
+				}
+			} else {
+				atomic.AddInt64(&rsc.Stats.RejectedWait, 1)
+				events.Warnln("conn", "Too many connections waiting on port", port, "rejected", outcon.RemoteAddr(), "increase wait_max or wait_slot")
+				outcon.Close()
+			}
+			return true
+		}
+		if rsc.Schedule != nil {
+			// 记录开放与关闭的切换
+			go func() {
+				open := rsc.Schedule.Open(time.Now())
+				events.Println("port", "Port", port, "schedule open:", open)
+				t := time.NewTicker(ScheduleCheck)
+				defer t.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case now := <-t.C:
+						if o := rsc.Schedule.Open(now); o != open {
+							open = o
+							events.Println("port", "Port", port, "schedule open:", open)
+						}
+					}
+				}
+			}()
+		}
+		if rsc.Limit != nil || rsc.ClientLimit != nil {
+			// 汇总记录拒绝的连接，端口饱和时不逐个记录
+			go func() {
+				t := time.NewTicker(SaturatedLogInterval)
+				defer t.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-t.C:
+						if rsc.Limit != nil {
+							if rate, conns := rsc.Limit.Rejected(); rate+conns > 0 {
+								events.Warnln("conn", fmt.Sprintf("Port %v is saturated, rejected %v connections over accept_rate and %v over max_conns",
+									port, rate, conns))
+							}
+						}
+						if rsc.ClientLimit != nil {
+							// 客户端的全部端口共享，先取到计数的端口记录
+							if _, conns := rsc.ClientLimit.Rejected(); conns > 0 {
+								events.Warnln("conn", fmt.Sprintf("Client of port %v is saturated, rejected %v connections over client_max_conns",
+									port, conns))
+							}
+						}
+					}
+				}
+			}()
+		}
+		go func() {
+			defer Recover()
+			for {
+				outcon, err := rsc.Listener.Accept()
+				if err != nil {
+					return
+				}
+				if rsc.Limit != nil {
+					conn, ok := rsc.Limit.Accept(outcon, rsc.reap)
+					if !ok {
+						atomic.AddInt64(&rsc.Stats.RejectedLimit, 1)
+						outcon.Close()
+						continue
+					}
+					outcon = conn
+				}
+				if rsc.ClientLimit != nil {
+					conn, ok := rsc.ClientLimit.Accept(outcon, rsc.reap)
+					if !ok {
+						atomic.AddInt64(&rsc.Stats.RejectedLimit, 1)
+						outcon.Close()
+						continue
+					}
+					outcon = conn
+				}
+				if rsc.TLSCheck != nil || len(rsc.Detect) > 0 || rsc.Forward != "" {
+					// 校验ClientHello、识别协议与读取代理请求需要等待数据，不阻塞Accept
+					go func() {
+						defer Recover()
+						if rsc.TLSCheck != nil {
+							hello, pconn, err := peekClientHello(outcon)
+							if cerr := rsc.TLSCheck.Check(hello); cerr != nil {
+								if err != nil {
+									cerr = fmt.Errorf("%v: %v", cerr, err)
+								}
+								events.Warnln("conn", "Unexpected TLS client hello", port, outcon.RemoteAddr(), cerr)
+								if !rsc.TLSCheck.LogOnly {
+									outcon.Close()
+									return
+								}
+							}
+							outcon = pconn
+						}
+						handle(outcon)
+					}()
+					continue
+				}
+				if !handle(outcon) {
+					return
+				}
+			}
+		}()
+		<-ctx.Done()
+	}
+	if len(config.Banner) > BannerMax {
+		logger.Warnf("Banner is longer than %v bytes, truncated", BannerMax)
+		config.Banner = config.Banner[:BannerMax]
+	}
+	var sampler = NewLogSampler(config.LogSample, config.LogBytes, time.Duration(config.LogDuration)*time.Second)
+	var maxSkew = MaxClockSkew
+	if config.MaxSkew != 0 {
+		maxSkew = time.Duration(config.MaxSkew) * time.Second
+	}
+	filter, err := newIPFilter(config.ControlAllow, config.ControlDeny)
+	if err != nil {
+		return fmt.Errorf("server initialization error: control_allow/control_deny: %v", err)
+	}
+	var banTime = BanTime
+	if config.BanTime > 0 {
+		banTime = time.Duration(config.BanTime) * time.Second
+	}
+	var bans = newAuthBans(config.BanAfter, banTime)
+	if bans != nil {
+		go func() {
+			t := time.NewTicker(time.Minute)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+					bans.Prune()
+				}
+			}
+		}()
+	}
+	// 记录认证失败，达到次数时封禁该IP
+	var authFailed = func(conn net.Conn) {
+		if ip := remoteIP(conn); bans.Fail(ip) {
+			events.Warnln("auth", "Banned", ip, "for", banTime, "after", config.BanAfter, "failed logins")
+		}
+	}
+	// 记录无法解析的握手，便于发现扫描控制端口的连接
+	var malformed = func(conn net.Conn, reason string, err error) {
+		if err != nil {
+			reason = fmt.Sprintf("%v: %v", reason, err)
+		}
+		events.Warnln("auth", "Malformed handshake from", conn.RemoteAddr(), reason)
+	}
+	doconn = func(conn net.Conn) {
+		defer Recover()
+		var cmd = make([]byte, 1)
+		// 连接后须及时发送命令，防止慢速连接占用协程
+		conn.SetReadDeadline(time.Now().Add(dataTimeout))
+		if _, err := io.ReadAtLeast(conn, cmd, 1); err != nil {
+			conn.Close()
+			return
+		}
+		if _, ok := conn.(*muxStream); ok && cmd[0] != NEWCONN {
+			// 流只用于数据连接
+			conn.Close()
+			return
+		}
+		var nonce []byte
+		switch cmd[0] {
+		case AUTH:
+			// AUTH -> nonce，之后客户端发送带应答的START
+			n, err := newAuthNonce()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			nonce = n
+			if _, err := conn.Write(nonce); err != nil {
+				conn.Close()
+				return
+			}
+			if _, err := io.ReadAtLeast(conn, cmd, 1); err != nil || cmd[0] != START {
+				if err == nil {
+					err = fmt.Errorf("unexpected command %#02x", cmd[0])
+				}
+				malformed(conn, "no START after AUTH", err)
+				conn.Close()
+				return
+			}
+			fallthrough
+		case START:
+			defer conn.Close()
+			// 配置须在超时前发送完，防止声明了长度却不发送数据的连接占用协程
+			conn.SetReadDeadline(time.Now().Add(HandshakeTimeOut))
+			// 初始化
+			// START version info_len info
+			// 旧版客户端不发送版本，info_len不超过HandshakeMax，第一个字节为0，按版本0处理
+			info_len := make([]byte, 8)
+			if _, err := io.ReadFull(conn, info_len[:1]); err != nil {
+				malformed(conn, "short START header", err)
+				return
+			}
+			var version uint8
+			if info_len[0] != 0 {
+				version = info_len[0]
+				if version > ProtocolVersion {
+					events.Warnln("auth", "Unsupported protocol version", version, "from", conn.RemoteAddr())
+					// ERROR_VERSION version
+					conn.Write([]byte{ERROR_VERSION, ProtocolVersion})
+					return
+				}
+				if _, err := io.ReadFull(conn, info_len[:1]); err != nil {
+					malformed(conn, "short START header", err)
+					return
+				}
+			}
+			if _, err := io.ReadFull(conn, info_len[1:]); err != nil {
+				malformed(conn, "short START header", err)
+				return
+			}
+			var ilen = (uint64(info_len[0]) << 56) | (uint64(info_len[1]) << 48) | (uint64(info_len[2]) << 40) | (uint64(info_len[3]) << 32) | (uint64(info_len[4]) << 24) | (uint64(info_len[5]) << 16) | (uint64(info_len[6]) << 8) | (uint64(info_len[7]))
+			if ilen > HandshakeMax {
+				// 限制消息最大内存使用量
+				malformed(conn, fmt.Sprintf("config length %v exceeds %v bytes", ilen, HandshakeMax), nil)
+				return
+			}
+			var clinfo = make([]byte, ilen)
+			if _, err := io.ReadFull(conn, clinfo); err != nil {
+				malformed(conn, fmt.Sprintf("config shorter than %v bytes", ilen), err)
+				return
+			}
+			var clicfg ClientConfig
+			// 旧版客户端在START中发送的配置也是旧写法
+			if err := json.Unmarshal(legacyKeys(clinfo), &clicfg); err != nil {
+				malformed(conn, "invalid config near "+configPreview(clinfo, err), err)
+				conn.Write([]byte{ERROR_BADCONFIG})
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			// 旧版客户端不发送时间，不校验
+			if clicfg.Time != 0 && maxSkew >= 0 {
+				skew := time.Since(time.Unix(clicfg.Time, 0))
+				if skew > maxSkew || skew < -maxSkew {
+					events.Warnln("auth", "Clock skew too large from", conn.RemoteAddr(), skew.Round(time.Second))
+					conn.Write([]byte{ERROR_CLOCK})
+					return
+				}
+			}
+			if nonce != nil {
+				// 按应答找到对应的密钥，之后与明文key的流程相同
+				clicfg.Key = ""
+				if keyStore != nil {
+					clicfg.Key = keyStore.Match(nonce, clicfg.Proof)
+				} else if checkProof(config.Key, nonce, clicfg.Proof) {
+					clicfg.Key = config.Key
+				}
+			} else if config.HMACOnly {
+				events.Warnln("auth", "Plaintext key rejected from", conn.RemoteAddr())
+				conn.Write([]byte{ERROR_PWD})
+				return
+			}
+			// 端口范围、映射数量与流量配额
+			var limitPort = config.LimitPort
+			var maxMappings = config.MaxMappings
+			var clientMaxConns = config.ClientMaxConns
+			var used *int64
+			var quota int64
+			var memory = config.ClientMemory
+			// 多密钥时为密钥名称，用于统计
+			var client string
+			if keyStore != nil {
+				kc, u := keyStore.Get(clicfg.Key)
+				if kc == nil {
+					events.Warnln("auth", "Wrong password from", conn.RemoteAddr())
+					authFailed(conn)
+					conn.Write([]byte{ERROR_PWD})
+					return
+				}
+				client = kc.name()
+				if kc.TOTPSecret != "" && !VerifyTOTP(kc.TOTPSecret, clicfg.TOTP, time.Now()) {
+					events.Warnln("auth", "Wrong TOTP code for", kc.name(), "from", conn.RemoteAddr())
+					authFailed(conn)
+					conn.Write([]byte{ERROR_TOTP})
+					return
+				}
+				if len(kc.PortRange) == 2 {
+					limitPort = PortSet{{kc.PortRange[0], kc.PortRange[1]}}
+				}
+				if kc.QuotaBytes > 0 && atomic.LoadInt64(u) >= kc.QuotaBytes {
+					events.Warnln("auth", "Quota exceeded for", kc.name())
+					conn.Write([]byte{ERROR_QUOTA})
+					return
+				}
+				used, quota = u, kc.QuotaBytes
+				memory = kc.MemoryBytes
+				if kc.MaxMappings > 0 {
+					maxMappings = kc.MaxMappings
+				}
+				if kc.MaxConns > 0 {
+					clientMaxConns = kc.MaxConns
+				}
+			} else if subtle.ConstantTimeCompare([]byte(clicfg.Key), []byte(config.Key)) != 1 {
+				events.Warnln("auth", "Wrong password from", conn.RemoteAddr())
+				authFailed(conn)
+				conn.Write([]byte{ERROR_PWD})
+				return
+			}
+			if maxMappings > 0 && len(clicfg.Map) > maxMappings {
+				events.Warnln("auth", fmt.Sprintf("Too many mappings from %v: %v > %v", conn.RemoteAddr(), len(clicfg.Map), maxMappings))
+				// ERROR_MAPPINGS max
+				conn.Write([]byte{ERROR_MAPPINGS, uint8(maxMappings >> 8), uint8(maxMappings)})
+				return
+			}
+			switch clicfg.Cipher {
+			case "", encrypto.CipherCTR, encrypto.CipherGCM:
+			default:
+				events.Println("error", "Unknown cipher", clicfg.Cipher, "from", conn.RemoteAddr())
+				conn.Write([]byte{ERROR})
+				return
+			}
+			// 数据连接的key与iv，KDF较慢，每个会话只计算一次
+			cryptKey, cryptIV := encrypto.GetKeyIv(clicfg.Key)
+			if clicfg.KDFSalt != "" {
+				if clicfg.KDFSalt != config.KDFSalt {
+					events.Warnln("auth", "KDF salt mismatch from", conn.RemoteAddr())
+					conn.Write([]byte{ERROR_KDF})
+					return
+				}
+				cryptKey, cryptIV = encrypto.GetKeyIvKDF(clicfg.Key, clicfg.KDFSalt)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			budget := newMemoryBudget(memory, bufSize)
+			// 经挑战认证的会话才能建立备用连接
+			var sauth *spareAuth
+			if nonce != nil {
+				sauth = newSpareAuth(clicfg.Key, nonce)
+			}
+			// 全部端口共享，超出后新的外网连接直接关闭
+			clientLimit := newConnLimiter(clientMaxConns, 0)
+			// SUCCESS发出前的命令在队列中等待
+			cw := NewControlWriter(conn, config.ControlQueue)
+			defer cw.Close()
+			// 本会话打开的端口，控制连接断开时在返回前全部关闭
+			var sessionPorts = make(map[uint16]*Resource)
+			defer func() {
+				for pt, rs := range sessionPorts {
+					closePort(pt, rs)
+				}
+			}()
+			// 校验映射并打开端口，返回SUCCESS或错误码；启动时与运行时添加映射共用；
+			// opened不为nil时在端口开始接受连接前调用，其中发送的命令先于该端口的NEWSOCKET
+			var openPort = func(cc ClientMapConfig, opened func()) uint8 {
+				if cc.Outer == 0 {
+					// 临时端口只能在运行时按名称分配
+					events.Println("error", "Port 0 without assignment", cc.Name)
+					return ERROR
+				}
+				// 判断端口是否合法
+				if !limitPort.Contains(cc.Outer) {
+					// 不满足端口范围
+					events.Println("error", fmt.Sprintf("Does not meet the port range %v %v", limitPort, cc.Outer))
+					return ERROR_LIMIT_PORT
+				}
+				switch cc.Proto {
+				case "", ProtoTCP:
+				case ProtoUDP:
+					if cc.TLS || cc.TLSCheck != nil || cc.Transparent || len(cc.Detect) > 0 || cc.ProxyProtocol != 0 || cc.ForwardProxy != "" {
+						events.Println("error", "TLS, transparent, detect, proxy protocol and forward proxy are not supported for udp", cc.Outer)
+						return ERROR
+					}
+				default:
+					events.Println("error", "Unknown protocol", cc.Proto, cc.Outer)
+					return ERROR
+				}
+				if cc.TLS && tlsConfig == nil {
+					events.Println("error", "No certificate to terminate TLS", cc.Outer)
+					return ERROR_TLS
+				}
+				if cc.TLSCheck != nil {
+					if err := cc.TLSCheck.Init(); err != nil || cc.TLS {
+						events.Println("error", "Bad TLS check config", cc.Outer, err)
+						return ERROR_TLS
+					}
+				}
+				idle, err := mappingTimeout(cc.IdleTimeout, config.IdleTimeout)
+				if err != nil {
+					events.Println("error", "Bad idle timeout", cc.Outer, err)
+					return ERROR
+				}
+				lifetime, err := mappingTimeout(cc.MaxLifetime, config.MaxLifetime)
+				if err != nil {
+					events.Println("error", "Bad max lifetime", cc.Outer, err)
+					return ERROR
+				}
+				maxConns, err := mappingLimit(float64(cc.MaxConns), float64(config.MaxConns))
+				if err != nil {
+					events.Println("error", "Bad max connections", cc.Outer, err)
+					return ERROR
+				}
+				acceptRate, err := mappingLimit(cc.AcceptRate, config.AcceptRate)
+				if err != nil {
+					events.Println("error", "Bad accept rate", cc.Outer, err)
+					return ERROR
+				}
+				bw, err := newBandwidth(cc.Bandwidth, cc.BandwidthIn, cc.BandwidthOut)
+				if err != nil {
+					events.Println("error", "Bad bandwidth", cc.Outer, err)
+					return ERROR
+				}
+				if cc.Weight < 0 || cc.Weight > WeightMax {
+					events.Println("error", "Bad weight", cc.Outer, cc.Weight)
+					return ERROR
+				}
+				icpt, err := lookupInterceptors(cc.Intercept)
+				if err != nil {
+					events.Println("error", "Bad interceptor config", cc.Outer, err)
+					return ERROR
+				}
+				if cc.Schedule != nil {
+					if err := cc.Schedule.Init(); err != nil {
+						events.Println("error", "Bad schedule config", cc.Outer, err)
+						return ERROR
+					}
+				}
+				for i := range cc.Detect {
+					if err := cc.Detect[i].Validate(); err != nil || len(cc.Detect) >= DetectDefault {
+						events.Println("error", "Bad protocol detection config", cc.Outer, err)
+						return ERROR
+					}
+				}
+				if cc.ForwardProxy != "" && (!validForward(cc.ForwardProxy) || cc.Transparent || len(cc.Detect) > 0 || cc.TLSCheck != nil) {
+					events.Println("error", "Bad forward proxy config", cc.ForwardProxy, cc.Outer)
+					return ERROR
+				}
+				var addr = net.JoinHostPort(bind, strconv.Itoa(int(cc.Outer)))
+				if cc.Bind != "" {
+					if net.ParseIP(cc.Bind) == nil {
+						events.Println("error", "Bad bind address", cc.Bind, cc.Outer)
+						return ERROR
+					}
+					addr = net.JoinHostPort(cc.Bind, strconv.Itoa(int(cc.Outer)))
+				}
+				resourceMu.Lock()
+				_, mapped := resourceMap[cc.Outer]
+				resourceMu.Unlock()
+				if mapped {
+					events.Println("error", "Port is already mapped", cc.Outer)
+					return ERROR_BUSY
+				}
+				var clis net.Listener
+				if cc.Proto == ProtoUDP {
+					clis, err = listenUDP(addr, idle)
+				} else {
+					clis, err = plc.Listen(context.Background(), "tcp", addr)
+				}
+				if err != nil {
+					if !errors.Is(err, syscall.EADDRINUSE) {
+						// 如文件描述符耗尽，客户端稍后重试
+						events.Println("error", "Can't listen on port", cc.Outer, err)
+						return ERROR_RETRY
+					}
+					events.Println("error", "Port is occupied", cc.Outer)
+					return ERROR_BUSY
+				}
+				if clicfg.DryRun {
+					// 只确认端口当前可以绑定
+					clis.Close()
+					return SUCCESS
+				}
+				if cc.TLS {
+					clis = tls.NewListener(clis, tlsConfig)
+				}
+				var spares chan net.Conn
+				if cc.Spare > 0 {
+					n := cc.Spare
+					if n > SpareMax {
+						n = SpareMax
+					}
+					spares = make(chan net.Conn, n)
+				}
+				pctx, pcancel := context.WithCancel(ctx)
+				rs := &Resource{
+					Key:         clicfg.Key,
+					CryptKey:    cryptKey,
+					CryptIV:     cryptIV,
+					Used:        used,
+					Quota:       quota,
+					Transparent: cc.Transparent,
+					Forward:     cc.ForwardProxy,
+					TLSCheck:    cc.TLSCheck,
+					Detect:      cc.Detect,
+					Schedule:    cc.Schedule,
+					Checksum:    cc.Checksum,
+					Cipher:      clicfg.Cipher,
+					RandomIV:    clicfg.RandomIV,
+					SplitIV:     clicfg.SplitIV,
+					Grace:       int64(config.WaitGrace),
+					SlotWait:    slotWait,
+					IdleTimeout: idle,
+					MaxLifetime: lifetime,
+					Intercept:   icpt,
+					Limit:       newConnLimiter(int(maxConns), acceptRate),
+					Bandwidth:   bw,
+					Share:       shared.Share(cc.Weight),
+					Stats:       portStats.Open(cc.Outer, client),
+					ProxyAddr:   cc.ProxyProtocol != 0,
+					Compress:    cc.Compress && clicfg.Compress,
+					Assigned:    cc.assigned,
+					Budget:      budget,
+					ClientLimit: clientLimit,
+					Listener:    clis,
+					WaitWorker:  make([]*Worker, waitMax),
+					Spares:      spares,
+					SpareAuth:   sauth,
+					cancel:      pcancel,
+					Running:     true,
+				}
+				resourceMu.Lock()
+				if _, ok := resourceMap[cc.Outer]; ok {
+					// 检查后其他会话打开了同一端口
+					resourceMu.Unlock()
+					pcancel()
+					clis.Close()
+					events.Println("error", "Port is already mapped", cc.Outer)
+					return ERROR_BUSY
+				}
+				resourceMap[cc.Outer] = rs
+				resourceMu.Unlock()
+				// 会话结束时同步关闭，客户端重连时端口已释放
+				sessionPorts[cc.Outer] = rs
+				if opened != nil {
+					opened()
+				}
+				go dolisten(pctx, cw, cc.Outer, rs)
+				return SUCCESS
+			}
+			// 打开端口
+			for _, cc := range clicfg.Map {
+				if code := openPort(cc, nil); code != SUCCESS {
+					if portError(code) {
+						// 带上出错的端口，客户端有多个映射时便于定位
+						// BUSY/LIMIT_PORT port
+						conn.Write([]byte{code, uint8(cc.Outer >> 8), uint8(cc.Outer)})
+						return
+					}
+					conn.Write([]byte{code})
+					return
+				}
+			}
+			// 旧版客户端不支持随机iv，仍回复SUCCESS
+			bans.Success(remoteIP(conn))
+			var success uint8 = SUCCESS
+			if clicfg.SplitIV {
+				// 支持分方向iv的客户端同样支持压缩、随机iv与KDF
+				success = SUCCESS_SPLIT_IV
+			} else if clicfg.Compress {
+				// 支持压缩的客户端同样支持随机iv与KDF
+				success = SUCCESS_COMPRESS
+			} else if clicfg.KDFSalt != "" {
+				// 支持KDF的客户端同样支持随机iv
+				success = SUCCESS_KDF
+			} else if clicfg.RandomIV {
+				success = SUCCESS_IV
+			}
+			if clicfg.Banner {
+				// SUCCESS banner_len(2) banner
+				conn.Write([]byte{success, uint8(len(config.Banner) >> 8), uint8(len(config.Banner))})
+				conn.Write([]byte(config.Banner))
+			} else {
+				conn.Write([]byte{success})
+			}
+			if clicfg.DryRun {
+				events.Println("auth", "Test connection succeeded", conn.RemoteAddr())
+				return
+			}
+			go cw.Run()
+			events.Println("auth", "Client connected", conn.RemoteAddr())
+			if clicfg.Heartbeat > 0 {
+				// 告知客户端支持心跳，旧版服务端不会发送
+				cw.Send([]byte{PONG})
+			}
+			sessionWg.Add(1)
+			defer sessionWg.Done()
+			sessionMu.Lock()
+			sessions[cw] = clicfg.Key
+			sessionMu.Unlock()
+			defer func() {
+				sessionMu.Lock()
+				delete(sessions, cw)
+				sessionMu.Unlock()
+			}()
+			if atomic.LoadInt32(&draining) == 1 {
+				cw.Send([]byte{RECONNECT})
+			}
+			// 本会话打开的端口，只允许关闭自己的端口
+			var owned = make(map[uint16]bool, len(clicfg.Map))
+			for _, cc := range clicfg.Map {
+				owned[cc.Outer] = true
+			}
+			// 从临时端口池分配端口并打开，以ASSIGN回复；端口被池外的程序占用时换一个端口重试
+			var assignPort = func(cc ClientMapConfig) {
+				var reply = func(port uint16, code uint8) {
+					// ASSIGN port(2) code(1) name_len(1) name
+					cw.Send(append([]byte{ASSIGN, uint8(port >> 8), uint8(port), code, uint8(len(cc.Name))}, cc.Name...))
+				}
+				switch {
+				case cc.Name == "" || len(cc.Name) > NameMax:
+					events.Println("error", "Bad name for an ephemeral port", conn.RemoteAddr())
+					reply(0, ERROR)
+					return
+				case maxMappings > 0 && len(owned) >= maxMappings:
+					events.Warnln("auth", "Too many mappings from", conn.RemoteAddr(), "to assign a port for", cc.Name)
+					reply(0, ERROR_MAPPINGS)
+					return
+				}
+				var busy = func(port uint16) bool {
+					resourceMu.Lock()
+					defer resourceMu.Unlock()
+					_, ok := resourceMap[port]
+					return ok
+				}
+				for i := 0; i < AssignTries; i++ {
+					port, err := ephemeral.Assign(client, conn.RemoteAddr().String(), cc.Name, busy)
+					if err != nil {
+						events.Warnln("port", "Can't assign a port for", cc.Name, conn.RemoteAddr(), err)
+						reply(0, ERROR_POOL)
+						return
+					}
+					cc.Outer, cc.assigned = port, true
+					code := openPort(cc, func() { reply(port, SUCCESS) })
+					if code == SUCCESS {
+						owned[port] = true
+						events.Println("port", "Client assigned port", port, "to", cc.Name, conn.RemoteAddr())
+						return
+					}
+					ephemeral.Release(port)
+					if code != ERROR_BUSY {
+						reply(0, code)
+						return
+					}
+				}
+				reply(0, ERROR_POOL)
+			}
+			// 控制命令，BATCH中的命令解压后从这里读出
+			var ctl = &controlReader{conn: conn}
+			// 读取 token_len token 并校验
+			var checkToken = func() (bool, error) {
+				tlen := make([]byte, 1)
+				if _, err := io.ReadAtLeast(ctl, tlen, 1); err != nil {
+					return false, err
+				}
+				token := make([]byte, tlen[0])
+				if _, err := io.ReadAtLeast(ctl, token, int(tlen[0])); err != nil {
+					return false, err
+				}
+				return killTokenOK(token, config.KillToken), nil
+			}
+			for {
+				if clicfg.Heartbeat > 0 {
+					conn.SetReadDeadline(time.Now().Add(time.Duration(clicfg.Heartbeat*HeartbeatMiss) * time.Second))
+				}
+				n, err := ctl.Read(cmd)
+				if err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						events.Warnln("auth", "Client heartbeat timed out", conn.RemoteAddr())
+					}
+					return
+				}
+				if n != 0 {
+					switch cmd[0] {
+					case KILL:
+						// KILL token_len token
+						ok, err := checkToken()
+						if err != nil {
+							return
+						}
+						if !ok {
+							events.Warnln("auth", "Rejected KILL with wrong token from", conn.RemoteAddr())
+							if config.KillAck {
+								cw.Send([]byte{ERROR})
+							}
+							continue
+						}
+						events.Println("auth", "Client requested shutdown", conn.RemoteAddr())
+						if config.KillAck {
+							// 连接即将关闭，直接写出确认
+							conn.SetWriteDeadline(time.Now().Add(KillWaitTime))
+							conn.Write([]byte{SUCCESS})
+						}
+						return
+					case KILL_PORT:
+						// KILL_PORT port(2) token_len token
+						bp := make([]byte, 2)
+						if _, err := io.ReadAtLeast(ctl, bp, 2); err != nil {
+							return
+						}
+						pt := uint16(bp[0])<<8 | uint16(bp[1])
+						ok, err := checkToken()
+						if err != nil {
+							return
+						}
+						if !ok {
+							events.Warnln("auth", "Rejected KILL for port", pt, "with wrong token from", conn.RemoteAddr())
+							continue
+						}
+						if !owned[pt] {
+							events.Println("error", "Client", conn.RemoteAddr(), "tried to close port", pt, "it does not own")
+							continue
+						}
+						delete(owned, pt)
+						if rs := sessionPorts[pt]; rs != nil {
+							// 同步关闭，之后立即添加同一端口不会因端口占用失败
+							events.Println("port", "Client requested to close port", pt, conn.RemoteAddr())
+							closePort(pt, rs)
+							delete(sessionPorts, pt)
+						}
+					case ADD_PORT:
+						// ADD_PORT len(2) json
+						blen := make([]byte, 2)
+						if _, err := io.ReadAtLeast(ctl, blen, 2); err != nil {
+							return
+						}
+						info := make([]byte, int(blen[0])<<8|int(blen[1]))
+						if _, err := io.ReadAtLeast(ctl, info, len(info)); err != nil {
+							return
+						}
+						var cc ClientMapConfig
+						if err := json.Unmarshal(legacyKeys(info), &cc); err != nil {
+							return
+						}
+						if cc.Outer == 0 {
+							assignPort(cc)
+							continue
+						}
+						var code uint8
+						switch {
+						case owned[cc.Outer]:
+							events.Println("error", "Port is occupied", cc.Outer)
+							code = ERROR_BUSY
+						case maxMappings > 0 && len(owned) >= maxMappings:
+							events.Warnln("auth", "Too many mappings from", conn.RemoteAddr(), "to add port", cc.Outer)
+							code = ERROR_MAPPINGS
+						default:
+							code = openPort(cc, nil)
+						}
+						if code == SUCCESS {
+							owned[cc.Outer] = true
+							events.Println("port", "Client added port", cc.Outer, conn.RemoteAddr())
+						}
+						cw.Send([]byte{ADD_PORT, uint8(cc.Outer >> 8), uint8(cc.Outer), code})
+					case PING:
+						cw.Send([]byte{PONG})
+					case BATCH:
+						if len(ctl.pending) > 0 {
+							events.Warnln("conn", "Nested control batch from", conn.RemoteAddr())
+							return
+						}
+						cmds, err := readBatch(ctl)
+						if err != nil {
+							events.Warnln("conn", "Bad control batch from", conn.RemoteAddr(), err)
+							return
+						}
+						ctl.pending = cmds
+					case IDLE:
+						continue
+					}
+				}
+			}
+		case MUX:
+			// MUX window(4) -> SUCCESS window(4)，交换双方每个流的接收窗口；
+			// 每个流与单独的数据连接相同，以NEWCONN开始
+			bw := make([]byte, 4)
+			if _, err := io.ReadFull(conn, bw); err != nil {
+				conn.Close()
+				return
+			}
+			peerWin, err := muxWindow(int(binary.BigEndian.Uint32(bw)))
+			if err != nil {
+				events.Warnln("conn", "Rejected mux connection from", conn.RemoteAddr(), err)
+				conn.Write([]byte{ERROR_BADCONFIG})
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			res := []byte{SUCCESS, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(res[1:], uint32(muxWin))
+			if _, err := conn.Write(res); err != nil {
+				conn.Close()
+				return
+			}
+			sess := newMuxSession(conn, muxWin, peerWin)
+			defer sess.Close()
+			for {
+				st, err := sess.Accept()
+				if err != nil {
+					return
+				}
+				go doconn(st)
+			}
+		case SPARE:
+			// SPARE port(2) seq(8) proof(32) -> SUCCESS，之后保留到有新连接时使用
+			bp := make([]byte, 10+SpareProofSize)
+			if _, err := io.ReadFull(conn, bp); err != nil {
+				conn.Close()
+				return
+			}
+			pt := binary.BigEndian.Uint16(bp)
+			resourceMu.Lock()
+			rs := resourceMap[pt]
+			resourceMu.Unlock()
+			if rs == nil || rs.Spares == nil {
+				conn.Write([]byte{ERROR})
+				conn.Close()
+				return
+			}
+			if !rs.SpareAuth.Check(pt, binary.BigEndian.Uint64(bp[2:]), bp[10:]) {
+				// 备用连接会收到访问者的连接与地址，只接受该端口所属会话建立的
+				events.Warnln("auth", "Bad spare connection proof from", conn.RemoteAddr(), "for port", pt)
+				conn.Write([]byte{ERROR})
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			if _, err := conn.Write([]byte{SUCCESS}); err != nil {
+				conn.Close()
+				return
+			}
+			select {
+			case rs.Spares <- conn:
+				resourceMu.Lock()
+				closed := resourceMap[pt] != rs
+				resourceMu.Unlock()
+				if closed {
+					// 端口已关闭
+					for len(rs.Spares) > 0 {
+						(<-rs.Spares).Close()
+					}
+				}
+			default:
+				// 已满，客户端稍后重新建立
+				conn.Close()
+			}
+		case NEWCONN:
+			// 客户端新建立连接
+			sport := make([]byte, 3)
+			if _, err := io.ReadAtLeast(conn, sport, 3); err != nil {
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			pt := (uint16(sport[0]) << 8) + uint16(sport[1])
+			id := uint8(sport[2])
+			resourceMu.Lock()
+			client := resourceMap[pt]
+			resourceMu.Unlock()
+			var iv []byte
+			if client != nil && client.RandomIV {
+				// NEWCONN port id iv
+				iv = make([]byte, encrypto.IVSize)
+				conn.SetReadDeadline(time.Now().Add(dataTimeout))
+				if _, err := io.ReadFull(conn, iv); err != nil {
+					conn.Close()
+					return
+				}
+				conn.SetReadDeadline(time.Time{})
+			}
+			if client != nil {
+				wk := client.Take(id)
+				if wk == nil {
+					conn.Close()
+					return
+				} else {
+					if !startForward() {
+						// 正在退出，不再对接
+						wk.Conn.Close()
+						conn.Close()
+						return
+					}
+					if !client.Budget.Acquire() {
+						active.Add(-2)
+						atomic.AddInt64(&client.Stats.RejectedMemory, 1)
+						events.Warnln("conn", "Client memory budget exceeded", pt)
+						wk.Conn.Close()
+						conn.Close()
+						return
+					}
+					if fc, ok := wk.Conn.(*forwardConn); ok {
+						// 客户端已连接目标地址，访问者收到回复后才发送数据
+						if err := fc.Established(); err != nil {
+							active.Add(-2)
+							client.Budget.Release()
+							wk.Conn.Close()
+							conn.Close()
+							return
+						}
+					}
+					events.Debugln("conn", "New connection", wk.Conn.RemoteAddr(), "on port", pt)
+					fw := &Forward{Key: client.Key, Port: pt, Outer: wk.Conn, Data: conn, Start: time.Now()}
+					forwards.Add(fw)
+					atomic.AddInt64(&client.Stats.Active, 1)
+					atomic.AddInt64(&client.Stats.Total, 1)
+					var s encrypto.NCopy
+					key := client.CryptKey
+					if iv == nil {
+						iv = client.CryptIV
+					}
+					if client.SplitIV {
+						s.InitSplit(conn, key, iv, false, bufSize)
+					} else {
+						s.Init(conn, key, iv, bufSize)
+					}
+					if client.Cipher == encrypto.CipherGCM {
+						s.EnableGCM(key, iv)
+					} else if client.Checksum {
+						s.EnableChecksum()
+					}
+					if client.Compress {
+						s.EnableCompress()
+					}
+					limited, stopLimit := limitForward(fw, client.IdleTimeout, client.MaxLifetime, func(reason string) {
+						events.Println("conn", "Close connection", fw.Outer.RemoteAddr(), "on port", pt, "reached", reason)
+					})
+					limited = intercept(limited, client.Intercept, InterceptInfo{Port: pt, Key: client.Key})
+					var counted net.Conn = &countConn{Conn: limited, in: &fw.In, out: &fw.Out}
+					counted = &countConn{Conn: counted, in: &client.Stats.In, out: &client.Stats.Out}
+					var outer net.Conn = &teeConn{Conn: counted, rsc: client}
+					if client.Quota > 0 {
+						outer = &quotaConn{Conn: outer, used: client.Used, limit: client.Quota}
+					}
+					outer = client.Bandwidth.Wrap(outer)
+					outer = client.Share.Wrap(outer)
+					// 两个方向都结束后归还预算
+					var left int32 = 2
+					var release = func() {
+						active.Done()
+						if atomic.AddInt32(&left, -1) == 0 {
+							stopLimit()
+							in, out, d := atomic.LoadInt64(&fw.In), atomic.LoadInt64(&fw.Out), time.Since(fw.Start)
+							if sampler.Keep(in+out, d) {
+								events.Println("conn", fmt.Sprintf("Connection closed %v on port %v, %v bytes in, %v bytes out, %v",
+									fw.Outer.RemoteAddr(), pt, in, out, d.Round(time.Millisecond)))
+							}
+							forwards.Remove(fw)
+							atomic.AddInt64(&client.Stats.Active, -1)
+							client.Budget.Release()
+						}
+					}
+					go func() {
+						defer release()
+						encrypto.WCopy(&s, outer)
+					}()
+					go func() {
+						defer release()
+						encrypto.RCopy(outer, &s)
+					}()
+				}
+			} else {
+				conn.Close()
+			}
+		default:
+			malformed(conn, fmt.Sprintf("unknown command %#02x", cmd[0]), nil)
+			conn.Close()
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+	for {
+		remoteConn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if atomic.LoadInt32(&draining) == 1 {
+				break
+			}
+			logger.Errorf("Accept on control port %v failed: %v", config.Port, err)
+			continue
+		}
+		if ip := remoteIP(remoteConn); !filter.Allowed(ip) || bans.Banned(ip) {
+			// 扫描与封禁中的地址可能很多，只在debug级别记录
+			logger.Debug("Rejected control connection from", remoteConn.RemoteAddr())
+			remoteConn.Close()
+			continue
+		}
+		if config.ControlFallback != "" {
+			// 按ALPN分流需要等待ClientHello，不阻塞Accept
+			go func(conn net.Conn) {
+				defer Recover()
+				tconn, err := splitALPN(conn, controlTLS, config.ControlFallback, dataTimeout)
+				if err != nil {
+					logger.Debug("Control port connection from", conn.RemoteAddr(), "not forwarded:", err)
+				}
+				if tconn != nil {
+					doconn(tconn)
+				}
+			}(remoteConn)
+			continue
+		}
+		go doconn(remoteConn)
+	}
+	if ctx.Err() != nil {
+		// 断开全部客户端，关闭映射端口，已对接的连接在宽限期内继续转发
+		sessionMu.Lock()
+		for cw := range sessions {
+			cw.Close()
+		}
+		sessionMu.Unlock()
+		events.Println("server", "Shutting down, waiting for active connections")
+		if !waitActive(gracePeriod(config.ShutdownGrace)) {
+			events.Println("server", "Shutdown grace period expired, closed", forwards.Close("", 0), "connections")
+		}
+		return nil
+	}
+	// 等待客户端切换到新进程，已对接的连接结束后退出
+	sessionWg.Wait()
+	waitActive(-1)
+	logger.Info("Drained, exit")
+	return nil
+}
+
+// dialLimiter 限制客户端同时建立中(连接服务端与内网服务)的连接数量，突发时排队等待
+type dialLimiter chan struct{}
+
+// newDialLimiter n不大于0时使用默认的DialConcurrency
+func newDialLimiter(n int) dialLimiter {
+	if n <= 0 {
+		n = DialConcurrency
+	}
+	return make(dialLimiter, n)
+}
+
+// Do 等待空位后执行fn，返回时归还
+func (l dialLimiter) Do(fn func()) {
+	l <- struct{}{}
+	defer func() { <-l }()
+	fn()
+}
+
+// DoClient 客户端处理，ctx取消后向服务端发送KILL并返回；无法启动或被服务端拒绝时返回错误
+func DoClient(ctx context.Context, config *ClientConfig) error {
+	if config == nil {
+		return nil
+	}
+	if len(config.KillToken) > 0xff {
+		return errors.New("client initialization error: kill token is too long")
+	}
+	if config.TOTPSecret != "" {
+		if _, err := decodeTOTPSecret(config.TOTPSecret); err != nil {
+			return fmt.Errorf("client initialization error: %v", err)
+		}
+	}
+	var bufSize = encrypto.BufferSize
+	if config.BufferSize > 0 {
+		bufSize = config.BufferSize
+	}
+	muxWin, err := muxWindow(config.MuxWindow)
+	if err != nil {
+		return fmt.Errorf("client initialization error: %v", err)
+	}
+	var batchInterval = time.Duration(config.ControlBatch) * time.Millisecond
+	switch {
+	case config.ControlBatch < 0:
+		return errors.New("client initialization error: control_batch must not be negative")
+	case config.ControlCompress && config.ControlBatch == 0:
+		return errors.New("client initialization error: control_compress needs control_batch")
+	case batchInterval > 0 && pingInterval(config.PingInterval) > 0 && batchInterval >= pingInterval(config.PingInterval):
+		return errors.New("client initialization error: control_batch must be shorter than ping_interval")
+	}
+	var retryMax, retryFactor = RetryMax, float64(RetryFactor)
+	if config.RetryMax > 0 {
+		retryMax = time.Duration(config.RetryMax) * time.Second
+	}
+	if config.RetryFactor != 0 {
+		retryFactor = config.RetryFactor
+	}
+	if config.RetryMax < 0 || retryFactor < 1 {
+		return errors.New("client initialization error: retry_max must not be negative and retry_factor must be at least 1")
+	}
+	// 数据连接的key，KDF较慢，只在启动时计算一次；iv由每个数据连接随机生成
+	cryptKey, _ := encrypto.GetKeyIv(config.Key)
+	if config.KDFSalt != "" {
+		cryptKey, _ = encrypto.GetKeyIvKDF(config.Key, config.KDFSalt)
+	}
+	allow, err := parseAllowList(config.AllowInner)
+	if err != nil {
+		return fmt.Errorf("client initialization error: %v", err)
+	}
+	var keepAlive = keepAlivePeriod(config.KeepAlive)
+	for i := range config.Map {
+		m := &config.Map[i]
+		if err := m.normalize(); err != nil {
+			return fmt.Errorf("client initialization error: %v", err)
+		}
+		m.keepAlive = keepAlive
+		if err := m.checkAllow(allow); err != nil {
+			return fmt.Errorf("client initialization error: %v", err)
+		}
+		if m.Outer == 0 {
+			switch {
+			case m.Name == "" || len(m.Name) > NameMax:
+				return fmt.Errorf("client initialization error: a mapping without outer needs a name of at most %v bytes", NameMax)
+			case m.Dir != nil || m.When != nil:
+				return fmt.Errorf("client initialization error: %v: dir and when need an outer port", m.Name)
+			}
+		}
+		if m.When != nil {
+			if m.Dir != nil || m.ForwardProxy != "" {
+				return fmt.Errorf("client initialization error: when can't be used with dir or forward_proxy, port %v", m.Outer)
+			}
+			if err := m.When.Init(); err != nil {
+				return fmt.Errorf("client initialization error: port %v: %v", m.Outer, err)
+			}
+		}
+		if m.Dir == nil {
+			continue
+		}
+		ds, err := newDirServer(m.Outer, m.Dir)
+		if err != nil {
+			return fmt.Errorf("client initialization error: %v", err)
+		}
+		defer ds.Close()
+		m.dir = ds
+	}
+	if config.Discover != nil {
+		if err := config.Discover.Init(); err != nil {
+			return fmt.Errorf("client initialization error: %v", err)
+		}
+	}
+	switch config.CheckBackends {
+	case "":
+	case CheckWarn:
+		checkBackends(config)
+	case CheckStrict:
+		if !checkBackends(config) {
+			return errors.New("client initialization error: unreachable backends, refusing to start")
+		}
+	default:
+		return fmt.Errorf("client initialization error: unknown check_backends mode %q, must be warn or strict", config.CheckBackends)
+	}
+	// outer为0的映射由服务端分配端口，分配后才加入portmap，以名称区分
+	var names = make(map[string]bool)
+	for i := 0; i < len(config.Map); {
+		if m := config.Map[i]; m.Outer == 0 {
+			if names[m.Name] {
+				return fmt.Errorf("client initialization error: duplicate name %v", m.Name)
+			}
+			names[m.Name] = true
+			config.ephemeral = append(config.ephemeral, m)
+			config.Map = append(config.Map[:i:i], config.Map[i+1:]...)
+			continue
+		}
+		i++
+	}
+	// 同一内网服务可以映射到多个外网端口，外网端口不能重复
+	var portmap = make(map[uint16]ClientMapConfig, len(config.Map))
+	for _, m := range config.Map {
+		if _, ok := portmap[m.Outer]; ok {
+			return fmt.Errorf("client initialization error: duplicate outer port %v", m.Outer)
+		}
+		portmap[m.Outer] = m
+	}
+	// 有条件的映射在条件成立时才添加
+	var whens []ClientMapConfig
+	for i := 0; i < len(config.Map); {
+		if m := config.Map[i]; m.When != nil {
+			whens = append(whens, m)
+			delete(portmap, m.Outer)
+			config.Map = append(config.Map[:i:i], config.Map[i+1:]...)
+			continue
+		}
+		i++
+	}
+	// 运行时关闭映射会修改portmap与config.Map
+	var mapMu sync.Mutex
+	// 当前认证成功的控制连接(开启control_batch时为合并写出的控制连接)，未连接时为nil
+	var control io.Writer
+	// KILL_PORT port(2) token_len token
+	var sendKillPort = func(w io.Writer, port uint16) {
+		var buffer bytes.Buffer
+		buffer.Write([]byte{KILL_PORT, uint8(port >> 8), uint8(port), uint8(len(config.KillToken))})
+		buffer.WriteString(config.KillToken)
+		w.Write(buffer.Bytes())
+	}
+	// 移除映射，调用时须持有mapMu
+	var removeMap = func(port uint16) {
+		if m := portmap[port]; m.assigned {
+			// 分配的临时端口，重连后不再请求
+			for i, e := range config.ephemeral {
+				if e.Name == m.Name {
+					config.ephemeral = append(config.ephemeral[:i:i], config.ephemeral[i+1:]...)
+					break
+				}
+			}
+		}
+		delete(portmap, port)
+		for i, m := range config.Map {
+			if m.Outer == port {
+				config.Map = append(config.Map[:i:i], config.Map[i+1:]...)
+				return
+			}
+		}
+	}
+	// ADD_PORT len(2) json，本地目录配置不发给服务端
+	var sendAddPort = func(w io.Writer, m ClientMapConfig) {
+		m.Dir = nil
+		m.AllowInner = nil
+		m.When = nil
+		info, _ := json.Marshal(&m)
+		var buffer bytes.Buffer
+		buffer.Write([]byte{ADD_PORT, uint8(len(info) >> 8), uint8(len(info))})
+		buffer.Write(info)
+		w.Write(buffer.Bytes())
+	}
+	// 添加映射，服务端拒绝时再移除
+	var addMap = func(m ClientMapConfig) error {
+		if m.Dir != nil {
+			return errors.New("dir mappings can't be added at runtime")
+		}
+		if m.ForwardProxy != "" {
+			// 会话的协议版本在握手时确定
+			return errors.New("forward proxy mappings can't be added at runtime")
+		}
+		if m.Outer == 0 {
+			return errors.New("outer port is required at runtime")
+		}
+		if err := m.normalize(); err != nil {
+			return err
+		}
+		m.keepAlive = keepAlive
+		if err := m.checkAllow(allow); err != nil {
+			return err
+		}
+		mapMu.Lock()
+		defer mapMu.Unlock()
+		if _, ok := portmap[m.Outer]; ok {
+			return fmt.Errorf("duplicate outer port %v", m.Outer)
+		}
+		portmap[m.Outer] = m
+		config.Map = append(config.Map, m)
+		if control != nil {
+			sendAddPort(control, m)
+		}
+		logger.Infof("Adding %v->:%v", m.Inner, m.Outer)
+		return nil
+	}
+	// 关闭单个映射，重连后也不再打开，端口不存在时返回false
+	var unmap = func(port uint16) bool {
+		mapMu.Lock()
+		defer mapMu.Unlock()
+		if _, ok := portmap[port]; !ok {
+			return false
+		}
+		removeMap(port)
+		if control != nil {
+			sendKillPort(control, port)
+		}
+		logger.Info("Unmapped port", port)
+		return true
+	}
+	for _, m := range whens {
+		go watchWhen(ctx, m, addMap, unmap)
+	}
+	if config.Discover != nil {
+		go watchDiscover(ctx, config.Discover, addMap, unmap)
+	}
+	var dialStats DialStatsMap
+	if config.Admin != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/probe/", probeHandler(config))
+		adminMux.Handle("/dial", &dialStats)
+		// 添加映射，只允许本机操作
+		adminMux.HandleFunc("/map", func(w http.ResponseWriter, r *http.Request) {
+			if !localOnly(w, r) {
+				return
+			}
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var m ClientMapConfig
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := addMap(m); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+		})
+		// 关闭单个映射，只允许本机操作
+		adminMux.HandleFunc("/unmap", func(w http.ResponseWriter, r *http.Request) {
+			if !localOnly(w, r) {
+				return
+			}
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			pt, err := strconv.ParseUint(r.FormValue("port"), 10, 16)
+			if err != nil {
+				http.Error(w, "bad port", http.StatusBadRequest)
+				return
+			}
+			if !unmap(uint16(pt)) {
+				http.Error(w, "port not mapped", http.StatusNotFound)
+			}
+		})
+		// 各映射的内网服务状态，只列出配置了backends的映射
+		adminMux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+			mapMu.Lock()
+			status := make(map[uint16][]BackendStatus)
+			for port, m := range portmap {
+				if m.lb != nil {
+					status[port] = m.lb.Status()
+				}
+			}
+			mapMu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+		})
+		// POST将映射的一个内网服务标记为维护中，DELETE恢复，只允许本机操作
+		adminMux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+			if !localOnly(w, r) {
+				return
+			}
+			if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			pt, err := strconv.ParseUint(r.FormValue("port"), 10, 16)
+			if err != nil {
+				http.Error(w, "bad port", http.StatusBadRequest)
+				return
+			}
+			addr, err := normalizeAddr(r.FormValue("backend"))
+			if err != nil {
+				http.Error(w, "bad backend", http.StatusBadRequest)
+				return
+			}
+			mapMu.Lock()
+			m, ok := portmap[uint16(pt)]
+			mapMu.Unlock()
+			switch {
+			case !ok:
+				http.Error(w, "port not mapped", http.StatusNotFound)
+			case m.lb == nil || !m.lb.Drain(addr, r.Method == http.MethodPost):
+				http.Error(w, "backend not found", http.StatusNotFound)
+			}
+		})
+		if err := startAdmin(config.Admin, adminMux); err != nil {
+			return fmt.Errorf("client initialization error: %v", err)
+		}
+	}
+	var d = dialer(config.FastOpen)
+	d.KeepAlive = keepAlive
+	tlsConfig, err := clientTLSConfig(config)
+	if err != nil {
+		return fmt.Errorf("client initialization error: %v", err)
+	}
+	var dialing = newDialLimiter(config.DialConcurrency)
+	// 开启mux时承载数据连接的多路复用连接，服务端不支持时为每个连接单独建立数据连接
+	var muxMu sync.Mutex
+	var mux *muxSession
+	var muxUnsupported bool
+	// 建立多路复用连接，服务端不支持时返回nil
+	var dialMux = func() (*muxSession, error) {
+		conn, err := dialServer(d, config.Server, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(DataTimeOut))
+		peerWin, err := muxHandshake(conn, muxWin)
+		if err != nil {
+			conn.Close()
+			if err == errMuxUnsupported {
+				// 旧版服务端不认识MUX，直接关闭连接
+				return nil, nil
+			}
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return newMuxSession(conn, muxWin, peerWin), nil
+	}
+	// 建立到服务端的数据连接
+	var openData = func() (net.Conn, error) {
+		if config.Mux {
+			muxMu.Lock()
+			if !muxUnsupported && (mux == nil || mux.IsClosed()) {
+				sess, err := dialMux()
+				switch {
+				case err != nil:
+					logger.Warn("Can't establish multiplexed connection, using a separate connection", err)
+				case sess == nil:
+					muxUnsupported = true
+					logger.Warn("Server does not support multiplexing, using a connection per forward, upgrade the server")
+				}
+				mux = sess
+			}
+			sess := mux
+			muxMu.Unlock()
+			if sess != nil {
+				if st, err := sess.Open(); err == nil {
+					return st, nil
+				}
+			}
+		}
+		return dialServer(d, config.Server, tlsConfig)
+	}
+	// 无法重试的错误，如密码错误，出现后停止重连
+	var fatal error
+	// 已对接的连接，退出时在宽限期后强制关闭
+	var active sync.WaitGroup
+	var liveMu sync.Mutex
+	var live = make(map[net.Conn]net.Conn)
+	// 退出时置位，之后不再开始新的转发
+	var draining bool
+	// track 开始建立转发前在active中预留，退出中返回false；预留的计数由doconn或建立失败时归还
+	var track = func() bool {
+		liveMu.Lock()
+		defer liveMu.Unlock()
+		if draining || ctx.Err() != nil {
+			return false
+		}
+		active.Add(1)
+		return true
+	}
+	var drain = func() {
+		liveMu.Lock()
+		draining = true
+		liveMu.Unlock()
+		if waitTimeout(&active, gracePeriod(config.ShutdownGrace)) {
+			return
+		}
+		liveMu.Lock()
+		defer liveMu.Unlock()
+		logger.Warn("Shutdown grace period expired, closing", len(live), "connections")
+		for local, remote := range live {
+			local.Close()
+			remote.Close()
+		}
+	}
+	// 主动刷新后重连，服务端可能尚未释放端口，端口占用时重试而不退出
+	var refreshing bool
+	// 上次握手发送版本后没有回复，下次按旧格式握手一次
+	var legacyStart bool
+	// 旧版服务端不发送访问者地址，只提示一次
+	var proxyWarned bool
+	// 重连间隔
+	var backoff = NewBackoff(RetryTime, retryMax, retryFactor)
+	// 服务端平滑重启时保留旧控制连接，新会话认证成功后再关闭
+	var handoff net.Conn
+	// 新建连接处理
+	// 调用前须由track预留，开始转发前返回时归还
+	var doconn = func(conn net.Conn, sport uint16, sp []byte, dst string, splitIV, compress bool, header []byte) {
+		defer Recover()
+		var forwarding bool
+		defer func() {
+			if !forwarding {
+				active.Done()
+			}
+		}()
+		mapMu.Lock()
+		m, ok := portmap[sport]
+		mapMu.Unlock()
+		if !ok {
+			// 映射已关闭
+			conn.Close()
+			return
+		}
+		if (m.Transparent || m.ForwardProxy != "") && strings.HasPrefix(dst, UnixScheme) {
+			// 服务端指定的目标不能是本机的Unix域套接字
+			conn.Close()
+			logger.Warnf("Destination %v for :%v is a unix socket, refused", dst, sport)
+			return
+		}
+		if dst != "" {
+			addr, ok := m.allow.Resolve(dst)
+			if !ok {
+				// 服务端指定的目标不在允许列表中
+				conn.Close()
+				logger.Warnf("Destination %v for :%v is not in allow_inner, refused", dst, sport)
+				return
+			}
+			if m.InnerTLS && m.InnerTLSName == "" && addr != dst {
+				// 连接的是校验过的IP，证书仍按目标的主机名校验
+				m.InnerTLSName, _, _ = net.SplitHostPort(dst)
+			}
+			// 透明代理与代理端口连接服务端发来的目标地址
+			m.Inner = addr
+			m.dir = nil
+			m.lb = nil
+		}
+		localConn, err := m.Dial()
+		kind, alert := dialStats.Record(sport, err)
+		if err == nil {
+			logger.Debugf("Connected %v for :%v", localConn.RemoteAddr(), sport)
+		}
+		if err != nil {
+			conn.Close()
+			logger.Warnf("Dial %v for :%v failed (%v): %v", m.Inner, sport, kind, err)
+			if alert {
+				logger.Errorf("Backend %v for :%v refused %v connections in a row, the service may be down", m.Inner, sport, RefusedAlert)
+			}
+			return
+		}
+		var idle *time.Timer
+		if m.IdleTimeout > 0 {
+			// 客户端也按映射的空闲超时关闭，与服务端之间的连接中断(对端不发FIN)时不会一直占用内网连接
+			localConn, idle = idleTimer(localConn, time.Duration(m.IdleTimeout)*time.Second, func() {
+				logger.Infof("Close idle connection %v for :%v", localConn.RemoteAddr(), sport)
+				localConn.Close()
+				conn.Close()
+			})
+		}
+		if len(header) > 0 {
+			// PROXY协议头，之后才是访问者的数据
+			if _, err := localConn.Write(header); err != nil {
+				conn.Close()
+				localConn.Close()
+				logger.Warnf("Send proxy protocol header to %v for :%v failed: %v", m.Inner, sport, err)
+				return
+			}
+		}
+		key := cryptKey
+		// NEWCONN port id iv
+		iv, err := encrypto.NewIV()
+		if err != nil {
+			conn.Close()
+			localConn.Close()
+			logger.Error("Generate iv failed", err)
+			return
+		}
+		conn.Write(append(append([]byte{NEWCONN}, sp...), iv...))
+		var s encrypto.NCopy
+		if splitIV {
+			s.InitSplit(conn, key, iv, true, bufSize)
+		} else {
+			s.Init(conn, key, iv, bufSize)
+		}
+		if config.Cipher == encrypto.CipherGCM {
+			s.EnableGCM(key, iv)
+		} else if m.Checksum {
+			s.EnableChecksum()
+		}
+		if compress && m.Compress {
+			s.EnableCompress()
+		}
+		liveMu.Lock()
+		live[localConn] = conn
+		liveMu.Unlock()
+		// 一个方向读到EOF时只半关闭，两个方向都结束后两端才关闭
+		var left int32 = 2
+		var untrack = func() {
+			if atomic.AddInt32(&left, -1) == 0 {
+				liveMu.Lock()
+				delete(live, localConn)
+				liveMu.Unlock()
+				if idle != nil {
+					idle.Stop()
+				}
+			}
+			active.Done()
+		}
+		// 预留的一个计数给其中一个方向
+		active.Add(1)
+		forwarding = true
+		go func() {
+			defer untrack()
+			encrypto.WCopy(&s, localConn)
+		}()
+		go func() {
+			defer untrack()
+			encrypto.RCopy(localConn, &s)
+		}()
+	}
+	for fatal == nil {
+		select {
+		case <-ctx.Done():
+			drain()
+			return nil
+		default:
+		}
+		func() {
+			defer Recover()
+			defer func() {
+				if handoff == nil && fatal == nil {
+					select {
+					case <-time.After(backoff.Next()):
+					case <-ctx.Done():
+					}
+				}
+			}()
+			prev := handoff
+			handoff = nil
+			defer func() {
+				if prev != nil {
+					prev.Close()
+				}
+			}()
+			logger.Info("Connecting to server...")
+			serverConn, err := dialServer(d, config.Server, tlsConfig)
+			if err != nil {
+				logger.Warn("Can't connect to server", err)
 				return
 			}
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
-			// 打开端口
-			for _, cc := range clicfg.Map {
-				// 判断端口是否合法
-				if len(config.LimitPort) >= 2 {
-					if cc.Outer < config.LimitPort[0] || cc.Outer > config.LimitPort[1] {
-						// 不满足端口范围
-						log.Printf("Does not meet the port range[%v, %v] %v", config.LimitPort[0], config.LimitPort[1], cc.Outer)
-						conn.Write([]byte{ERROR_LIMIT_PORT})
-						return
+			defer func() {
+				if handoff != serverConn {
+					serverConn.Close()
+				}
+			}()
+			// 映射可能在运行时关闭，握手使用当前映射的副本
+			mapMu.Lock()
+			cfg := *config
+			cfg.Map = append([]ClientMapConfig(nil), config.Map...)
+			mapMu.Unlock()
+			var version = cfg.startVersion()
+			if legacyStart {
+				version, legacyStart = 0, false
+			}
+			code, banner, arg, nonce, err := clientHandshake(serverConn, &cfg, false, version)
+			if err != nil {
+				logger.Warn("Handshake failed:", err)
+				if errors.Is(err, errNoReply) && version == versionBase {
+					// 可能是旧版服务端，下次按旧格式握手；需要更高版本时旧格式的服务端也不支持，不回退
+					legacyStart = true
+				}
+				return
+			}
+			if version == 0 && successCode(code) {
+				logger.Warn("Server does not support protocol version, using the legacy handshake, upgrade the server")
+			}
+			// 回复AUTH的服务端都支持随机iv，成功的结果至少为SUCCESS_IV
+			splitIV := code == SUCCESS_SPLIT_IV
+			compress := code == SUCCESS_COMPRESS || splitIV
+			if config.KDFSalt != "" && successCode(code) && code != SUCCESS_KDF && !compress {
+				// 旧版服务端忽略盐，双方的key不一致
+				fatal = errors.New("server does not support kdf, upgrade the server")
+				return
+			}
+			if successCode(code) {
+				if !splitIV && config.Cipher != encrypto.CipherGCM {
+					logger.Warn("Server does not support per-direction iv, both directions share one keystream, upgrade the server")
+				}
+				if !compress {
+					for _, cc := range cfg.Map {
+						if cc.Compress {
+							logger.Warn("Server does not support compression, mappings are not compressed, upgrade the server")
+							break
+						}
 					}
 				}
-				clis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", cc.Outer))
-				if err != nil {
-					log.Println("Port is occupied", cc.Outer)
-					conn.Write([]byte{ERROR_BUSY})
-					return
+				code = SUCCESS
+			}
+			if code != SUCCESS {
+				if fatal = rejectError(code, arg, refreshing); fatal == nil {
+					// 暂时性错误，按退避间隔重试
+					logger.Warn(rejectMessage(code, arg))
 				}
-				resourceMu.Lock()
-				resourceMap[cc.Outer] = &Resource{
-					Listener: clis,
-					Running:  true,
+				return
+			}
+			logger.Info("Certification successful")
+			// 服务端可能已重启或升级，新的数据连接使用新的多路复用连接，旧的在已有连接结束后关闭
+			muxMu.Lock()
+			if mux != nil {
+				mux.CloseWhenIdle()
+				mux = nil
+			}
+			muxUnsupported = false
+			muxMu.Unlock()
+			// 控制命令的写出，开启control_batch时合并写出，writeNow用于不能等待的KILL
+			var ctl io.Writer = serverConn
+			var writeNow = serverConn.Write
+			if batchInterval > 0 {
+				cb := newControlBatch(serverConn, batchInterval, config.ControlCompress)
+				defer cb.Close()
+				ctl, writeNow = cb, cb.WriteNow
+			}
+			mapMu.Lock()
+			control = ctl
+			// 握手期间关闭与添加的映射
+			var sent = make(map[uint16]bool, len(cfg.Map))
+			for _, cc := range cfg.Map {
+				sent[cc.Outer] = true
+				if _, ok := portmap[cc.Outer]; !ok {
+					sendKillPort(ctl, cc.Outer)
 				}
-				resourceMu.Unlock()
-				go dolisten(ctx, conn, cc.Outer)
 			}
-			conn.Write([]byte{SUCCESS})
-			for {
-				n, err := conn.Read(cmd)
-				if err != nil {
+			for _, m := range config.Map {
+				if !sent[m.Outer] {
+					sendAddPort(ctl, m)
+				}
+			}
+			for _, m := range config.ephemeral {
+				sendAddPort(ctl, m)
+			}
+			mapMu.Unlock()
+			// 本会话分配到的临时端口，下次认证成功后重新分配
+			var assigned []uint16
+			defer func() {
+				mapMu.Lock()
+				if control == ctl {
+					control = nil
+				}
+				for _, pt := range assigned {
+					delete(portmap, pt)
+				}
+				mapMu.Unlock()
+			}()
+			refreshing = false
+			backoff.Reset()
+			if banner != "" {
+				logger.Infof("Server notice: %s", banner)
+			}
+			if prev != nil {
+				prev.Close()
+				prev = nil
+			}
+			var opened = make(map[uint16]ClientMapConfig, len(cfg.Map))
+			for _, cc := range cfg.Map {
+				opened[cc.Outer] = cc
+				logger.Infof("%v->:%v", cc.Label(), cc.Outer)
+			}
+			go PublishMap(&cfg)
+			// 读取NEWSOCKET之后的端口、id与附带的信息，控制连接与备用连接共用
+			var readSocket = func(r io.Reader, cmd uint8) (sport uint16, sp []byte, dst string, header []byte, err error) {
+				// 读取远端端口与id
+				sp = make([]byte, 3)
+				if _, err = io.ReadFull(r, sp); err != nil {
 					return
 				}
-				if n != 0 {
-					switch cmd[0] {
-					case KILL:
+				sport = uint16(sp[0])<<8 + uint16(sp[1])
+				// 按服务端打开端口时的映射解析，映射在运行时关闭后服务端仍可能发来该端口的命令
+				mapMu.Lock()
+				pm, ok := opened[sport]
+				if !ok {
+					// 运行时添加的端口，服务端的回复可能晚于该端口的NEWSOCKET
+					pm = portmap[sport]
+				}
+				mapMu.Unlock()
+				if pm.Transparent || pm.ForwardProxy != "" {
+					// 透明代理的原始目标地址或访问者请求的目标地址
+					dlen := make([]byte, 1)
+					if _, err = io.ReadFull(r, dlen); err != nil {
 						return
-					case IDLE:
-						continue
 					}
+					daddr := make([]byte, dlen[0])
+					if _, err = io.ReadFull(r, daddr); err != nil {
+						return
+					}
+					dst = string(daddr)
+				}
+				if rules := pm.Detect; len(rules) > 0 {
+					// 服务端识别出的协议
+					pb := make([]byte, 1)
+					if _, err = io.ReadFull(r, pb); err != nil {
+						return
+					}
+					if dst == "" && int(pb[0]) < len(rules) {
+						dst = rules[pb[0]].Inner
+					}
+				}
+				var src, local string
+				if cmd == NEWSOCKET_PROXY {
+					// 访问者地址与外网端口地址
+					if src, err = readAddr(r); err != nil {
+						return
+					}
+					if local, err = readAddr(r); err != nil {
+						return
+					}
+				}
+				if pm.ProxyProtocol != 0 {
+					mapMu.Lock()
+					if cmd != NEWSOCKET_PROXY && !proxyWarned {
+						proxyWarned = true
+						logger.Warn("Server does not send visitor addresses for proxy protocol, upgrade the server")
+					}
+					mapMu.Unlock()
+					header = proxyHeader(pm.ProxyProtocol, src, local)
 				}
+				return
 			}
-		case NEWCONN:
-			// 客户端新建立连接
-			sport := make([]byte, 3)
-			io.ReadAtLeast(conn, sport, 3)
-			pt := (uint16(sport[0]) << 8) + uint16(sport[1])
-			id := uint8(sport[2])
-			client := resourceMap[pt]
-			if client != nil {
-				if int(id) >= len(client.WaitWorker) {
+			var recvcmd = []byte{IDLE}
+			// 退出时通知服务端关闭映射
+			done := make(chan struct{})
+			defer close(done)
+			// 备用数据连接，会话结束时关闭
+			var spareMu sync.Mutex
+			var spares = make(map[net.Conn]bool)
+			var noSpare bool
+			go func() {
+				<-done
+				spareMu.Lock()
+				defer spareMu.Unlock()
+				for c := range spares {
+					c.Close()
+				}
+				spares = nil
+			}()
+			// 旧版服务端不认识SPARE，关闭连接或不回复；本会话不再建立备用连接，重连后再尝试
+			var errNoSpare = errors.New("server does not support spare connections")
+			// 备用连接的序号，每个SPARE使用一次
+			var spareSeq uint64
+			// 建立备用连接并等待服务端在其上发送NEWSOCKET，之后与普通数据连接相同
+			var waitSpare = func(conn net.Conn, port uint16) error {
+				// SPARE port(2) seq(8) proof(32) -> SUCCESS
+				seq := atomic.AddUint64(&spareSeq, 1)
+				var buffer bytes.Buffer
+				buffer.Write([]byte{SPARE, uint8(port >> 8), uint8(port)})
+				binary.Write(&buffer, binary.BigEndian, seq)
+				buffer.Write(spareProof(config.Key, nonce, port, seq))
+				conn.SetDeadline(time.Now().Add(DataTimeOut))
+				if _, err := conn.Write(buffer.Bytes()); err != nil {
+					return err
+				}
+				cmd := make([]byte, 1)
+				if _, err := io.ReadFull(conn, cmd); err != nil {
+					return errNoSpare
+				}
+				if cmd[0] != SUCCESS {
+					return fmt.Errorf("server refused spare connection for :%v", port)
+				}
+				conn.SetDeadline(time.Time{})
+				if _, err := io.ReadFull(conn, cmd); err != nil {
+					return err
+				}
+				if cmd[0] != NEWSOCKET && cmd[0] != NEWSOCKET_PROXY {
+					return fmt.Errorf("unexpected command %#02x on spare connection", cmd[0])
+				}
+				sport, sp, dst, header, err := readSocket(conn, cmd[0])
+				if err != nil {
+					return err
+				}
+				if !track() {
+					// 正在退出，不再对接
 					conn.Close()
-					return
-				} else {
-					wk := client.WaitWorker[id]
-					if wk == nil {
-						conn.Close()
+					return nil
+				}
+				go doconn(conn, sport, sp, dst, splitIV, compress, header)
+				return nil
+			}
+			// 保持映射的一个备用连接，被使用后重新建立，映射关闭或会话结束时退出
+			var keepSpare = func(port uint16) {
+				defer Recover()
+				for {
+					mapMu.Lock()
+					_, ok := portmap[port]
+					mapMu.Unlock()
+					spareMu.Lock()
+					ok = ok && !noSpare
+					spareMu.Unlock()
+					if !ok {
 						return
 					}
-					if wk.LastTime < time.Now().Unix() {
-						if wk.Conn != nil {
-							wk.Conn.Close()
+					conn, err := dialServer(d, config.Server, tlsConfig)
+					if err == nil {
+						spareMu.Lock()
+						if spares == nil {
+							spareMu.Unlock()
+							conn.Close()
+							return
+						}
+						spares[conn] = true
+						spareMu.Unlock()
+						err = waitSpare(conn, port)
+						spareMu.Lock()
+						delete(spares, conn)
+						spareMu.Unlock()
+						if err == nil {
+							continue
 						}
 						conn.Close()
+						if err == errNoSpare {
+							spareMu.Lock()
+							warned := noSpare
+							noSpare = true
+							spareMu.Unlock()
+							if !warned {
+								logger.Warn("Server does not support spare connections, spare is ignored, upgrade the server")
+							}
+							return
+						}
+					}
+					select {
+					case <-done:
 						return
+					default:
+					}
+					logger.Debugf("Spare connection for :%v failed: %v", port, err)
+					select {
+					case <-done:
+						return
+					case <-time.After(RetryTime):
 					}
-					var s encrypto.NCopy
-					key, iv := encrypto.GetKeyIv(config.Key)
-					s.Init(conn, key, iv)
-					go encrypto.WCopy(&s, wk.Conn)
-					go encrypto.RCopy(wk.Conn, &s)
-					client.mu.Lock()
-					defer client.mu.Unlock()
-					client.WaitWorker[id] = nil
 				}
-			} else {
-				conn.Close()
 			}
-		default:
-			conn.Close()
-		}
-	}
-
-	for {
-		remoteConn, err := lis.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		go doconn(remoteConn)
-	}
-
-}
-
-// DoClient 客户端处理
-func DoClient(config *ClientConfig) {
-	if config == nil {
-		return
-	}
-	var portmap = make(map[uint16]string, len(config.Map))
-	for _, m := range config.Map {
-		portmap[m.Outer] = m.Inner
-	}
-	var isContinue = true
-	// 新建连接处理
-	var doconn = func(conn net.Conn, sport uint16, sp []byte) {
-		defer Recover()
-		localConn, err := net.Dial("tcp", portmap[sport])
-		if err != nil {
-			conn.Close()
-			log.Println(err)
-			return
-		}
-		conn.Write([]byte{NEWCONN})
-		conn.Write(sp)
-		key, iv := encrypto.GetKeyIv(config.Key)
-		var s encrypto.NCopy
-		s.Init(conn, key, iv)
-		go encrypto.WCopy(&s, localConn)
-		go encrypto.RCopy(localConn, &s)
-	}
-	for isContinue {
-		func() {
-			defer Recover()
-			defer time.Sleep(RetryTime)
-			log.Println("Connecting to server...")
-			serverConn, err := net.Dial("tcp", config.Server)
-			if err != nil {
-				log.Println("Can't connect to server")
-				return
-			}
-			defer serverConn.Close()
-			serverConn.(*net.TCPConn).SetKeepAlive(true)
-			serverConn.(*net.TCPConn).SetKeepAlivePeriod(TcpKeepAlivePeriod)
-			clinfo, _ := json.Marshal(config)
-			// 添加字节缓冲
-			var buffer bytes.Buffer
-			// 发送客户端信息
-			// START info_len info
-			buffer.Write([]byte{START})
-			binary.Write(&buffer, binary.BigEndian, uint64(len(clinfo)))
-			buffer.Write(clinfo)
-			serverConn.Write(buffer.Bytes())
-			buffer.Reset()
-			// 读取返回信息
-			// SUCCESS / ERROR / BUSY
-			var recvcmd = make([]byte, 1)
-			io.ReadAtLeast(serverConn, recvcmd, 1)
-			switch recvcmd[0] {
-			case ERROR_PWD:
-				log.Println("Wrong password")
-				isContinue = false
-				return
-			case ERROR_BUSY:
-				log.Println("Port is occupied")
-				isContinue = false
-				return
-			case ERROR_LIMIT_PORT:
-				log.Println("Does not meet the port range")
-				isContinue = false
-				return
-			}
-			if recvcmd[0] != SUCCESS {
-				// 密码错误
-				log.Println("Unknown error")
-				isContinue = false
-				return
-			}
-			log.Println("Certification successful")
-			for _, cc := range config.Map {
-				log.Printf("%v->:%v\n", cc.Inner, cc.Outer)
-			}
-			recvcmd[0] = IDLE
+			for _, cc := range cfg.Map {
+				for i := 0; i < cc.Spare && i < SpareMax; i++ {
+					go keepSpare(cc.Outer)
+				}
+			}
+			go func() {
+				select {
+				case <-ctx.Done():
+					var buffer bytes.Buffer
+					// KILL token_len token
+					buffer.Write([]byte{KILL, uint8(len(config.KillToken))})
+					buffer.WriteString(config.KillToken)
+					writeNow(buffer.Bytes())
+				case <-done:
+				}
+			}()
+			// 收到服务端第一个PONG后开始心跳，旧版服务端不回复PING
+			var lastPong int64
+			var heartbeat = make(chan struct{})
+			var heartbeatOnce sync.Once
+			if interval := pingInterval(config.PingInterval); interval > 0 {
+				timeout := PingTimeOut
+				if config.PingTimeout > 0 {
+					timeout = time.Duration(config.PingTimeout) * time.Second
+				}
+				// 合并写出时PING最多晚batchInterval发出
+				timeout += batchInterval
+				go func() {
+					select {
+					case <-heartbeat:
+					case <-done:
+						return
+					}
+					t := time.NewTicker(interval)
+					defer t.Stop()
+					for {
+						select {
+						case <-done:
+							return
+						case <-t.C:
+						}
+						sent := time.Now().UnixNano()
+						if _, err := ctl.Write([]byte{PING}); err != nil {
+							return
+						}
+						time.AfterFunc(timeout, func() {
+							select {
+							case <-done:
+								// 会话已结束，平滑重启时旧连接可能仍在使用
+								return
+							default:
+							}
+							if atomic.LoadInt64(&lastPong) < sent {
+								logger.Warn("Server did not answer heartbeat, reconnecting")
+								serverConn.Close()
+							}
+						})
+					}
+				}()
+			}
+			// 最近一次收到服务端命令的时间，PONG不算
+			var lastCmd = time.Now()
 			// 进入指令读取循环
 			for {
+				if config.Refresh > 0 {
+					serverConn.SetReadDeadline(lastCmd.Add(time.Duration(config.Refresh) * time.Second))
+				}
 				_, err = serverConn.Read(recvcmd)
+				if ne, ok := err.(net.Error); ok && ne.Timeout() && config.Refresh > 0 {
+					// 空闲超时，通知服务端关闭映射后重连
+					logger.Info("Control connection idle, refreshing")
+					var buffer bytes.Buffer
+					buffer.Write([]byte{KILL, uint8(len(config.KillToken))})
+					buffer.WriteString(config.KillToken)
+					writeNow(buffer.Bytes())
+					// 等待服务端关闭连接
+					serverConn.SetReadDeadline(time.Now().Add(KillWaitTime))
+					io.Copy(ioutil.Discard, serverConn)
+					refreshing = true
+					return
+				}
 				if err != nil {
 					return
 				}
+				if recvcmd[0] == PONG {
+					atomic.StoreInt64(&lastPong, time.Now().UnixNano())
+					heartbeatOnce.Do(func() { close(heartbeat) })
+					continue
+				}
+				lastCmd = time.Now()
+				serverConn.SetReadDeadline(time.Time{})
 				switch recvcmd[0] {
-				case NEWSOCKET:
+				case NEWSOCKET, NEWSOCKET_PROXY:
 					// 新建连接
-					// 读取远端端口与id
-					sp := make([]byte, 3)
-					io.ReadAtLeast(serverConn, sp, 3)
-					sport := uint16(sp[0])<<8 + uint16(sp[1])
-					conn, err := net.Dial("tcp", config.Server)
+					sport, sp, dst, header, err := readSocket(serverConn, recvcmd[0])
 					if err != nil {
 						return
 					}
-					go doconn(conn, sport, sp)
+					if !track() {
+						// 正在退出，不再建立新连接
+						break
+					}
+					go dialing.Do(func() {
+						conn, err := openData()
+						if err != nil {
+							active.Done()
+							logger.Warn("Can't connect to server for new connection", err)
+							return
+						}
+						doconn(conn, sport, sp, dst, splitIV, compress, header)
+					})
+				case ADD_PORT:
+					// ADD_PORT port(2) code(1)
+					res := make([]byte, 3)
+					if _, err := io.ReadAtLeast(serverConn, res, 3); err != nil {
+						return
+					}
+					pt := uint16(res[0])<<8 | uint16(res[1])
+					mapMu.Lock()
+					m, ok := portmap[pt]
+					if res[2] == SUCCESS {
+						if ok {
+							opened[pt] = m
+							logger.Infof("%v->:%v", m.Inner, m.Outer)
+							for i := 0; i < m.Spare && i < SpareMax; i++ {
+								go keepSpare(pt)
+							}
+						}
+					} else if ok {
+						// 服务端拒绝，移除映射，避免重连时整个握手失败
+						logger.Errorf("Add port %v failed: %v", pt, handshakeError(res[2]))
+						removeMap(pt)
+					}
+					mapMu.Unlock()
+				case ASSIGN:
+					// ASSIGN port(2) code(1) name_len(1) name
+					res := make([]byte, 4)
+					if _, err := io.ReadFull(serverConn, res); err != nil {
+						return
+					}
+					name := make([]byte, res[3])
+					if _, err := io.ReadFull(serverConn, name); err != nil {
+						return
+					}
+					pt := uint16(res[0])<<8 | uint16(res[1])
+					mapMu.Lock()
+					for _, m := range config.ephemeral {
+						if m.Name != string(name) {
+							continue
+						}
+						if res[2] != SUCCESS {
+							logger.Errorf("Assign port for %v failed: %v", m.Name, handshakeError(res[2]))
+							break
+						}
+						m.Outer, m.assigned = pt, true
+						portmap[pt] = m
+						opened[pt] = m
+						assigned = append(assigned, pt)
+						logger.Infof("%v->:%v (%v)", m.Label(), pt, m.Name)
+						for i := 0; i < m.Spare && i < SpareMax; i++ {
+							go keepSpare(pt)
+						}
+						break
+					}
+					mapMu.Unlock()
 				case IDLE:
-					_, err := serverConn.Write([]byte{SUCCESS})
+					_, err := ctl.Write([]byte{SUCCESS})
 					if err != nil {
 						return
 					}
+				case SUCCESS:
+					// 服务端确认KILL
+					logger.Info("Server confirmed shutdown")
+					return
+				case ERROR:
+					logger.Warn("Server rejected shutdown")
+					return
+				case RECONNECT:
+					logger.Info("Server is restarting, reconnecting")
+					handoff = serverConn
+					return
 				}
 			}
 		}()
 	}
+	return fatal
+}
+
+// 进程退出码
+const (
+	// ExitOK 正常退出
+	ExitOK = 0
+	// ExitConfig 配置文件读取或解析失败
+	ExitConfig = 1
+	// ExitNetwork -testconnect无法连接服务端或握手中断
+	ExitNetwork = 2
+	// ExitRejected -testconnect被服务端拒绝
+	ExitRejected = 3
+	// ExitFatal 服务端无法启动，或客户端无法启动、被服务端拒绝
+	ExitFatal = 4
+)
+
+// jsonPosition 将json错误的字节偏移转换为行号与列号
+func jsonPosition(data []byte, offset int64) (line, col int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line, col = 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+// LoadConfig 读取并解析配置文件，返回可直接展示给用户的错误信息
+func LoadConfig(path string) (*Config, error) {
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			return nil, fmt.Errorf("config file not found: %s", path)
+		case os.IsPermission(err):
+			return nil, fmt.Errorf("permission denied reading config file: %s", path)
+		default:
+			return nil, fmt.Errorf("can't read config file %s: %v", path, err)
+		}
+	}
+	var config Config
+	if err = json.Unmarshal(legacyKeys(configBytes), &config); err != nil {
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			line, col := jsonPosition(configBytes, e.Offset)
+			return nil, fmt.Errorf("invalid JSON in %s at line %d, column %d: %v", path, line, col, e)
+		case *json.UnmarshalTypeError:
+			line, col := jsonPosition(configBytes, e.Offset)
+			return nil, fmt.Errorf("invalid value for %q in %s at line %d, column %d: expected %v, got %v", e.Field, path, line, col, e.Type, e.Value)
+		default:
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	}
+	return &config, nil
+}
+
+// AllServers server与servers中的全部服务端配置
+func (c *Config) AllServers() []*ServerConfig {
+	var servers []*ServerConfig
+	if c.Server != nil {
+		servers = append(servers, c.Server)
+	}
+	for _, s := range c.Servers {
+		if s != nil {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// AllClients client与clients中的全部客户端配置
+func (c *Config) AllClients() []*ClientConfig {
+	var clients []*ClientConfig
+	if c.Client != nil {
+		clients = append(clients, c.Client)
+	}
+	for _, cl := range c.Clients {
+		if cl != nil {
+			clients = append(clients, cl)
+		}
+	}
+	return clients
+}
+
+// CheckRole 校验配置是否与显式指定的角色一致；role为空时配置只能包含server或client一种节，
+// 避免只想运行客户端时误带server节而对外开放端口
+func (c *Config) CheckRole(role string) error {
+	var server, client bool
+	switch role {
+	case "":
+		if len(c.AllServers()) > 0 && len(c.AllClients()) > 0 {
+			return errors.New("config contains both server and client sections, select with -role server, client or both, or run with -legacy-role")
+		}
+		return nil
+	case "server":
+		server = true
+	case "client":
+		client = true
+	case "both":
+		server, client = true, true
+	default:
+		return fmt.Errorf("unknown role %q, must be server, client or both", role)
+	}
+	if server != (len(c.AllServers()) > 0) {
+		if server {
+			return fmt.Errorf("role %q requires a server section", role)
+		}
+		return fmt.Errorf("role %q but config contains a server section", role)
+	}
+	if client != (len(c.AllClients()) > 0) {
+		if client {
+			return fmt.Errorf("role %q requires a client section", role)
+		}
+		return fmt.Errorf("role %q but config contains a client section", role)
+	}
+	return nil
+}
+
+// Validate 启动前校验常见的配置错误，如缺少密码、端口为0、端口重复与无法解析的地址
+func (c *Config) Validate() error {
+	servers, clients := c.AllServers(), c.AllClients()
+	if len(servers) == 0 && len(clients) == 0 {
+		return errors.New("config contains neither a server nor a client section")
+	}
+	var ports = make(map[uint16]bool, len(servers))
+	for i, s := range servers {
+		name := "server"
+		if len(servers) > 1 {
+			name = fmt.Sprintf("server %v", i+1)
+		}
+		if s.Key == "" && s.AuthFile == "" {
+			return fmt.Errorf("%v: key is empty", name)
+		}
+		if s.Port == 0 {
+			return fmt.Errorf("%v: port must not be 0", name)
+		}
+		if ports[s.Port] {
+			return fmt.Errorf("%v: duplicate control port %v", name, s.Port)
+		}
+		ports[s.Port] = true
+	}
+	for i, cl := range clients {
+		name := "client"
+		if len(clients) > 1 {
+			name = fmt.Sprintf("client %v", i+1)
+		}
+		if err := cl.validate(); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validate 校验密码、服务端地址与映射
+func (cl *ClientConfig) validate() error {
+	if cl.Key == "" {
+		return errors.New("key is empty")
+	}
+	host, port, err := net.SplitHostPort(cl.Server)
+	if err != nil {
+		return fmt.Errorf("bad server address %q, must be host:port: %v", cl.Server, err)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); host == "" || err != nil || p == 0 {
+		return fmt.Errorf("bad server address %q, must be host:port", cl.Server)
+	}
+	var outers = make(map[uint16]bool, len(cl.Map))
+	for _, m := range cl.Map {
+		if m.Outer == 0 {
+			return fmt.Errorf("outer port of %q must not be 0", m.Inner)
+		}
+		if outers[m.Outer] {
+			return fmt.Errorf("duplicate outer port %v", m.Outer)
+		}
+		outers[m.Outer] = true
+		if m.ForwardProxy != "" && m.AllowInner == nil && cl.AllowInner == nil {
+			return fmt.Errorf("forward_proxy requires allow_inner, port %v", m.Outer)
+		}
+		switch {
+		case m.Dir != nil || m.Inner == StdioInner:
+		case m.Inner == "":
+			// 透明代理、代理端口、多个内网服务与协议识别可以不配置inner
+			if !m.Transparent && m.ForwardProxy == "" && len(m.Backends) == 0 && len(m.Detect) == 0 {
+				return fmt.Errorf("inner address for port %v is empty", m.Outer)
+			}
+		default:
+			if _, err := normalizeAddr(m.Inner); err != nil {
+				return fmt.Errorf("bad inner address %q for port %v: %v", m.Inner, m.Outer, err)
+			}
+		}
+	}
+	return nil
 }
 
 func main() {
 	cfg := flag.String("f", "config.json", "Config file")
+	role := flag.String("role", "", "Run as server, client or both; the config must contain exactly the matching sections")
+	legacyRole := flag.Bool("legacy-role", false, "Without -role, run every section in the config like older versions, even if it has both server and client sections")
+	var testConnect bool
+	flag.BoolVar(&testConnect, "testconnect", false, "Handshake with the configured server without opening ports, then exit")
+	flag.BoolVar(&testConnect, "check", false, "Same as -testconnect")
+	// 不使用配置文件，直接由命令行运行一次性的映射
+	server := flag.String("server", "", "Run a server listening on this address, e.g. :7000, without a config file")
+	client := flag.String("client", "", "Run a client connecting to this server, e.g. example.com:7000, without a config file")
+	key := flag.String("key", "", "Key for -server and -client")
+	var maps mapFlags
+	flag.Var(&maps, "map", "Mapping inner:outer for -client, e.g. 8080:80 or 192.168.1.2:22:2222, repeatable")
+	logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error, overrides the config")
+	logFormat := flag.String("log-format", "", "Log format: text or json, overrides the config")
 	flag.Parse()
+	encrypto.Logf = logger.Warnf
+	// 先使用命令行的设置，读取配置出错时也按该格式输出
+	if err := setupLogger(*logLevel, *logFormat); err != nil {
+		logger.Error(err)
+		os.Exit(ExitConfig)
+	}
 	psignal := make(chan os.Signal, 1)
 	// ctrl+c->SIGINT, kill -9 -> SIGKILL
 	signal.Notify(psignal, syscall.SIGINT, syscall.SIGTERM)
-	configBytes, err := ioutil.ReadFile(*cfg)
-	if err != nil {
-		panic(err)
+	var config *Config
+	var err error
+	inline := *server != "" || *client != "" || *key != "" || len(maps) > 0
+	if inline {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "f" {
+				err = errors.New("-f can't be used with -server, -client, -key or -map")
+			}
+		})
+		if err == nil {
+			config, err = inlineConfig(*server, *client, *key, maps)
+		}
+	} else {
+		config, err = LoadConfig(*cfg)
 	}
-	var config Config
-	err = json.Unmarshal(configBytes, &config)
 	if err != nil {
-		panic(err)
+		logger.Error(err)
+		os.Exit(ExitConfig)
+	}
+	// 命令行未指定的项使用配置中的设置
+	var level, format string
+	if *logLevel == "" {
+		level = config.LogLevel
+	}
+	if *logFormat == "" {
+		format = config.LogFormat
+	}
+	if err = setupLogger(level, format); err != nil {
+		logger.Error(err)
+		os.Exit(ExitConfig)
+	}
+	if tlsPolicy, err = config.TLS.Config(); err != nil {
+		logger.Error("Invalid tls policy:", err)
+		os.Exit(ExitConfig)
+	}
+	// 命令行模式由-server与-client明确指定角色；-testconnect只使用client节，不打开端口
+	if *role != "" || !(inline || *legacyRole || testConnect) {
+		if err = config.CheckRole(*role); err != nil {
+			logger.Error(err)
+			os.Exit(ExitConfig)
+		}
+	}
+	if err = config.Validate(); err != nil {
+		logger.Error("Invalid config:", err)
+		os.Exit(ExitConfig)
+	}
+	servers, clients := config.AllServers(), config.AllClients()
+	if testConnect {
+		if len(clients) == 0 {
+			logger.Error("-testconnect requires a client section")
+			os.Exit(ExitConfig)
+		}
+		// 依次测试每个客户端，返回第一个失败的退出码
+		code := ExitOK
+		for _, cl := range clients {
+			if c := TestConnect(cl); code == ExitOK {
+				code = c
+			}
+		}
+		os.Exit(code)
+	}
+	if *role == "" && *legacyRole && len(servers) > 0 && len(clients) > 0 {
+		logger.Warn("Config contains both server and client sections, running both; use -role both instead of -legacy-role")
+	}
+	// 每个服务端与客户端使用各自的ctx，一个实例出错退出不影响其他实例；收到信号时全部取消
+	root, cancel := context.WithCancel(context.Background())
+	roles := len(servers) + len(clients)
+	roleDone := make(chan error, roles)
+	// 多个实例时错误信息带上是哪一个
+	multi := roles > 1
+	var start = func(name string, fn func(ctx context.Context) error) {
+		ctx, cancel := context.WithCancel(root)
+		go func() {
+			defer cancel()
+			err := fn(ctx)
+			if err != nil && multi {
+				err = fmt.Errorf("%v: %w", name, err)
+			}
+			roleDone <- err
+		}()
+	}
+	for _, s := range servers {
+		s := s
+		start(fmt.Sprintf("server :%v", s.Port), func(ctx context.Context) error { return DoServer(ctx, s) })
+	}
+	for _, cl := range clients {
+		cl := cl
+		start(fmt.Sprintf("client of %v", cl.Server), func(ctx context.Context) error { return DoClient(ctx, cl) })
+	}
+	// 全部实例都退出或收到信号时结束，出错的实例不影响其他实例，最后以失败退出
+	var failed bool
+	var record = func(err error) {
+		if err != nil {
+			failed = true
+			logger.Error(err)
+		}
+	}
+run:
+	for roles > 0 {
+		select {
+		case <-psignal:
+			break run
+		case err := <-roleDone:
+			roles--
+			record(err)
+		}
+	}
+	cancel()
+	// 等待客户端发出KILL，以及已对接的连接在宽限期内结束
+	var grace time.Duration
+	for _, s := range servers {
+		if g := gracePeriod(s.ShutdownGrace); g > grace {
+			grace = g
+		}
+	}
+	for _, cl := range clients {
+		if g := gracePeriod(cl.ShutdownGrace); g > grace {
+			grace = g
+		}
+	}
+	timeout := time.After(grace + KillWaitTime)
+wait:
+	for ; roles > 0; roles-- {
+		select {
+		case err := <-roleDone:
+			record(err)
+		case <-timeout:
+			break wait
+		}
+	}
+	if failed {
+		os.Exit(ExitFatal)
 	}
-	go DoServer(config.Server)
-	go DoClient(config.Client)
-	<-psignal
-	log.Println("Bye~")
+	logger.Info("Bye~")
 }
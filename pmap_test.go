@@ -0,0 +1,930 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"pmap/encrypto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freePort 取一个当前空闲的本机端口
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// localAddr 本机端口的地址
+func localAddr(port uint16) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+}
+
+// echoServer 回显收到的数据的内网服务，返回其地址
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveEcho(t, l)
+}
+
+// serveEcho 在l上回显收到的数据，测试结束时关闭，返回监听地址
+func serveEcho(t *testing.T, l net.Listener) string {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startServer 在空闲端口启动服务端，测试结束时停止
+func startServer(t *testing.T, config *ServerConfig) {
+	t.Helper()
+	if config.Key == "" {
+		config.Key = "test-key"
+	}
+	if config.Port == 0 {
+		config.Port = freePort(t)
+	}
+	if config.Bind == "" {
+		config.Bind = "127.0.0.1"
+	}
+	run(t, func(ctx context.Context) error { return DoServer(ctx, config) })
+	waitDial(t, localAddr(config.Port))
+}
+
+// startClient 连接config.Server启动客户端，等待全部外网端口可连接
+func startClient(t *testing.T, config *ClientConfig) {
+	t.Helper()
+	if config.Key == "" {
+		config.Key = "test-key"
+	}
+	// DoClient会修改config，启动前取出外网端口
+	var outers []uint16
+	for _, m := range config.Map {
+		outers = append(outers, m.Outer)
+	}
+	run(t, func(ctx context.Context) error { return DoClient(ctx, config) })
+	for _, port := range outers {
+		waitDial(t, localAddr(port))
+	}
+}
+
+// run 在协程中运行服务端或客户端，测试结束时取消并等待返回
+func run(t *testing.T, fn func(ctx context.Context) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := fn(ctx); err != nil && ctx.Err() == nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(15 * time.Second):
+			t.Error("not stopped after cancel")
+		}
+	})
+}
+
+// waitDial 等待地址可以连接
+func waitDial(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v not ready: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// roundTrip 经外网端口发送data，返回回显的数据
+func roundTrip(t *testing.T, addr string, data []byte) []byte {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	go c.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("read from %v: %v", addr, err)
+	}
+	return got
+}
+
+func TestTunnelEcho(t *testing.T) {
+	tests := []struct {
+		name   string
+		client ClientConfig
+	}{
+		{"ctr", ClientConfig{}},
+		{"gcm", ClientConfig{Cipher: "gcm"}},
+		{"kdf", ClientConfig{KDFSalt: "salt"}},
+		{"mux", ClientConfig{Mux: true, MuxWindow: MuxFrameMax}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server := &ServerConfig{KDFSalt: tt.client.KDFSalt}
+			startServer(t, server)
+			client := tt.client
+			client.Server = localAddr(server.Port)
+			outer := freePort(t)
+			client.Map = []ClientMapConfig{{Inner: echoServer(t), Outer: outer}}
+			startClient(t, &client)
+			for _, size := range []int{1, 10240, 100000} {
+				data := bytes.Repeat([]byte("pmap"), size/4+1)[:size]
+				if got := roundTrip(t, localAddr(outer), data); !bytes.Equal(got, data) {
+					t.Fatalf("size %v: echo mismatch", size)
+				}
+			}
+		})
+	}
+}
+
+// TestHalfClose 访问者发送请求后关闭写的一端，内网服务读到EOF才回复，访问者仍能收到回复
+func TestHalfClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   ClientConfig
+		compress bool
+	}{
+		{"ctr", ClientConfig{}, false},
+		{"gcm", ClientConfig{Cipher: "gcm"}, false},
+		{"compress", ClientConfig{}, true},
+		{"mux", ClientConfig{Mux: true}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer c.Close()
+						req, err := ioutil.ReadAll(c)
+						if err != nil {
+							return
+						}
+						c.Write(append([]byte("got "), req...))
+					}()
+				}
+			}()
+			server := &ServerConfig{}
+			startServer(t, server)
+			client := tt.client
+			client.Server = localAddr(server.Port)
+			outer := freePort(t)
+			client.Map = []ClientMapConfig{{Inner: l.Addr().String(), Outer: outer, Compress: tt.compress}}
+			startClient(t, &client)
+
+			c, err := net.Dial("tcp", localAddr(outer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "got ping" {
+				t.Fatalf("got %q, want %q", got, "got ping")
+			}
+		})
+	}
+}
+
+func TestResourceSlots(t *testing.T) {
+	r := &Resource{WaitWorker: make([]*Worker, 3)}
+	conns := make([]net.Conn, 4)
+	for i := range conns {
+		conns[i], _ = net.Pipe()
+	}
+	for i := 0; i < 3; i++ {
+		ok, id := r.NewConn(conns[i])
+		if !ok || int(id) != i {
+			t.Fatalf("NewConn #%v = %v, %v; want true, %v", i, ok, id, i)
+		}
+	}
+	if ok, _ := r.NewConn(conns[3]); ok {
+		t.Fatal("NewConn succeeded with all slots taken")
+	}
+	if wk := r.Take(1); wk == nil || wk.Conn != conns[1] {
+		t.Fatal("Take(1) did not return the waiting conn")
+	}
+	if wk := r.Take(1); wk != nil {
+		t.Fatal("slot taken twice")
+	}
+	if ok, id := r.NewConn(conns[3]); !ok || id != 1 {
+		t.Fatalf("NewConn after Take = %v, %v; want true, 1", ok, id)
+	}
+	if wk := r.Take(200); wk != nil {
+		t.Fatal("Take out of range returned a conn")
+	}
+}
+
+// TestResourceGrace 等待超时后的宽限期内连接仍可被NEWCONN取走，不被新连接复用或回收
+func TestResourceGrace(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		grace     int64
+		lastTime  int64 // 等待中连接的超时时间
+		claimable bool  // Take能取走，新连接与reap不复用、不关闭
+	}{
+		{"waiting", 0, now + 30, true},
+		{"expired without grace", 0, now - 2, false},
+		{"expired within grace", 5, now - 2, true},
+		{"expired after grace", 5, now - 10, false},
+	}
+	closed := func(c net.Conn) bool {
+		c.SetWriteDeadline(time.Now())
+		_, err := c.Write([]byte{0})
+		return err == io.ErrClosedPipe
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			// Take
+			r := &Resource{WaitWorker: make([]*Worker, 1), Grace: tt.grace}
+			c, _ := net.Pipe()
+			r.WaitWorker[0] = &Worker{Conn: c, LastTime: tt.lastTime}
+			if wk := r.Take(0); (wk != nil) != tt.claimable || closed(c) == tt.claimable {
+				t.Errorf("Take = %v, closed %v; want claimable %v", wk, closed(c), tt.claimable)
+			}
+
+			// 唯一的位置被占用时新连接能否取代
+			c, _ = net.Pipe()
+			r.WaitWorker[0] = &Worker{Conn: c, LastTime: tt.lastTime}
+			n, _ := net.Pipe()
+			if ok, _ := r.NewConn(n); ok == tt.claimable || closed(c) == tt.claimable {
+				t.Errorf("NewConn = %v, closed %v; want %v", ok, closed(c), !tt.claimable)
+			}
+
+			c, _ = net.Pipe()
+			r.WaitWorker[0] = &Worker{Conn: c, LastTime: tt.lastTime}
+			r.reap()
+			if (r.WaitWorker[0] != nil) != tt.claimable || closed(c) == tt.claimable {
+				t.Errorf("reap kept %v, closed %v; want kept %v", r.WaitWorker[0] != nil, closed(c), tt.claimable)
+			}
+		})
+	}
+}
+
+// TestDialLimiter 一批NEWSOCKET同时到达时，同时建立中的连接不超过上限，超出的排队后全部完成
+func TestDialLimiter(t *testing.T) {
+	tests := []struct {
+		config int // ClientConfig.DialConcurrency
+		burst  int
+		want   int // 同时建立中的最大数量
+	}{
+		{0, 100, DialConcurrency},
+		{-1, 100, DialConcurrency},
+		{1, 20, 1},
+		{4, 50, 4},
+		{8, 5, 5},
+	}
+	for _, tt := range tests {
+		l := newDialLimiter(tt.config)
+		var mu sync.Mutex
+		var cur, peak, done int
+		count := func(d int) int {
+			mu.Lock()
+			defer mu.Unlock()
+			cur += d
+			if cur > peak {
+				peak = cur
+			}
+			if d < 0 {
+				done++
+			}
+			return cur
+		}
+		gate := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < tt.burst; i++ {
+			wg.Add(1)
+			go l.Do(func() {
+				defer wg.Done()
+				count(1)
+				// 建立连接阻塞到放行，期间其余的只能排队
+				<-gate
+				count(-1)
+			})
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for count(0) < tt.want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(gate)
+		wg.Wait()
+		if peak != tt.want || done != tt.burst {
+			t.Errorf("limit %v, burst %v: peak %v, done %v; want peak %v, done %v", tt.config, tt.burst, peak, done, tt.want, tt.burst)
+		}
+	}
+}
+
+// TestSharedInner 同一内网服务映射到多个外网端口时各端口独立统计，关闭其中一个不影响其余端口
+func TestSharedInner(t *testing.T) {
+	inner := echoServer(t)
+	validate := []struct {
+		name    string
+		outers  []uint16
+		wantErr bool
+	}{
+		{"one port", []uint16{9100}, false},
+		{"same inner on two ports", []uint16{9100, 9101}, false},
+		{"same inner on three ports", []uint16{80, 8080, 8081}, false},
+		{"duplicate outer port", []uint16{9100, 9101, 9100}, true},
+	}
+	for _, tt := range validate {
+		cl := &ClientConfig{Key: "k", Server: "127.0.0.1:8808"}
+		for _, port := range tt.outers {
+			cl.Map = append(cl.Map, ClientMapConfig{Inner: inner, Outer: port})
+		}
+		if err := cl.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%v: validate = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	serverAdmin := localAddr(freePort(t))
+	server := &ServerConfig{Admin: serverAdmin}
+	startServer(t, server)
+	clientAdmin := localAddr(freePort(t))
+	a, b := freePort(t), freePort(t)
+	startClient(t, &ClientConfig{
+		Server: localAddr(server.Port),
+		Admin:  clientAdmin,
+		Map:    []ClientMapConfig{{Inner: inner, Outer: a}, {Inner: inner, Outer: b}},
+	})
+	waitDial(t, serverAdmin)
+	waitDial(t, clientAdmin)
+
+	sizes := map[uint16]int{a: 100, b: 3000}
+	for port, size := range sizes {
+		data := bytes.Repeat([]byte{'x'}, size)
+		if got := roundTrip(t, localAddr(port), data); !bytes.Equal(got, data) {
+			t.Fatalf(":%v: echo mismatch", port)
+		}
+	}
+	// 统计在连接关闭后更新；等待端口可连接时的连接也计入Total，只比较字节数
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := portStats(t, serverAdmin)
+		ok := true
+		for port, size := range sizes {
+			if s := stats[port]; s.In != int64(size) || s.Out != int64(size) {
+				ok = false
+			}
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("per-port stats not separated: %+v", stats)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// b上已对接的连接在关闭a后继续转发
+	c, err := net.Dial("tcp", localAddr(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	echo := func(msg string) {
+		t.Helper()
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != msg {
+			t.Fatalf("echo on :%v = %q, %v", b, got, err)
+		}
+	}
+	echo("before")
+	resp, err := http.Post("http://"+clientAdmin+"/unmap?port="+strconv.Itoa(int(a)), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /unmap: %v", resp.Status)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if !portStats(t, serverAdmin)[a].Open {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf(":%v still open after unmap", a)
+		}
+	}
+	echo("after")
+	if !portStats(t, serverAdmin)[b].Open {
+		t.Fatalf(":%v closed with :%v", b, a)
+	}
+	data := []byte("new connection")
+	if got := roundTrip(t, localAddr(b), data); !bytes.Equal(got, data) {
+		t.Fatalf(":%v: echo mismatch after unmapping :%v", b, a)
+	}
+}
+
+// TestClientMemoryFlood 大量连接同时到达时，同时转发的连接数不超过客户端的内存预算
+func TestClientMemoryFlood(t *testing.T) {
+	const flood, budget = 12, 3
+	admin := localAddr(freePort(t))
+	server := &ServerConfig{Admin: admin, ClientMemory: int64(budget * 2 * encrypto.BufferSize)}
+	startServer(t, server)
+	outer := freePort(t)
+	startClient(t, &ClientConfig{Server: localAddr(server.Port), Map: []ClientMapConfig{{Inner: echoServer(t), Outer: outer}}})
+	waitDial(t, admin)
+	// 等待检测端口时的连接结束，归还预算
+	for deadline := time.Now().Add(5 * time.Second); portStats(t, admin)[outer].Active != 0; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("probe connections still active")
+		}
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	var wg sync.WaitGroup
+	for i := 0; i < flood; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := net.Dial("tcp", localAddr(outer))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			c.Write([]byte("ping"))
+			if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+				// 超出预算被关闭
+				c.Close()
+				return
+			}
+			// 转发中的连接保持打开，占用预算
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	s := portStats(t, admin)[outer]
+	if len(conns) != budget || s.Active != budget || s.RejectedMemory != flood-budget {
+		t.Fatalf("%v connections forwarded, stats %+v; want %v forwarded, %v rejected", len(conns), s, budget, flood-budget)
+	}
+}
+
+// portStats 服务端/ports的端口统计
+func portStats(t *testing.T, admin string) map[uint16]PortStat {
+	t.Helper()
+	resp, err := http.Get("http://" + admin + "/ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Ports []PortStat `json:"ports"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	stats := make(map[uint16]PortStat, len(result.Ports))
+	for _, p := range result.Ports {
+		stats[p.Port] = p
+	}
+	return stats
+}
+
+// TestControlWriter 客户端不读取控制连接时，命令在队列满后被拒绝而不阻塞发送方，关闭后连接断开
+func TestControlWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		reading  bool // 客户端读取控制连接
+		accepted int  // 连续发送时被接受的命令数
+	}{
+		{"default queue, not reading", 0, false, ControlQueueSize + 1},
+		{"queue 1, not reading", 1, false, 2},
+		{"queue 4, not reading", 4, false, 5},
+		{"queue 4, reading", 4, true, 100},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			w := NewControlWriter(server, tt.size)
+			go w.Run()
+			received := make(chan []byte, 1)
+			if tt.reading {
+				go func() {
+					b, _ := ioutil.ReadAll(client)
+					received <- b
+				}()
+			}
+			var want []byte
+			done := make(chan int)
+			go func() {
+				n := 0
+				for i := 0; i < 100; i++ {
+					if !w.Send([]byte{byte(i)}) {
+						break
+					}
+					want = append(want, byte(i))
+					n++
+					if tt.reading {
+						// 等待写出，队列不会满
+						time.Sleep(time.Millisecond)
+					} else if n == 1 {
+						// 等待Run取走第一条命令并阻塞在写出
+						time.Sleep(20 * time.Millisecond)
+					}
+				}
+				done <- n
+			}()
+			select {
+			case n := <-done:
+				if n != tt.accepted {
+					t.Fatalf("%v commands accepted, want %v", n, tt.accepted)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Send blocked on a client that doesn't read")
+			}
+			w.Close()
+			if w.Send([]byte{IDLE}) {
+				t.Fatal("Send succeeded after Close")
+			}
+			if tt.reading {
+				if got := <-received; !bytes.Equal(got, want) {
+					t.Fatalf("client received %v, want %v", got, want)
+				}
+				return
+			}
+			// 关闭后客户端读到已写出的部分后EOF
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := ioutil.ReadAll(client); err != nil {
+				t.Fatalf("control connection not closed: %v", err)
+			}
+		})
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{"127.0.0.1:3306", "127.0.0.1:3306", false},
+		{"db.internal:5432", "db.internal:5432", false},
+		{"localhost:http", "localhost:http", false},
+		{"[::1]:3306", "[::1]:3306", false},
+		{"[fd00::10]:443", "[fd00::10]:443", false},
+		// 未加方括号的IPv6地址，最后一个冒号之后为端口
+		{"::1:3306", "[::1]:3306", false},
+		{"fd00::10:443", "[fd00::10]:443", false},
+		{"::ffff:10.0.0.1:80", "[::ffff:10.0.0.1]:80", false},
+		{"127.0.0.1", "", true},
+		{"[::1]", "", true},
+		{"db.internal:99999", "", true},
+		{"db.internal:no-such-service", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeAddr(tt.addr)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeAddr(%q) = %q, %v; want %q, error %v", tt.addr, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// 映射的内网地址、协议识别规则与多个内网服务都经过规范化
+	m := ClientMapConfig{Outer: 1, Inner: "::1:3306", Backends: []string{"[::1]:3306", "fd00::2:3306"}, Detect: []DetectRule{{Inner: "::1:22"}}}
+	if err := m.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Inner != "[::1]:3306" || m.Detect[0].Inner != "[::1]:22" {
+		t.Errorf("normalize: inner %q, detect inner %q", m.Inner, m.Detect[0].Inner)
+	}
+	if m.lb == nil || len(m.lb.backends) != 2 || m.lb.backends[1].addr != "[fd00::2]:3306" {
+		t.Errorf("normalize: backends not normalized or deduplicated")
+	}
+}
+
+// TestTunnelIPv6Inner 内网服务为IPv6地址时，加方括号与不加方括号的写法都能连接
+func TestTunnelIPv6Inner(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available:", err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	serveEcho(t, l)
+	for _, inner := range []string{"[::1]:" + port, "::1:" + port} {
+		server := &ServerConfig{}
+		startServer(t, server)
+		outer := freePort(t)
+		startClient(t, &ClientConfig{Server: localAddr(server.Port), Map: []ClientMapConfig{{Inner: inner, Outer: outer}}})
+		data := []byte("ipv6 " + inner)
+		if got := roundTrip(t, localAddr(outer), data); !bytes.Equal(got, data) {
+			t.Fatalf("inner %v: echo mismatch", inner)
+		}
+	}
+}
+
+func TestUnixInner(t *testing.T) {
+	tests := []struct {
+		m       ClientMapConfig
+		network string // normalize成功时Inner的网络类型与地址
+		address string
+		wantErr bool
+	}{
+		{ClientMapConfig{Outer: 1, Inner: "unix:/run/php-fpm.sock"}, "unix", "/run/php-fpm.sock", false},
+		{ClientMapConfig{Outer: 1, Inner: "unix:relative.sock"}, "unix", "relative.sock", false},
+		{ClientMapConfig{Outer: 1, Inner: "unixhost:80"}, "tcp", "unixhost:80", false},
+		{ClientMapConfig{Outer: 1, Inner: "127.0.0.1:80"}, "tcp", "127.0.0.1:80", false},
+		{ClientMapConfig{Outer: 1, Inner: "unix:"}, "", "", true},
+		{ClientMapConfig{Outer: 1, Inner: "unix:/run/dns.sock", Proto: ProtoUDP}, "", "", true},
+		{ClientMapConfig{Outer: 1, Backends: []string{"unix:/run/a.sock", "unix:/run/b.sock"}}, "unix", "/run/a.sock", false},
+	}
+	for _, tt := range tests {
+		m := tt.m
+		err := m.normalize()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: normalize = %v, want error %v", tt.m.Inner, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if network, address := splitNetwork(m.Inner); network != tt.network || address != tt.address {
+			t.Errorf("%q: splitNetwork = %v, %v; want %v, %v", tt.m.Inner, network, address, tt.network, tt.address)
+		}
+	}
+	// Unix域套接字没有主机名，开启inner_tls时须指定证书名称
+	m := ClientMapConfig{Outer: 1, Inner: "unix:/run/app.sock", InnerTLS: true}
+	if _, err := m.Dial(); err == nil || !strings.Contains(err.Error(), "inner_tls_name") {
+		t.Errorf("inner_tls without a name: Dial = %v", err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "echo.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip("unix sockets not available:", err)
+	}
+	serveEcho(t, l)
+	server := &ServerConfig{}
+	startServer(t, server)
+	outer := freePort(t)
+	startClient(t, &ClientConfig{Server: localAddr(server.Port), Map: []ClientMapConfig{{Inner: UnixScheme + sock, Outer: outer}}})
+	data := bytes.Repeat([]byte("unix"), 5000)
+	if got := roundTrip(t, localAddr(outer), data); !bytes.Equal(got, data) {
+		t.Fatal("echo mismatch through the unix socket inner")
+	}
+}
+
+// TestReusePortOuterBusy reuse_port只作用于控制端口，其他客户端不能绑定已映射的端口
+func TestReusePortOuterBusy(t *testing.T) {
+	server := &ServerConfig{ReusePort: true}
+	startServer(t, server)
+	outer := freePort(t)
+	startClient(t, &ClientConfig{Server: localAddr(server.Port), Map: []ClientMapConfig{{Inner: echoServer(t), Outer: outer}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := DoClient(ctx, &ClientConfig{Key: "test-key", Server: localAddr(server.Port), Map: []ClientMapConfig{{Inner: echoServer(t), Outer: outer}}})
+	if err == nil || !strings.Contains(err.Error(), handshakeError(ERROR_BUSY)) {
+		t.Fatalf("second client mapping the same port: %v, want %q", err, handshakeError(ERROR_BUSY))
+	}
+	data := []byte("first client")
+	if got := roundTrip(t, localAddr(outer), data); !bytes.Equal(got, data) {
+		t.Fatal("first client's mapping broken by the second client")
+	}
+}
+
+// TestForgedSpare 没有正确应答的SPARE被拒绝，收不到访问者的连接
+func TestForgedSpare(t *testing.T) {
+	server := &ServerConfig{}
+	startServer(t, server)
+	outer := freePort(t)
+	startClient(t, &ClientConfig{Server: localAddr(server.Port), Map: []ClientMapConfig{{Inner: echoServer(t), Outer: outer, Spare: 2}}})
+
+	forge := func(proof []byte) net.Conn {
+		c, err := net.Dial("tcp", localAddr(server.Port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		b.Write([]byte{SPARE, uint8(outer >> 8), uint8(outer)})
+		b.Write([]byte{0, 0, 0, 0, 0, 0, 0, 1})
+		b.Write(proof)
+		if _, err := c.Write(b.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	// 以会话的认证挑战计算应答的SPARE被接受，并收到访问者的NEWSOCKET
+	ctrl, err := net.Dial("tcp", localAddr(server.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	go io.Copy(ioutil.Discard, ctrl)
+	port := freePort(t)
+	cfg := &ClientConfig{Key: "test-key", Server: localAddr(server.Port), Map: []ClientMapConfig{{Inner: "127.0.0.1:1", Outer: port, Spare: 1}}}
+	code, _, _, nonce, err := clientHandshake(ctrl, cfg, false, cfg.startVersion())
+	if err != nil || !successCode(code) {
+		t.Fatalf("handshake: %v, %v", code, err)
+	}
+	spare, err := net.Dial("tcp", localAddr(server.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spare.Close()
+	spare.SetDeadline(time.Now().Add(5 * time.Second))
+	var b bytes.Buffer
+	b.Write([]byte{SPARE, uint8(port >> 8), uint8(port)})
+	b.Write([]byte{0, 0, 0, 0, 0, 0, 0, 7})
+	b.Write(spareProof("test-key", nonce, port, 7))
+	spare.Write(b.Bytes())
+	cmd := make([]byte, 1)
+	if _, err := io.ReadFull(spare, cmd); err != nil || cmd[0] != SUCCESS {
+		t.Fatalf("valid spare: %v, %v; want SUCCESS", cmd, err)
+	}
+	visitor, err := net.Dial("tcp", localAddr(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	if _, err := io.ReadFull(spare, cmd); err != nil || cmd[0] != NEWSOCKET {
+		t.Fatalf("valid spare: %v, %v; want NEWSOCKET", cmd, err)
+	}
+
+	for _, proof := range [][]byte{
+		make([]byte, SpareProofSize),
+		spareProof("test-key", nonce, outer, 1),
+		spareProof("test-key", make([]byte, AuthNonceSize), outer, 1),
+		spareProof("wrong-key", make([]byte, AuthNonceSize), outer, 1),
+	} {
+		c := forge(proof)
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		// 有访问者时也只会收到ERROR，之后连接关闭
+		data := []byte("visitor")
+		if got := roundTrip(t, localAddr(outer), data); !bytes.Equal(got, data) {
+			t.Fatal("echo mismatch")
+		}
+		got, err := ioutil.ReadAll(c)
+		if err != nil || !bytes.Equal(got, []byte{ERROR}) {
+			t.Fatalf("forged spare received %v, %v; want only ERROR", got, err)
+		}
+	}
+}
+
+// TestRevokeKeyClosesForwards 吊销密钥时已对接的转发连接一并关闭
+func TestRevokeKeyClosesForwards(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "keys.json")
+	if err := ioutil.WriteFile(authFile, []byte(`{"alice-secret": {"label": "alice"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	admin := localAddr(freePort(t))
+	server := &ServerConfig{AuthFile: authFile, Admin: admin}
+	startServer(t, server)
+	outer := freePort(t)
+	client := &ClientConfig{Key: "alice-secret", Server: localAddr(server.Port), Map: []ClientMapConfig{{Inner: echoServer(t), Outer: outer}}}
+	// 吊销后客户端重连失败退出，不作为测试失败
+	run(t, func(ctx context.Context) error {
+		DoClient(ctx, client)
+		return nil
+	})
+	waitDial(t, localAddr(outer))
+	waitDial(t, admin)
+
+	c, err := net.Dial("tcp", localAddr(outer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, "http://"+admin+"/keys?key=alice-secret", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /keys: %v", resp.Status)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("forwarded connection still open after revoke: %v", err)
+	}
+}
+
+func TestCheckRole(t *testing.T) {
+	server, client := &ServerConfig{}, &ClientConfig{}
+	tests := []struct {
+		name    string
+		config  Config
+		role    string
+		wantErr bool
+	}{
+		{"server only", Config{Server: server}, "", false},
+		{"client only", Config{Client: client}, "", false},
+		{"both without role", Config{Server: server, Client: client}, "", true},
+		{"both in clients without role", Config{Server: server, Clients: []*ClientConfig{client}}, "", true},
+		{"both with role both", Config{Server: server, Client: client}, "both", false},
+		{"client role with server section", Config{Server: server, Client: client}, "client", true},
+		{"server role without server section", Config{Client: client}, "server", true},
+		{"unknown role", Config{Client: client}, "proxy", true},
+	}
+	for _, tt := range tests {
+		if err := tt.config.CheckRole(tt.role); (err != nil) != tt.wantErr {
+			t.Errorf("%v: CheckRole(%q) = %v, want error %v", tt.name, tt.role, err, tt.wantErr)
+		}
+	}
+}
+
+func TestKillTokenOK(t *testing.T) {
+	tests := []struct {
+		token, want string
+		ok          bool
+	}{
+		{"", "", true},
+		{"anything", "", true},
+		{"secret", "secret", true},
+		{"", "secret", false},
+		{"secre", "secret", false},
+		{"secret!", "secret", false},
+		{"Secret", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := killTokenOK([]byte(tt.token), tt.want); got != tt.ok {
+			t.Errorf("killTokenOK(%q, %q) = %v, want %v", tt.token, tt.want, got, tt.ok)
+		}
+	}
+}
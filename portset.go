@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portRange 闭区间[min, max]，单个端口时min与max相同
+type portRange struct {
+	min, max uint16
+}
+
+// PortSet 允许客户端使用的端口，由多个范围与单个端口组成，为nil时不限制
+type PortSet []portRange
+
+// ParsePortSet 解析逗号分隔的端口与范围，如"8000-8100,9000,9443"
+func ParsePortSet(s string) (PortSet, error) {
+	var set = PortSet{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		r, err := parsePortRange(item)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, r)
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("empty port set %q", s)
+	}
+	return set, nil
+}
+
+func parsePortRange(item string) (portRange, error) {
+	lo, hi := item, item
+	if i := strings.Index(item, "-"); i >= 0 {
+		lo, hi = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+	}
+	min, err1 := strconv.ParseUint(lo, 10, 16)
+	max, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || min == 0 || min > max {
+		return portRange{}, fmt.Errorf("bad port or range %q", item)
+	}
+	return portRange{uint16(min), uint16(max)}, nil
+}
+
+// Contains 端口是否在任一范围内
+func (p PortSet) Contains(port uint16) bool {
+	if p == nil {
+		return true
+	}
+	for _, r := range p {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (p PortSet) String() string {
+	var items []string
+	for _, r := range p {
+		if r.min == r.max {
+			items = append(items, strconv.Itoa(int(r.min)))
+		} else {
+			items = append(items, fmt.Sprintf("%v-%v", r.min, r.max))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// UnmarshalJSON 接受字符串"8000-8100,9000"、字符串数组["8000-8100", "9000"]，
+// 以及旧的[min, max]数字数组：与旧版本相同，少于两项时不限制，多于两项时只使用前两项，min大于max时不允许任何端口
+func (p *PortSet) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*p = nil
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if strings.TrimSpace(s) == "" {
+			*p = nil
+			return nil
+		}
+		set, err := ParsePortSet(s)
+		if err != nil {
+			return err
+		}
+		*p = set
+		return nil
+	}
+	var legacy []uint16
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		switch {
+		case len(legacy) < 2:
+			*p = nil
+		case legacy[0] > legacy[1]:
+			*p = PortSet{}
+		default:
+			*p = PortSet{{legacy[0], legacy[1]}}
+		}
+		return nil
+	}
+	var items []string
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("bad port set %s", data)
+	}
+	set, err := ParsePortSet(strings.Join(items, ","))
+	if err != nil {
+		return err
+	}
+	*p = set
+	return nil
+}
+
+// MarshalJSON 输出为字符串形式，不限制时为null
+func (p PortSet) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(p.String())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPortSetUnmarshal(t *testing.T) {
+	tests := []struct {
+		data    string
+		in, out []uint16 // 允许与不允许的端口，in为nil且out为nil表示不限制
+		wantErr bool
+	}{
+		{`"8000-8100,9000,9443"`, []uint16{8000, 8050, 8100, 9000, 9443}, []uint16{7999, 8101, 9001}, false},
+		{`["8000-8100", "9000"]`, []uint16{8000, 9000}, []uint16{9001}, false},
+		{`""`, nil, nil, false},
+		{`null`, nil, nil, false},
+		{`"9000-8000"`, nil, nil, true},
+		{`"abc"`, nil, nil, true},
+		// 旧的[min, max]写法与旧版本的行为一致
+		{`[9000, 9100]`, []uint16{9000, 9100}, []uint16{8999, 9101}, false},
+		{`[]`, nil, nil, false},
+		{`[9000]`, nil, nil, false},
+		{`[9000, 9100, 9500]`, []uint16{9050}, []uint16{9500}, false},
+		{`[9100, 9000]`, nil, []uint16{9000, 9050, 9100}, false},
+	}
+	for _, tt := range tests {
+		var p PortSet
+		err := json.Unmarshal([]byte(tt.data), &p)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.data, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if tt.in == nil && tt.out == nil && p != nil {
+			t.Errorf("%s: got %v, want no limit", tt.data, p)
+		}
+		for _, port := range tt.in {
+			if !p.Contains(port) {
+				t.Errorf("%s: %v not allowed", tt.data, port)
+			}
+		}
+		for _, port := range tt.out {
+			if p.Contains(port) {
+				t.Errorf("%s: %v allowed", tt.data, port)
+			}
+		}
+	}
+}
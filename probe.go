@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProbeTimeOut 探测的连接与等待超时时间
+const ProbeTimeOut = 3 * time.Second
+
+// ProbeStep 单步探测结果
+type ProbeStep struct {
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms"`
+	FirstByte bool    `json:"first_byte,omitempty"` // 通过隧道收到了内网服务发来的数据
+	Error     string  `json:"error,omitempty"`
+}
+
+// ProbeResult 单个映射的探测结果
+type ProbeResult struct {
+	Outer   uint16     `json:"outer"`
+	Inner   string     `json:"inner"`
+	Backend ProbeStep  `json:"backend"`
+	Tunnel  *ProbeStep `json:"tunnel,omitempty"`
+}
+
+func since(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// probeBackend 直接连接内网服务
+func probeBackend(m ClientMapConfig) (step ProbeStep) {
+	start := time.Now()
+	conn, err := m.Dial()
+	step.LatencyMs = since(start)
+	if err != nil {
+		step.Error = err.Error()
+		return
+	}
+	conn.Close()
+	step.OK = true
+	return
+}
+
+// 启动时检查内网服务的模式
+const (
+	CheckWarn   = "warn"   // 不可达时输出警告
+	CheckStrict = "strict" // 不可达时拒绝启动
+)
+
+// checkBackends 启动时连接每个内网服务一次并输出结果，全部可达时返回true；
+// 透明代理与标准输入输出的映射没有固定的内网地址，跳过
+func checkBackends(config *ClientConfig) bool {
+	ok := true
+	var check = func(m ClientMapConfig) {
+		step := probeBackend(m)
+		if step.OK {
+			logger.Infof("Backend %v for :%v reachable (%.1fms)", m.Inner, m.Outer, step.LatencyMs)
+			return
+		}
+		ok = false
+		logger.Warnf("Backend %v for :%v unreachable: %v", m.Inner, m.Outer, step.Error)
+	}
+	for _, m := range config.Map {
+		if m.Transparent || m.ForwardProxy != "" || m.Inner == StdioInner || m.Dir != nil {
+			continue
+		}
+		if m.lb != nil {
+			// 逐个检查负载均衡的内网服务
+			for _, be := range m.lb.backends {
+				bm := m
+				bm.Inner = be.addr
+				bm.lb = nil
+				check(bm)
+			}
+		} else {
+			check(m)
+		}
+		for _, rule := range m.Detect {
+			rm := m
+			rm.Inner = rule.Inner
+			rm.lb = nil
+			check(rm)
+		}
+	}
+	return ok
+}
+
+// probeTunnel 从外网地址连接，经过服务端与客户端到达内网服务；
+// 内网服务主动发送数据时能收到首字节，否则连接在等待期间未被关闭即认为隧道可用
+func probeTunnel(server string, m ClientMapConfig) (step ProbeStep) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		step.Error = err.Error()
+		return
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(int(m.Outer))), ProbeTimeOut)
+	if err != nil {
+		step.Error = err.Error()
+		return
+	}
+	defer conn.Close()
+	step.LatencyMs = since(start)
+	conn.SetReadDeadline(time.Now().Add(ProbeTimeOut))
+	var b = make([]byte, 1)
+	_, err = conn.Read(b)
+	if err == nil {
+		// 收到首字节时以首字节到达时间为延迟
+		step.LatencyMs = since(start)
+		step.OK, step.FirstByte = true, true
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		step.OK = true
+	} else {
+		step.Error = "tunnel closed: " + err.Error()
+	}
+	return
+}
+
+// probeHandler POST /probe/{outer}[?tunnel=1] 探测单个映射
+func probeHandler(config *ClientConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pt, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/probe/"), 10, 16)
+		if err != nil {
+			http.Error(w, "bad port", http.StatusBadRequest)
+			return
+		}
+		var m *ClientMapConfig
+		for i := range config.Map {
+			if config.Map[i].Outer == uint16(pt) {
+				m = &config.Map[i]
+			}
+		}
+		if m == nil {
+			http.Error(w, "port is not mapped", http.StatusNotFound)
+			return
+		}
+		res := ProbeResult{Outer: m.Outer, Inner: m.Inner, Backend: probeBackend(*m)}
+		if r.FormValue("tunnel") == "1" {
+			step := probeTunnel(config.Server, *m)
+			res.Tunnel = &step
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
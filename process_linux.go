@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// commLen 内核保留的进程名长度，/proc/<pid>/comm只有前15个字节
+const commLen = 15
+
+// processRunning 是否有名为name的进程在运行，比较/proc/<pid>/comm
+func processRunning(name string) (bool, error) {
+	if len(name) > commLen {
+		name = name[:commLen]
+	}
+	comms, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		return false, err
+	}
+	for _, path := range comms {
+		// 进程可能已经退出，读取失败时跳过
+		comm, err := ioutil.ReadFile(path)
+		if err == nil && string(bytes.TrimSuffix(comm, []byte("\n"))) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// processRunning 非Linux平台不支持按进程名判断条件
+func processRunning(name string) (bool, error) {
+	return false, errors.New("process conditions are only supported on linux")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// PROXY协议版本
+const (
+	ProxyV1 = 1 // 文本格式
+	ProxyV2 = 2 // 二进制格式
+)
+
+// proxyV2Sig PROXY协议v2的固定签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader 生成访问者地址src、外网端口地址dst的PROXY协议头；
+// 地址无法解析(如旧版服务端没有发送地址)时生成UNKNOWN(v1)或LOCAL(v2)，内网服务使用连接本身的地址
+func proxyHeader(version int, src, dst string) []byte {
+	sip, sport := splitIPPort(src)
+	dip, dport := splitIPPort(dst)
+	known := sip != nil && dip != nil
+	v4 := known && sip.To4() != nil && dip.To4() != nil
+	if known && !v4 && (sip.To4() != nil || dip.To4() != nil) {
+		// 地址族不同
+		known = false
+	}
+	if version == ProxyV1 {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case v4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %v %v %v %v\r\n", sip.To4(), dip.To4(), sport, dport))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %v %v %v %v\r\n", sip, dip, sport, dport))
+		}
+	}
+	// v2: 签名(12) 版本与命令(1) 地址族与协议(1) 长度(2) 地址
+	hdr := append([]byte(nil), proxyV2Sig...)
+	switch {
+	case !known:
+		return append(hdr, 0x20, 0x00, 0, 0)
+	case v4:
+		hdr = append(hdr, 0x21, 0x11, 0, 12)
+		hdr = append(hdr, sip.To4()...)
+		hdr = append(hdr, dip.To4()...)
+	default:
+		hdr = append(hdr, 0x21, 0x21, 0, 36)
+		hdr = append(hdr, sip.To16()...)
+		hdr = append(hdr, dip.To16()...)
+	}
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:2], sport)
+	binary.BigEndian.PutUint16(ports[2:], dport)
+	return append(hdr, ports[:]...)
+}
+
+// splitIPPort 解析ip:port，失败时返回nil
+func splitIPPort(addr string) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0
+	}
+	return net.ParseIP(host), uint16(p)
+}
+
+// readAddr 读取 len(1) addr
+func readAddr(r io.Reader) (string, error) {
+	alen := make([]byte, 1)
+	if _, err := io.ReadFull(r, alen); err != nil {
+		return "", err
+	}
+	addr := make([]byte, alen[0])
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", err
+	}
+	return string(addr), nil
+}
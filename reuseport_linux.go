@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// soReusePort syscall包中未定义SO_REUSEPORT
+const soReusePort = 0xf
+
+// listenConfig reuse为true时设置SO_REUSEPORT，允许新进程绑定相同端口
+func listenConfig(reuse bool) *net.ListenConfig {
+	if !reuse {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setsockoptInt(c, syscall.SOL_SOCKET, soReusePort, 1)
+		},
+	}
+}
+
+// setsockoptInt 在socket创建后、bind/connect前设置选项
+func setsockoptInt(c syscall.RawConn, level, opt, value int) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// restartSignal 通知旧进程停止接受新连接并排空的信号
+func restartSignal() os.Signal {
+	return syscall.SIGUSR2
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// listenConfig 非Linux平台不支持SO_REUSEPORT
+func listenConfig(reuse bool) *net.ListenConfig {
+	if reuse {
+		logger.Warn("SO_REUSEPORT is only supported on linux, ignored")
+	}
+	return &net.ListenConfig{}
+}
+
+// restartSignal 非Linux平台不支持平滑重启
+func restartSignal() os.Signal {
+	return nil
+}
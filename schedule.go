@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleCheck 检查开放时段切换的间隔，仅用于记录切换日志
+const ScheduleCheck = time.Minute
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ScheduleConfig 映射端口接受连接的时段，时段外的连接直接关闭
+type ScheduleConfig struct {
+	Timezone string   `json:"timezone"` // 时区，如Asia/Shanghai，为空使用服务端本地时区
+	Windows  []string `json:"windows"`  // 开放时段，如"Mon-Fri 09:00-18:00"、"Sat,Sun 10:00-12:00"、"22:00-06:00"(每天，跨零点)
+
+	loc     *time.Location
+	windows []window
+}
+
+// window 单个开放时段，start/end为当天的分钟数，end小于start时跨零点
+type window struct {
+	days       [7]bool
+	start, end int
+}
+
+// Init 校验并解析配置
+func (s *ScheduleConfig) Init() error {
+	s.loc = time.Local
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return err
+		}
+		s.loc = loc
+	}
+	if len(s.Windows) == 0 {
+		return fmt.Errorf("schedule has no windows")
+	}
+	s.windows = s.windows[:0]
+	for _, v := range s.Windows {
+		w, err := parseWindow(v)
+		if err != nil {
+			return fmt.Errorf("bad schedule window %q: %v", v, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return nil
+}
+
+// parseWindow 解析"[星期] HH:MM-HH:MM"
+func parseWindow(v string) (w window, err error) {
+	fields := strings.Fields(v)
+	var days, hours string
+	switch len(fields) {
+	case 1:
+		days, hours = "sun-sat", fields[0]
+	case 2:
+		days, hours = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+	for _, part := range strings.Split(strings.ToLower(days), ",") {
+		from, to := part, part
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		a, ok1 := weekdays[from]
+		b, ok2 := weekdays[to]
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("unknown day %q", part)
+		}
+		// 允许Fri-Mon这样跨周末的范围
+		for d := a; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == b {
+				break
+			}
+		}
+	}
+	i := strings.IndexByte(hours, '-')
+	if i < 0 {
+		return w, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+	if w.start, err = parseClock(hours[:i]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(hours[i+1:]); err != nil {
+		return w, err
+	}
+	if w.start == w.end || w.start == 24*60 {
+		return w, fmt.Errorf("empty time range")
+	}
+	return w, nil
+}
+
+// parseClock 解析HH:MM为当天的分钟数，允许24:00
+func parseClock(v string) (int, error) {
+	i := strings.IndexByte(v, ':')
+	if i < 0 {
+		return 0, fmt.Errorf("bad time %q", v)
+	}
+	h, err1 := strconv.Atoi(v[:i])
+	m, err2 := strconv.Atoi(v[i+1:])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time %q", v)
+	}
+	return h*60 + m, nil
+}
+
+// Open 判断t时刻是否在开放时段内
+func (s *ScheduleConfig) Open(t time.Time) bool {
+	t = t.In(s.loc)
+	day := t.Weekday()
+	min := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[day] && min >= w.start && min < w.end {
+				return true
+			}
+			continue
+		}
+		// 跨零点的时段属于开始的那一天
+		if (w.days[day] && min >= w.start) || (w.days[(day+6)%7] && min < w.end) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// StdioInner 内网地址为该值时，隧道连接到进程的标准输入输出
+const StdioInner = "stdio:"
+
+// stdioUsed 标准输入只能被读取一次，只服务第一个连接
+var stdioUsed int32
+
+// stdioAddr 标准输入输出的地址
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return StdioInner }
+
+// stdioConn 以标准输入为读端、标准输出为写端的连接，标准输入EOF后隧道随之关闭
+type stdioConn struct{}
+
+// dialStdio 连接标准输入输出
+func dialStdio() (net.Conn, error) {
+	if !atomic.CompareAndSwapInt32(&stdioUsed, 0, 1) {
+		return nil, errors.New("stdio is already used by another connection")
+	}
+	return stdioConn{}, nil
+}
+
+func (stdioConn) Read(p []byte) (int, error)         { return os.Stdin.Read(p) }
+func (stdioConn) Write(p []byte) (int, error)        { return os.Stdout.Write(p) }
+func (stdioConn) Close() error                       { return nil }
+func (stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (stdioConn) SetDeadline(t time.Time) error      { return os.Stdin.SetDeadline(t) }
+func (stdioConn) SetReadDeadline(t time.Time) error  { return os.Stdin.SetReadDeadline(t) }
+func (stdioConn) SetWriteDeadline(t time.Time) error { return os.Stdout.SetWriteDeadline(t) }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TeeMaxBytes 默认最多复制的字节数
+	TeeMaxBytes = 10 * 1024 * 1024
+	// TeeDuration 默认复制时长
+	TeeDuration = time.Minute
+	// teeQueue 待写出的数据块数量，写满时丢弃，不影响转发
+	teeQueue = 256
+)
+
+// 复制方向
+const (
+	TeeIn   = "in"   // 外网访问者发来的数据
+	TeeOut  = "out"  // 发回外网访问者的数据
+	TeeBoth = "both" // 双向，按时间顺序混合写出
+)
+
+// Tee 将端口转发的数据复制一份到文件或连接，用于调试，达到大小或时间上限后自动停止
+type Tee struct {
+	Port    uint16
+	Target  string
+	Dir     string
+	limit   int64
+	written int64
+	dropped int64
+	queue   chan []byte
+	done    chan struct{}
+	once    sync.Once
+	timer   *time.Timer
+	onStop  func(*Tee)
+}
+
+// NewTee 打开复制目标，target为 file:/path 或 tcp:host:port
+func NewTee(port uint16, target, dir string, limit int64, d time.Duration, onStop func(*Tee)) (*Tee, error) {
+	if dir != TeeIn && dir != TeeOut && dir != TeeBoth {
+		return nil, errors.New("dir must be in, out or both")
+	}
+	var w io.WriteCloser
+	var err error
+	switch {
+	case strings.HasPrefix(target, "file:"):
+		w, err = os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	case strings.HasPrefix(target, "tcp:"):
+		w, err = net.Dial("tcp", strings.TrimPrefix(target, "tcp:"))
+	default:
+		err = errors.New("target must be file:/path or tcp:host:port")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = TeeMaxBytes
+	}
+	if d <= 0 {
+		d = TeeDuration
+	}
+	t := &Tee{
+		Port:   port,
+		Target: target,
+		Dir:    dir,
+		limit:  limit,
+		queue:  make(chan []byte, teeQueue),
+		done:   make(chan struct{}),
+		onStop: onStop,
+	}
+	t.timer = time.AfterFunc(d, t.Stop)
+	go t.run(w)
+	logger.Infof("Tee started on port %v to %v (%v, max %v bytes, %v)", port, target, dir, limit, d)
+	return t, nil
+}
+
+func (t *Tee) run(w io.WriteCloser) {
+	defer w.Close()
+	for {
+		select {
+		case b := <-t.queue:
+			if _, err := w.Write(b); err != nil {
+				t.Stop()
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Copy 复制一块数据，不阻塞转发
+func (t *Tee) Copy(dir string, p []byte) {
+	if t.Dir != TeeBoth && t.Dir != dir {
+		return
+	}
+	if atomic.AddInt64(&t.written, int64(len(p))) > t.limit {
+		t.Stop()
+		return
+	}
+	b := append([]byte(nil), p...)
+	select {
+	case t.queue <- b:
+	case <-t.done:
+	default:
+		atomic.AddInt64(&t.dropped, int64(len(p)))
+	}
+}
+
+// Stop 停止复制
+func (t *Tee) Stop() {
+	t.once.Do(func() {
+		t.timer.Stop()
+		close(t.done)
+		if t.onStop != nil {
+			t.onStop(t)
+		}
+		logger.Infof("Tee stopped on port %v, %v bytes copied, %v bytes dropped",
+			t.Port, atomic.LoadInt64(&t.written), atomic.LoadInt64(&t.dropped))
+	})
+}
+
+// teeConn 外网连接，读写时复制给端口当前的Tee
+type teeConn struct {
+	net.Conn
+	rsc *Resource
+}
+
+func (c *teeConn) Unwrap() net.Conn { return c.Conn }
+
+func (c *teeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if t := c.rsc.Tee(); t != nil {
+			t.Copy(TeeIn, p[:n])
+		}
+	}
+	return n, err
+}
+
+func (c *teeConn) Write(p []byte) (int, error) {
+	if t := c.rsc.Tee(); t != nil {
+		t.Copy(TeeOut, p)
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSPolicy 所有TLS监听与连接统一使用的加密策略
+type TLSPolicy struct {
+	MinVersion   string   `json:"min_version"`   // 最低TLS版本，默认1.2
+	CipherSuites []string `json:"cipher_suites"` // 允许的加密套件(仅对TLS1.2及以下生效)，为空使用Go默认
+	Curves       []string `json:"curves"`        // 曲线偏好，为空使用Go默认
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// tlsPolicy 由main校验配置后设置
+var tlsPolicy = &tls.Config{MinVersion: tls.VersionTLS12}
+
+// newTLSConfig 按统一策略创建tls.Config
+func newTLSConfig() *tls.Config {
+	return tlsPolicy.Clone()
+}
+
+// Config 校验策略并生成基础tls.Config
+func (p *TLSPolicy) Config() (*tls.Config, error) {
+	var cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	if p == nil {
+		return cfg, nil
+	}
+	if p.MinVersion != "" {
+		ver, ok := tlsVersions[p.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls min_version %q", p.MinVersion)
+		}
+		cfg.MinVersion = ver
+	}
+	if p.CipherSuites != nil {
+		var suites = make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, name := range p.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure tls cipher suite %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+		if len(cfg.CipherSuites) == 0 && cfg.MinVersion < tls.VersionTLS13 {
+			return nil, fmt.Errorf("tls cipher_suites is empty")
+		}
+	}
+	if p.Curves != nil {
+		for _, name := range p.Curves {
+			id, ok := tlsCurves[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown tls curve %q", name)
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+		if len(cfg.CurvePreferences) == 0 {
+			return nil, fmt.Errorf("tls curves is empty")
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// UDPSessionTimeOut UDP没有连接关闭的通知，会话双向都没有数据超过该时间后关闭
+	UDPSessionTimeOut = 60 * time.Second
+	// udpQueue 每个会话等待读取的数据报数量，写满时丢弃
+	udpQueue = 64
+	// udpBacklog 等待Accept的新会话数量，写满时丢弃新会话的数据报
+	udpBacklog = 64
+	// udpMaxDatagram 数据报最大长度
+	udpMaxDatagram = 65535
+)
+
+// 映射协议
+const (
+	ProtoTCP = "tcp"
+	ProtoUDP = "udp"
+)
+
+var errSessionClosed = errors.New("udp session closed")
+
+// datagramConn 将逐个收发数据报的连接转换为字节流，隧道中每个数据报以 长度(2) 数据 传输，保留数据报边界
+type datagramConn struct {
+	net.Conn
+	rbuf    []byte
+	pending []byte
+	wbuf    []byte
+}
+
+func newDatagramConn(conn net.Conn) *datagramConn {
+	return &datagramConn{Conn: conn, rbuf: make([]byte, 2+udpMaxDatagram)}
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		n, err := c.Conn.Read(c.rbuf[2:])
+		if err != nil {
+			// 已连接的UDP收到ICMP端口不可达时返回ECONNREFUSED，内网服务可能稍后恢复
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return 0, err
+		}
+		c.rbuf[0], c.rbuf[1] = uint8(n>>8), uint8(n)
+		c.pending = c.rbuf[:2+n]
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	c.wbuf = append(c.wbuf, p...)
+	for len(c.wbuf) >= 2 {
+		size := int(c.wbuf[0])<<8 | int(c.wbuf[1])
+		if len(c.wbuf) < 2+size {
+			break
+		}
+		if _, err := c.Conn.Write(c.wbuf[2 : 2+size]); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+			return 0, err
+		}
+		c.wbuf = c.wbuf[2+size:]
+	}
+	// 剩余的不完整数据报移到缓冲开头，避免缓冲无限增长
+	c.wbuf = append(c.wbuf[:0], c.wbuf...)
+	return len(p), nil
+}
+
+// udpListener 将UDP端口按来源地址拆分为会话，以net.Listener的形式交给与TCP相同的转发流程
+type udpListener struct {
+	pc       net.PacketConn
+	timeout  time.Duration
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	accept   chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// listenUDP 监听UDP地址，timeout为会话空闲超时
+func listenUDP(addr string, timeout time.Duration) (*udpListener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = UDPSessionTimeOut
+	}
+	l := &udpListener{
+		pc:       pc,
+		timeout:  timeout,
+		sessions: make(map[string]*udpSession),
+		accept:   make(chan net.Conn, udpBacklog),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (l *udpListener) serve() {
+	defer l.Close()
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b := append([]byte(nil), buf[:n]...)
+		l.mu.Lock()
+		s := l.sessions[addr.String()]
+		if s == nil {
+			s = newUDPSession(l, addr)
+			select {
+			case l.accept <- newDatagramConn(s):
+				l.sessions[addr.String()] = s
+			default:
+				// 新会话过多，丢弃
+				l.mu.Unlock()
+				continue
+			}
+		}
+		l.mu.Unlock()
+		s.push(b)
+	}
+}
+
+// Accept 返回新来源地址的会话
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, errSessionClosed
+	}
+}
+
+// Close 关闭端口与全部会话
+func (l *udpListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.pc.Close()
+		l.mu.Lock()
+		sessions := make([]*udpSession, 0, len(l.sessions))
+		for _, s := range l.sessions {
+			sessions = append(sessions, s)
+		}
+		l.mu.Unlock()
+		for _, s := range sessions {
+			s.Close()
+		}
+	})
+	return nil
+}
+
+// Addr 实现net.Listener
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *udpListener) remove(s *udpSession) {
+	l.mu.Lock()
+	if l.sessions[s.addr.String()] == s {
+		delete(l.sessions, s.addr.String())
+	}
+	l.mu.Unlock()
+}
+
+// udpSession 单个来源地址的会话，每次Read返回一个数据报
+type udpSession struct {
+	l      *udpListener
+	addr   net.Addr
+	queue  chan []byte
+	done   chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	active time.Time
+}
+
+func newUDPSession(l *udpListener, addr net.Addr) *udpSession {
+	return &udpSession{
+		l:      l,
+		addr:   addr,
+		queue:  make(chan []byte, udpQueue),
+		done:   make(chan struct{}),
+		active: time.Now(),
+	}
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.active = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpSession) push(b []byte) {
+	s.touch()
+	select {
+	case s.queue <- b:
+	default:
+	}
+}
+
+func (s *udpSession) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		remain := s.l.timeout - time.Since(s.active)
+		s.mu.Unlock()
+		if remain <= 0 {
+			s.Close()
+			return 0, io.EOF
+		}
+		t := time.NewTimer(remain)
+		select {
+		case b := <-s.queue:
+			t.Stop()
+			return copy(p, b), nil
+		case <-s.done:
+			t.Stop()
+			return 0, io.EOF
+		case <-t.C:
+			// 期间可能有发出的数据，重新计算剩余时间
+		}
+	}
+}
+
+func (s *udpSession) Write(p []byte) (int, error) {
+	select {
+	case <-s.done:
+		return 0, errSessionClosed
+	default:
+	}
+	s.touch()
+	return s.l.pc.WriteTo(p, s.addr)
+}
+
+func (s *udpSession) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.l.remove(s)
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr                { return s.l.pc.LocalAddr() }
+func (s *udpSession) RemoteAddr() net.Addr               { return s.addr }
+func (s *udpSession) SetDeadline(t time.Time) error      { return nil }
+func (s *udpSession) SetReadDeadline(t time.Time) error  { return nil }
+func (s *udpSession) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// WhenInterval 默认检查映射条件的间隔
+const WhenInterval = 2 * time.Second
+
+// WhenConfig 映射只在本机条件成立时打开，条件成立时向服务端添加映射，不成立时关闭；file与process只能指定一个
+type WhenConfig struct {
+	File     string `json:"file"`     // 文件存在时成立，如开发服务器运行时持有的锁文件或pid文件
+	Process  string `json:"process"`  // 有该名称的进程运行时成立，只支持Linux
+	Interval int    `json:"interval"` // 检查间隔(秒)，默认2
+}
+
+// Init 校验配置
+func (w *WhenConfig) Init() error {
+	switch {
+	case (w.File == "") == (w.Process == ""):
+		return errors.New("when needs exactly one of file or process")
+	case w.Interval < 0:
+		return errors.New("when interval must not be negative")
+	}
+	if w.Process != "" {
+		if _, err := processRunning(w.Process); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Holds 条件当前是否成立
+func (w *WhenConfig) Holds() bool {
+	if w.File != "" {
+		_, err := os.Stat(w.File)
+		return err == nil
+	}
+	ok, _ := processRunning(w.Process)
+	return ok
+}
+
+// String 日志中的条件描述
+func (w *WhenConfig) String() string {
+	if w.File != "" {
+		return "file " + w.File
+	}
+	return "process " + w.Process
+}
+
+// watchWhen 定期检查m的条件，成立时add，不再成立时remove，ctx取消后返回；
+// 只在条件变化时操作，运行中手动关闭的映射在条件再次成立时重新添加
+func watchWhen(ctx context.Context, m ClientMapConfig, add func(ClientMapConfig) error, remove func(uint16) bool) {
+	interval := WhenInterval
+	if m.When.Interval > 0 {
+		interval = time.Duration(m.When.Interval) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var open bool
+	for {
+		if holds := m.When.Holds(); holds != open {
+			open = holds
+			if holds {
+				logger.Infof("Condition %v met, mapping %v->:%v", m.When, m.Label(), m.Outer)
+				if err := add(m); err != nil {
+					logger.Errorf("Add port %v failed: %v", m.Outer, err)
+				}
+			} else {
+				logger.Infof("Condition %v no longer met, closing port %v", m.When, m.Outer)
+				remove(m.Outer)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
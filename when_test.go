@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWhenFile 条件文件出现时打开映射，删除后关闭
+func TestWhenFile(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "dev.lock")
+	server := &ServerConfig{}
+	startServer(t, server)
+	outer := freePort(t)
+	client := &ClientConfig{
+		Key:    "test-key",
+		Server: localAddr(server.Port),
+		Map:    []ClientMapConfig{{Inner: echoServer(t), Outer: outer, When: &WhenConfig{File: lock, Interval: 1}}},
+	}
+	run(t, func(ctx context.Context) error { return DoClient(ctx, client) })
+	time.Sleep(200 * time.Millisecond)
+	if c, err := net.Dial("tcp", localAddr(outer)); err == nil {
+		c.Close()
+		t.Fatal("port opened before the condition holds")
+	}
+	if err := ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitDial(t, localAddr(outer))
+	if got := roundTrip(t, localAddr(outer), []byte("ping")); string(got) != "ping" {
+		t.Fatalf("echo %q", got)
+	}
+	os.Remove(lock)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", localAddr(outer))
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("port still open after the condition stopped holding")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWhenInit(t *testing.T) {
+	for _, w := range []WhenConfig{{}, {File: "a", Process: "b"}, {File: "a", Interval: -1}} {
+		if err := w.Init(); err == nil {
+			t.Errorf("%+v accepted", w)
+		}
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	comm, err := ioutil.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := &WhenConfig{Process: strings.TrimSpace(string(comm))}
+	if err := self.Init(); err != nil || !self.Holds() {
+		t.Errorf("own process %q not found: %v", self.Process, err)
+	}
+	if (&WhenConfig{Process: "pmap-no-such-process"}).Holds() {
+		t.Error("found a process that does not exist")
+	}
+}